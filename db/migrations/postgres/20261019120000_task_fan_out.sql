@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS tasks_left_id_idx ON tasks (left_id);
+CREATE INDEX IF NOT EXISTS tasks_right_id_idx ON tasks (right_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tasks_left_id_idx;
+DROP INDEX IF EXISTS tasks_right_id_idx;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS task_cache
+(
+    operation  VARCHAR(1),
+    arg1       DOUBLE PRECISION,
+    arg2       DOUBLE PRECISION,
+    result     DOUBLE PRECISION,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    PRIMARY KEY (operation, arg1, arg2)
+);
+CREATE INDEX IF NOT EXISTS task_cache_created_at_idx ON task_cache (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS task_cache;
+-- +goose StatementEnd
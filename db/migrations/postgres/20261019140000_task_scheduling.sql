@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS cost          BIGINT      DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS critical_path BIGINT      DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS created_at    TIMESTAMPTZ DEFAULT now();
+CREATE INDEX IF NOT EXISTS tasks_expression_id_idx ON tasks (expression_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tasks_expression_id_idx;
+ALTER TABLE tasks
+    DROP COLUMN IF EXISTS cost,
+    DROP COLUMN IF EXISTS critical_path,
+    DROP COLUMN IF EXISTS created_at;
+-- +goose StatementEnd
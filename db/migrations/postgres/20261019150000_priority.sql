@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 1;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS priority;
+ALTER TABLE tasks
+    DROP COLUMN IF EXISTS priority;
+-- +goose StatementEnd
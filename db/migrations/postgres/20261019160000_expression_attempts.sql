@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS attempt            INTEGER     NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS attempt_started_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE TABLE IF NOT EXISTS expression_attempts
+(
+    expression_id INTEGER REFERENCES expressions (id) ON DELETE CASCADE,
+    attempt       INTEGER,
+    status        VARCHAR(9),
+    result        VARCHAR(100),
+    started_at    TIMESTAMPTZ,
+    finished_at   TIMESTAMPTZ DEFAULT now(),
+    PRIMARY KEY (expression_id, attempt)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS expression_attempts;
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS attempt,
+    DROP COLUMN IF EXISTS attempt_started_at;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS sweeps
+(
+    id         SERIAL PRIMARY KEY,
+    expression TEXT,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS sweep_id     INTEGER REFERENCES sweeps (id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS sweep_values JSONB;
+CREATE INDEX IF NOT EXISTS expressions_sweep_id_idx ON expressions (sweep_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS sweep_id,
+    DROP COLUMN IF EXISTS sweep_values;
+DROP TABLE IF EXISTS sweeps;
+-- +goose StatementEnd
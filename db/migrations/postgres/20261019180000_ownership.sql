@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS id SERIAL PRIMARY KEY;
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE sweeps
+    ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS expressions_user_id_idx ON expressions (user_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expressions_user_id_idx;
+ALTER TABLE sweeps
+    DROP COLUMN IF EXISTS user_id;
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS user_id;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS id;
+-- +goose StatementEnd
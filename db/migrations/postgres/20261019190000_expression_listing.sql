@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS expressions_user_id_created_at_idx ON expressions (user_id, created_at, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expressions_user_id_created_at_idx;
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS created_at;
+-- +goose StatementEnd
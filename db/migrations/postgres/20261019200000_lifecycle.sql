@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS started_at  TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS finished_at TIMESTAMPTZ;
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS dispatched_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS completed_at  TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS agent_id      TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tasks
+    DROP COLUMN IF EXISTS dispatched_at,
+    DROP COLUMN IF EXISTS completed_at,
+    DROP COLUMN IF EXISTS agent_id;
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS started_at,
+    DROP COLUMN IF EXISTS finished_at;
+-- +goose StatementEnd
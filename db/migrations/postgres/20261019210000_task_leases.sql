@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS state       TEXT NOT NULL DEFAULT 'pending',
+    ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS stream_id   TEXT;
+UPDATE tasks SET state = 'done' WHERE completed_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS tasks_state_idx ON tasks (state);
+CREATE INDEX IF NOT EXISTS tasks_lease_until_idx ON tasks (lease_until) WHERE state = 'leased';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tasks_lease_until_idx;
+DROP INDEX IF EXISTS tasks_state_idx;
+ALTER TABLE tasks
+    DROP COLUMN IF EXISTS state,
+    DROP COLUMN IF EXISTS lease_until,
+    DROP COLUMN IF EXISTS stream_id;
+-- +goose StatementEnd
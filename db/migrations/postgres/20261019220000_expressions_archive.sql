@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS expressions_archive
+(
+    id          INTEGER PRIMARY KEY,
+    user_id     INTEGER,
+    status      VARCHAR(9),
+    result      VARCHAR(100),
+    expression  TEXT,
+    priority    INTEGER,
+    created_at  TIMESTAMPTZ,
+    started_at  TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS expressions_archive_user_id_idx ON expressions_archive (user_id, id);
+CREATE INDEX IF NOT EXISTS expressions_retention_idx ON expressions (status, COALESCE(finished_at, created_at));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expressions_retention_idx;
+DROP TABLE IF EXISTS expressions_archive;
+-- +goose StatementEnd
@@ -0,0 +1,87 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS expression_events
+(
+    id            BIGSERIAL PRIMARY KEY,
+    expression_id INTEGER     NOT NULL REFERENCES expressions (id) ON DELETE CASCADE,
+    type          TEXT        NOT NULL,
+    task_id       UUID,
+    agent_id      TEXT,
+    detail        TEXT,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS expression_events_expression_id_idx ON expression_events (expression_id, id);
+
+-- История только дописывается: события пишут триггеры, чтобы ни один переход не потерялся.
+CREATE OR REPLACE FUNCTION expression_events_append_only() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'expression_events: история не меняется';
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER expression_events_append_only
+    BEFORE UPDATE
+    ON expression_events
+    FOR EACH ROW
+EXECUTE FUNCTION expression_events_append_only();
+
+CREATE OR REPLACE FUNCTION expression_event() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO expression_events(expression_id, type) VALUES (NEW.id, 'submitted');
+    ELSIF NEW.attempt <> OLD.attempt THEN
+        INSERT INTO expression_events(expression_id, type, detail) VALUES (NEW.id, 'retried', OLD.status);
+    ELSIF NEW.main_task_id IS NOT NULL AND NEW.main_task_id IS DISTINCT FROM OLD.main_task_id THEN
+        INSERT INTO expression_events(expression_id, type, task_id) VALUES (NEW.id, 'parsed', NEW.main_task_id);
+    END IF;
+    IF NEW.status = 'Подсчёт' THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.status IS NOT DISTINCT FROM OLD.status THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+    INSERT INTO expression_events(expression_id, type, detail)
+    VALUES (NEW.id,
+            CASE NEW.status WHEN 'Выполнено' THEN 'completed' WHEN 'Ошибка' THEN 'errored' ELSE 'cancelled' END,
+            NEW.result);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER expression_event
+    AFTER INSERT OR UPDATE OF status, main_task_id, attempt
+    ON expressions
+    FOR EACH ROW
+EXECUTE FUNCTION expression_event();
+
+CREATE OR REPLACE FUNCTION task_event() RETURNS trigger AS
+$$
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id, agent_id, detail)
+    VALUES (NEW.expression_id,
+            CASE NEW.state WHEN 'leased' THEN 'task_dispatched' WHEN 'done' THEN 'task_completed' ELSE 'task_requeued' END,
+            NEW.id,
+            CASE WHEN OLD.state = 'leased' OR NEW.state = 'leased' THEN NEW.agent_id END,
+            CASE WHEN NEW.state = 'done' THEN NEW.result::TEXT END);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER task_event
+    AFTER UPDATE OF state
+    ON tasks
+    FOR EACH ROW
+    WHEN (NEW.state IS DISTINCT FROM OLD.state)
+EXECUTE FUNCTION task_event();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS task_event ON tasks;
+DROP FUNCTION IF EXISTS task_event();
+DROP TRIGGER IF EXISTS expression_event ON expressions;
+DROP FUNCTION IF EXISTS expression_event();
+DROP TABLE IF EXISTS expression_events;
+DROP FUNCTION IF EXISTS expression_events_append_only();
+-- +goose StatementEnd
@@ -0,0 +1,114 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Статусы хранятся кодами, русские подписи отдаёт приложение. Триггер истории на время
+-- перевода выключен: смена подписи на код - не переход.
+ALTER TABLE expressions DISABLE TRIGGER expression_event;
+UPDATE expressions
+SET status = CASE status
+                 WHEN 'Подсчёт' THEN CASE WHEN started_at IS NULL THEN 'pending' ELSE 'running' END
+                 WHEN 'Выполнено' THEN 'done'
+                 WHEN 'Ошибка' THEN 'failed'
+                 WHEN 'Отменено' THEN 'cancelled'
+                 ELSE status END;
+ALTER TABLE expressions ENABLE TRIGGER expression_event;
+UPDATE expression_attempts
+SET status = CASE status
+                 WHEN 'Подсчёт' THEN 'running'
+                 WHEN 'Выполнено' THEN 'done'
+                 WHEN 'Ошибка' THEN 'failed'
+                 WHEN 'Отменено' THEN 'cancelled'
+                 ELSE status END;
+UPDATE expressions_archive
+SET status = CASE status
+                 WHEN 'Выполнено' THEN 'done'
+                 WHEN 'Ошибка' THEN 'failed'
+                 WHEN 'Отменено' THEN 'cancelled'
+                 ELSE status END;
+
+ALTER TABLE expressions
+    ALTER COLUMN status SET NOT NULL,
+    ADD CONSTRAINT expressions_status_check CHECK (status IN ('pending', 'running', 'done', 'failed', 'cancelled'));
+
+CREATE OR REPLACE FUNCTION expression_event() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO expression_events(expression_id, type) VALUES (NEW.id, 'submitted');
+    ELSIF NEW.attempt <> OLD.attempt THEN
+        INSERT INTO expression_events(expression_id, type, detail) VALUES (NEW.id, 'retried', OLD.status);
+    ELSIF NEW.main_task_id IS NOT NULL AND NEW.main_task_id IS DISTINCT FROM OLD.main_task_id THEN
+        INSERT INTO expression_events(expression_id, type, task_id) VALUES (NEW.id, 'parsed', NEW.main_task_id);
+    END IF;
+    IF NEW.status NOT IN ('done', 'failed', 'cancelled') THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.status IS NOT DISTINCT FROM OLD.status THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+    INSERT INTO expression_events(expression_id, type, detail)
+    VALUES (NEW.id,
+            CASE NEW.status WHEN 'done' THEN 'completed' WHEN 'failed' THEN 'errored' ELSE 'cancelled' END,
+            NEW.result);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION expression_event() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        INSERT INTO expression_events(expression_id, type) VALUES (NEW.id, 'submitted');
+    ELSIF NEW.attempt <> OLD.attempt THEN
+        INSERT INTO expression_events(expression_id, type, detail) VALUES (NEW.id, 'retried', OLD.status);
+    ELSIF NEW.main_task_id IS NOT NULL AND NEW.main_task_id IS DISTINCT FROM OLD.main_task_id THEN
+        INSERT INTO expression_events(expression_id, type, task_id) VALUES (NEW.id, 'parsed', NEW.main_task_id);
+    END IF;
+    IF NEW.status = 'Подсчёт' THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.status IS NOT DISTINCT FROM OLD.status THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+    INSERT INTO expression_events(expression_id, type, detail)
+    VALUES (NEW.id,
+            CASE NEW.status WHEN 'Выполнено' THEN 'completed' WHEN 'Ошибка' THEN 'errored' ELSE 'cancelled' END,
+            NEW.result);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE expressions
+    DROP CONSTRAINT IF EXISTS expressions_status_check,
+    ALTER COLUMN status DROP NOT NULL;
+
+ALTER TABLE expressions DISABLE TRIGGER expression_event;
+UPDATE expressions
+SET status = CASE status
+                 WHEN 'pending' THEN 'Подсчёт'
+                 WHEN 'running' THEN 'Подсчёт'
+                 WHEN 'done' THEN 'Выполнено'
+                 WHEN 'failed' THEN 'Ошибка'
+                 WHEN 'cancelled' THEN 'Отменено'
+                 ELSE status END;
+ALTER TABLE expressions ENABLE TRIGGER expression_event;
+UPDATE expression_attempts
+SET status = CASE status
+                 WHEN 'running' THEN 'Подсчёт'
+                 WHEN 'done' THEN 'Выполнено'
+                 WHEN 'failed' THEN 'Ошибка'
+                 WHEN 'cancelled' THEN 'Отменено'
+                 ELSE status END;
+UPDATE expressions_archive
+SET status = CASE status
+                 WHEN 'done' THEN 'Выполнено'
+                 WHEN 'failed' THEN 'Ошибка'
+                 WHEN 'cancelled' THEN 'Отменено'
+                 ELSE status END;
+-- +goose StatementEnd
@@ -0,0 +1,69 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS callback_url TEXT;
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS webhook_secret TEXT;
+
+CREATE TABLE IF NOT EXISTS webhook_outbox
+(
+    id              BIGSERIAL PRIMARY KEY,
+    expression_id   INTEGER     NOT NULL REFERENCES expressions (id) ON DELETE CASCADE,
+    user_id         INTEGER REFERENCES users (id) ON DELETE CASCADE,
+    url             TEXT        NOT NULL,
+    payload         TEXT        NOT NULL,
+    state           TEXT        NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'delivered', 'failed')),
+    attempts        INTEGER     NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_due_idx ON webhook_outbox (next_attempt_at) WHERE state = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_outbox_expression_id_idx ON webhook_outbox (expression_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id          BIGSERIAL PRIMARY KEY,
+    webhook_id  BIGINT      NOT NULL REFERENCES webhook_outbox (id) ON DELETE CASCADE,
+    attempt     INTEGER     NOT NULL,
+    status_code INTEGER,
+    error       TEXT,
+    duration_ms BIGINT      NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+
+-- Вебхук ставится в outbox той же транзакцией, что переводит выражение в конечный статус.
+CREATE OR REPLACE FUNCTION webhook_enqueue() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.status IS NOT DISTINCT FROM OLD.status THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+    INSERT INTO webhook_outbox(expression_id, user_id, url, payload)
+    VALUES (NEW.id, NEW.user_id, NEW.callback_url,
+            json_build_object('id', NEW.id, 'status', NEW.status, 'result', NEW.result, 'attempt', NEW.attempt,
+                              'finished_at', NEW.finished_at)::TEXT);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER webhook_enqueue
+    AFTER INSERT OR UPDATE OF status
+    ON expressions
+    FOR EACH ROW
+    WHEN (NEW.callback_url IS NOT NULL AND NEW.status IN ('done', 'failed', 'cancelled'))
+EXECUTE FUNCTION webhook_enqueue();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS webhook_enqueue ON expressions;
+DROP FUNCTION IF EXISTS webhook_enqueue();
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_outbox;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS webhook_secret;
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS callback_url;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS external_ref TEXT;
+
+CREATE TABLE IF NOT EXISTS imports
+(
+    id          SERIAL PRIMARY KEY,
+    user_id     INTEGER REFERENCES users (id) ON DELETE CASCADE,
+    filename    TEXT,
+    state       TEXT        NOT NULL DEFAULT 'running' CHECK (state IN ('running', 'done', 'failed')),
+    total       INTEGER     NOT NULL,
+    processed   INTEGER     NOT NULL DEFAULT 0,
+    created     INTEGER     NOT NULL DEFAULT 0,
+    failed      INTEGER     NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS import_errors
+(
+    import_id INTEGER NOT NULL REFERENCES imports (id) ON DELETE CASCADE,
+    line      INTEGER NOT NULL,
+    ref       TEXT,
+    error     TEXT    NOT NULL,
+    PRIMARY KEY (import_id, line)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS import_errors;
+DROP TABLE IF EXISTS imports;
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS external_ref;
+-- +goose StatementEnd
@@ -0,0 +1,42 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Ошибку вычисления агент присылает в стриме, задача с ней помечается упавшей.
+CREATE OR REPLACE FUNCTION task_event() RETURNS trigger AS
+$$
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id, agent_id, detail)
+    VALUES (NEW.expression_id,
+            CASE NEW.state
+                WHEN 'leased' THEN 'task_dispatched'
+                WHEN 'done' THEN 'task_completed'
+                WHEN 'cancelled' THEN 'task_cancelled'
+                WHEN 'failed' THEN 'task_failed'
+                ELSE 'task_requeued' END,
+            NEW.id,
+            CASE WHEN OLD.state = 'leased' OR NEW.state = 'leased' THEN NEW.agent_id END,
+            CASE WHEN NEW.state = 'done' THEN NEW.result::TEXT END);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM tasks WHERE state = 'failed';
+CREATE OR REPLACE FUNCTION task_event() RETURNS trigger AS
+$$
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id, agent_id, detail)
+    VALUES (NEW.expression_id,
+            CASE NEW.state
+                WHEN 'leased' THEN 'task_dispatched'
+                WHEN 'done' THEN 'task_completed'
+                WHEN 'cancelled' THEN 'task_cancelled'
+                ELSE 'task_requeued' END,
+            NEW.id,
+            CASE WHEN OLD.state = 'leased' OR NEW.state = 'leased' THEN NEW.agent_id END,
+            CASE WHEN NEW.state = 'done' THEN NEW.result::TEXT END);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Оставшееся время открытых задач выражения для политики sjf, уменьшается при решении каждой задачи.
+ALTER TABLE expressions
+    ADD COLUMN IF NOT EXISTS remaining_cost BIGINT NOT NULL DEFAULT 0;
+UPDATE expressions e
+SET remaining_cost = s.cost
+FROM (SELECT expression_id, sum(cost) AS cost
+      FROM tasks
+      WHERE state IN ('pending', 'leased')
+      GROUP BY expression_id) s
+WHERE e.id = s.expression_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE expressions
+    DROP COLUMN IF EXISTS remaining_cost;
+-- +goose StatementEnd
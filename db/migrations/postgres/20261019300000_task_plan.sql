@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- left_id и right_id обнуляются по мере счёта, план выражения строится по исходным связям.
+-- У задач, сохранённых до миграции, известны только ещё не посчитанные связи.
+ALTER TABLE tasks
+    ADD COLUMN IF NOT EXISTS plan_left_id  UUID,
+    ADD COLUMN IF NOT EXISTS plan_right_id UUID;
+UPDATE tasks
+SET plan_left_id  = left_id,
+    plan_right_id = right_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tasks
+    DROP COLUMN IF EXISTS plan_left_id,
+    DROP COLUMN IF EXISTS plan_right_id;
+-- +goose StatementEnd
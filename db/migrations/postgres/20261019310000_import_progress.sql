@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Время последнего прогресса импорта: задания без прогресса дольше RETRY_STUCK_S завершаются с ошибкой.
+ALTER TABLE imports
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+UPDATE imports
+SET updated_at = COALESCE(finished_at, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE imports
+    DROP COLUMN IF EXISTS updated_at;
+-- +goose StatementEnd
@@ -0,0 +1,76 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS tasks
+(
+    id            TEXT PRIMARY KEY,
+    expression_id INTEGER,
+    left_id       TEXT REFERENCES tasks (id) ON DELETE SET NULL,
+    right_id      TEXT REFERENCES tasks (id) ON DELETE SET NULL,
+    operation     TEXT,
+    arg1          REAL,
+    arg2          REAL,
+    result        REAL,
+    cost          INTEGER DEFAULT 0,
+    critical_path INTEGER DEFAULT 0,
+    priority      INTEGER NOT NULL DEFAULT 1,
+    created_at    INTEGER DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE INDEX IF NOT EXISTS tasks_left_id_idx ON tasks (left_id);
+CREATE INDEX IF NOT EXISTS tasks_right_id_idx ON tasks (right_id);
+CREATE INDEX IF NOT EXISTS tasks_expression_id_idx ON tasks (expression_id);
+CREATE TABLE IF NOT EXISTS sweeps
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    expression TEXT,
+    created_at INTEGER DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE TABLE IF NOT EXISTS expressions
+(
+    id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+    status             TEXT,
+    result             TEXT,
+    expression         TEXT,
+    main_task_id       TEXT REFERENCES tasks (id) ON DELETE SET NULL,
+    priority           INTEGER NOT NULL DEFAULT 1,
+    attempt            INTEGER NOT NULL DEFAULT 1,
+    attempt_started_at INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER)),
+    sweep_id           INTEGER REFERENCES sweeps (id) ON DELETE SET NULL,
+    sweep_values       TEXT
+);
+CREATE INDEX IF NOT EXISTS expressions_sweep_id_idx ON expressions (sweep_id);
+CREATE TABLE IF NOT EXISTS expression_attempts
+(
+    expression_id INTEGER REFERENCES expressions (id) ON DELETE CASCADE,
+    attempt       INTEGER,
+    status        TEXT,
+    result        TEXT,
+    started_at    INTEGER,
+    finished_at   INTEGER DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER)),
+    PRIMARY KEY (expression_id, attempt)
+);
+CREATE TABLE IF NOT EXISTS users
+(
+    login         TEXT,
+    password_hash TEXT
+);
+CREATE TABLE IF NOT EXISTS task_cache
+(
+    operation  TEXT,
+    arg1       REAL,
+    arg2       REAL,
+    result     REAL,
+    created_at INTEGER DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER)),
+    PRIMARY KEY (operation, arg1, arg2)
+);
+CREATE INDEX IF NOT EXISTS task_cache_created_at_idx ON task_cache (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS task_cache;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS expression_attempts;
+DROP TABLE IF EXISTS expressions;
+DROP TABLE IF EXISTS sweeps;
+DROP TABLE IF EXISTS tasks;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN user_id INTEGER;
+ALTER TABLE sweeps
+    ADD COLUMN user_id INTEGER;
+CREATE INDEX IF NOT EXISTS expressions_user_id_idx ON expressions (user_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expressions_user_id_idx;
+ALTER TABLE sweeps
+    DROP COLUMN user_id;
+ALTER TABLE expressions
+    DROP COLUMN user_id;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- SQLite не умеет добавлять колонку с неконстантным DEFAULT: время ставит INSERT.
+ALTER TABLE expressions
+    ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+UPDATE expressions
+SET created_at = attempt_started_at;
+CREATE INDEX IF NOT EXISTS expressions_user_id_created_at_idx ON expressions (user_id, created_at, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expressions_user_id_created_at_idx;
+ALTER TABLE expressions
+    DROP COLUMN created_at;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN started_at INTEGER;
+ALTER TABLE expressions
+    ADD COLUMN finished_at INTEGER;
+ALTER TABLE tasks
+    ADD COLUMN dispatched_at INTEGER;
+ALTER TABLE tasks
+    ADD COLUMN completed_at INTEGER;
+ALTER TABLE tasks
+    ADD COLUMN agent_id TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tasks
+    DROP COLUMN agent_id;
+ALTER TABLE tasks
+    DROP COLUMN completed_at;
+ALTER TABLE tasks
+    DROP COLUMN dispatched_at;
+ALTER TABLE expressions
+    DROP COLUMN finished_at;
+ALTER TABLE expressions
+    DROP COLUMN started_at;
+-- +goose StatementEnd
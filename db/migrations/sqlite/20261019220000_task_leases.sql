@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tasks
+    ADD COLUMN state TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE tasks
+    ADD COLUMN lease_until INTEGER;
+ALTER TABLE tasks
+    ADD COLUMN stream_id TEXT;
+UPDATE tasks SET state = 'done' WHERE completed_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS tasks_state_idx ON tasks (state);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tasks_state_idx;
+ALTER TABLE tasks
+    DROP COLUMN stream_id;
+ALTER TABLE tasks
+    DROP COLUMN lease_until;
+ALTER TABLE tasks
+    DROP COLUMN state;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS expressions_archive
+(
+    id          INTEGER PRIMARY KEY,
+    user_id     INTEGER,
+    status      TEXT,
+    result      TEXT,
+    expression  TEXT,
+    priority    INTEGER,
+    created_at  INTEGER,
+    started_at  INTEGER,
+    finished_at INTEGER,
+    archived_at INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE INDEX IF NOT EXISTS expressions_archive_user_id_idx ON expressions_archive (user_id, id);
+CREATE INDEX IF NOT EXISTS expressions_retention_idx ON expressions (status, COALESCE(finished_at, created_at));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS expressions_retention_idx;
+DROP TABLE IF EXISTS expressions_archive;
+-- +goose StatementEnd
@@ -0,0 +1,84 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS expression_events
+(
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    expression_id INTEGER NOT NULL REFERENCES expressions (id) ON DELETE CASCADE,
+    type          TEXT    NOT NULL,
+    task_id       TEXT,
+    agent_id      TEXT,
+    detail        TEXT,
+    created_at    INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE INDEX IF NOT EXISTS expression_events_expression_id_idx ON expression_events (expression_id, id);
+
+-- История только дописывается: события пишут триггеры, чтобы ни один переход не потерялся.
+CREATE TRIGGER IF NOT EXISTS expression_events_append_only
+    BEFORE UPDATE
+    ON expression_events
+BEGIN
+    SELECT RAISE(ABORT, 'expression_events: история не меняется');
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_submitted
+    AFTER INSERT
+    ON expressions
+BEGIN
+    INSERT INTO expression_events(expression_id, type) VALUES (NEW.id, 'submitted');
+    INSERT INTO expression_events(expression_id, type, detail)
+    SELECT NEW.id, CASE NEW.status WHEN 'Выполнено' THEN 'completed' WHEN 'Ошибка' THEN 'errored' ELSE 'cancelled' END,
+           NEW.result
+    WHERE NEW.status <> 'Подсчёт';
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_retried
+    AFTER UPDATE OF attempt
+    ON expressions
+    WHEN NEW.attempt <> OLD.attempt
+BEGIN
+    INSERT INTO expression_events(expression_id, type, detail) VALUES (NEW.id, 'retried', OLD.status);
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_parsed
+    AFTER UPDATE OF main_task_id
+    ON expressions
+    WHEN NEW.main_task_id IS NOT NULL AND NEW.main_task_id IS NOT OLD.main_task_id
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id) VALUES (NEW.id, 'parsed', NEW.main_task_id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_finished
+    AFTER UPDATE OF status
+    ON expressions
+    WHEN NEW.status <> 'Подсчёт' AND NEW.status IS NOT OLD.status
+BEGIN
+    INSERT INTO expression_events(expression_id, type, detail)
+    VALUES (NEW.id,
+            CASE NEW.status WHEN 'Выполнено' THEN 'completed' WHEN 'Ошибка' THEN 'errored' ELSE 'cancelled' END,
+            NEW.result);
+END;
+
+CREATE TRIGGER IF NOT EXISTS task_event
+    AFTER UPDATE OF state
+    ON tasks
+    WHEN NEW.state IS NOT OLD.state
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id, agent_id, detail)
+    VALUES (NEW.expression_id,
+            CASE NEW.state WHEN 'leased' THEN 'task_dispatched' WHEN 'done' THEN 'task_completed' ELSE 'task_requeued' END,
+            NEW.id,
+            CASE WHEN OLD.state = 'leased' OR NEW.state = 'leased' THEN NEW.agent_id END,
+            CASE WHEN NEW.state = 'done' THEN CAST(NEW.result AS TEXT) END);
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS task_event;
+DROP TRIGGER IF EXISTS expression_finished;
+DROP TRIGGER IF EXISTS expression_parsed;
+DROP TRIGGER IF EXISTS expression_retried;
+DROP TRIGGER IF EXISTS expression_submitted;
+DROP TRIGGER IF EXISTS expression_events_append_only;
+DROP TABLE IF EXISTS expression_events;
+-- +goose StatementEnd
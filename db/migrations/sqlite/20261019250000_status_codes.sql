@@ -0,0 +1,119 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Статусы хранятся кодами, русские подписи отдаёт приложение. Триггеры истории пересоздаются
+-- после перевода: смена подписи на код - не переход.
+DROP TRIGGER IF EXISTS expression_submitted;
+DROP TRIGGER IF EXISTS expression_finished;
+
+UPDATE expressions
+SET status = CASE status
+                 WHEN 'Подсчёт' THEN CASE WHEN started_at IS NULL THEN 'pending' ELSE 'running' END
+                 WHEN 'Выполнено' THEN 'done'
+                 WHEN 'Ошибка' THEN 'failed'
+                 WHEN 'Отменено' THEN 'cancelled'
+                 ELSE status END;
+UPDATE expression_attempts
+SET status = CASE status
+                 WHEN 'Подсчёт' THEN 'running'
+                 WHEN 'Выполнено' THEN 'done'
+                 WHEN 'Ошибка' THEN 'failed'
+                 WHEN 'Отменено' THEN 'cancelled'
+                 ELSE status END;
+UPDATE expressions_archive
+SET status = CASE status
+                 WHEN 'Выполнено' THEN 'done'
+                 WHEN 'Ошибка' THEN 'failed'
+                 WHEN 'Отменено' THEN 'cancelled'
+                 ELSE status END;
+
+-- CHECK в существующую таблицу SQLite не добавляет, поэтому проверка - триггерами.
+CREATE TRIGGER IF NOT EXISTS expressions_status_insert
+    BEFORE INSERT
+    ON expressions
+    WHEN NEW.status IS NULL OR NEW.status NOT IN ('pending', 'running', 'done', 'failed', 'cancelled')
+BEGIN
+    SELECT RAISE(ABORT, 'expressions: неизвестный статус');
+END;
+
+CREATE TRIGGER IF NOT EXISTS expressions_status_update
+    BEFORE UPDATE OF status
+    ON expressions
+    WHEN NEW.status IS NULL OR NEW.status NOT IN ('pending', 'running', 'done', 'failed', 'cancelled')
+BEGIN
+    SELECT RAISE(ABORT, 'expressions: неизвестный статус');
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_submitted
+    AFTER INSERT
+    ON expressions
+BEGIN
+    INSERT INTO expression_events(expression_id, type) VALUES (NEW.id, 'submitted');
+    INSERT INTO expression_events(expression_id, type, detail)
+    SELECT NEW.id, CASE NEW.status WHEN 'done' THEN 'completed' WHEN 'failed' THEN 'errored' ELSE 'cancelled' END,
+           NEW.result
+    WHERE NEW.status IN ('done', 'failed', 'cancelled');
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_finished
+    AFTER UPDATE OF status
+    ON expressions
+    WHEN NEW.status IN ('done', 'failed', 'cancelled') AND NEW.status IS NOT OLD.status
+BEGIN
+    INSERT INTO expression_events(expression_id, type, detail)
+    VALUES (NEW.id,
+            CASE NEW.status WHEN 'done' THEN 'completed' WHEN 'failed' THEN 'errored' ELSE 'cancelled' END,
+            NEW.result);
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS expressions_status_insert;
+DROP TRIGGER IF EXISTS expressions_status_update;
+DROP TRIGGER IF EXISTS expression_submitted;
+DROP TRIGGER IF EXISTS expression_finished;
+
+UPDATE expressions
+SET status = CASE status
+                 WHEN 'pending' THEN 'Подсчёт'
+                 WHEN 'running' THEN 'Подсчёт'
+                 WHEN 'done' THEN 'Выполнено'
+                 WHEN 'failed' THEN 'Ошибка'
+                 WHEN 'cancelled' THEN 'Отменено'
+                 ELSE status END;
+UPDATE expression_attempts
+SET status = CASE status
+                 WHEN 'running' THEN 'Подсчёт'
+                 WHEN 'done' THEN 'Выполнено'
+                 WHEN 'failed' THEN 'Ошибка'
+                 WHEN 'cancelled' THEN 'Отменено'
+                 ELSE status END;
+UPDATE expressions_archive
+SET status = CASE status
+                 WHEN 'done' THEN 'Выполнено'
+                 WHEN 'failed' THEN 'Ошибка'
+                 WHEN 'cancelled' THEN 'Отменено'
+                 ELSE status END;
+
+CREATE TRIGGER IF NOT EXISTS expression_submitted
+    AFTER INSERT
+    ON expressions
+BEGIN
+    INSERT INTO expression_events(expression_id, type) VALUES (NEW.id, 'submitted');
+    INSERT INTO expression_events(expression_id, type, detail)
+    SELECT NEW.id, CASE NEW.status WHEN 'Выполнено' THEN 'completed' WHEN 'Ошибка' THEN 'errored' ELSE 'cancelled' END,
+           NEW.result
+    WHERE NEW.status <> 'Подсчёт';
+END;
+
+CREATE TRIGGER IF NOT EXISTS expression_finished
+    AFTER UPDATE OF status
+    ON expressions
+    WHEN NEW.status <> 'Подсчёт' AND NEW.status IS NOT OLD.status
+BEGIN
+    INSERT INTO expression_events(expression_id, type, detail)
+    VALUES (NEW.id,
+            CASE NEW.status WHEN 'Выполнено' THEN 'completed' WHEN 'Ошибка' THEN 'errored' ELSE 'cancelled' END,
+            NEW.result);
+END;
+-- +goose StatementEnd
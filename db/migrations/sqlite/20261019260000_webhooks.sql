@@ -0,0 +1,69 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE expressions
+    ADD COLUMN callback_url TEXT;
+ALTER TABLE users
+    ADD COLUMN webhook_secret TEXT;
+
+CREATE TABLE IF NOT EXISTS webhook_outbox
+(
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    expression_id   INTEGER NOT NULL REFERENCES expressions (id) ON DELETE CASCADE,
+    user_id         INTEGER,
+    url             TEXT    NOT NULL,
+    payload         TEXT    NOT NULL,
+    state           TEXT    NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'delivered', 'failed')),
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER)),
+    created_at      INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_due_idx ON webhook_outbox (next_attempt_at) WHERE state = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_outbox_expression_id_idx ON webhook_outbox (expression_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id  INTEGER NOT NULL REFERENCES webhook_outbox (id) ON DELETE CASCADE,
+    attempt     INTEGER NOT NULL,
+    status_code INTEGER,
+    error       TEXT,
+    duration_ms INTEGER NOT NULL,
+    created_at  INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+
+-- Вебхук ставится в outbox той же транзакцией, что переводит выражение в конечный статус.
+CREATE TRIGGER IF NOT EXISTS webhook_enqueue_insert
+    AFTER INSERT
+    ON expressions
+    WHEN NEW.callback_url IS NOT NULL AND NEW.status IN ('done', 'failed', 'cancelled')
+BEGIN
+    INSERT INTO webhook_outbox(expression_id, user_id, url, payload)
+    VALUES (NEW.id, NEW.user_id, NEW.callback_url,
+            json_object('id', NEW.id, 'status', NEW.status, 'result', NEW.result, 'attempt', NEW.attempt,
+                        'finished_at', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.finished_at / 1000.0, 'unixepoch')));
+END;
+
+CREATE TRIGGER IF NOT EXISTS webhook_enqueue_update
+    AFTER UPDATE OF status
+    ON expressions
+    WHEN NEW.callback_url IS NOT NULL AND NEW.status IN ('done', 'failed', 'cancelled') AND NEW.status IS NOT OLD.status
+BEGIN
+    INSERT INTO webhook_outbox(expression_id, user_id, url, payload)
+    VALUES (NEW.id, NEW.user_id, NEW.callback_url,
+            json_object('id', NEW.id, 'status', NEW.status, 'result', NEW.result, 'attempt', NEW.attempt,
+                        'finished_at', strftime('%Y-%m-%dT%H:%M:%fZ', NEW.finished_at / 1000.0, 'unixepoch')));
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS webhook_enqueue_update;
+DROP TRIGGER IF EXISTS webhook_enqueue_insert;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_outbox;
+ALTER TABLE users
+    DROP COLUMN webhook_secret;
+ALTER TABLE expressions
+    DROP COLUMN callback_url;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Отмена выражения больше не удаляет выданные агентам задачи, а помечает их отменёнными.
+DROP TRIGGER IF EXISTS task_event;
+CREATE TRIGGER IF NOT EXISTS task_event
+    AFTER UPDATE OF state
+    ON tasks
+    WHEN NEW.state IS NOT OLD.state
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id, agent_id, detail)
+    VALUES (NEW.expression_id,
+            CASE NEW.state
+                WHEN 'leased' THEN 'task_dispatched'
+                WHEN 'done' THEN 'task_completed'
+                WHEN 'cancelled' THEN 'task_cancelled'
+                ELSE 'task_requeued' END,
+            NEW.id,
+            CASE WHEN OLD.state = 'leased' OR NEW.state = 'leased' THEN NEW.agent_id END,
+            CASE WHEN NEW.state = 'done' THEN CAST(NEW.result AS TEXT) END);
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM tasks WHERE state = 'cancelled';
+DROP TRIGGER IF EXISTS task_event;
+CREATE TRIGGER IF NOT EXISTS task_event
+    AFTER UPDATE OF state
+    ON tasks
+    WHEN NEW.state IS NOT OLD.state
+BEGIN
+    INSERT INTO expression_events(expression_id, type, task_id, agent_id, detail)
+    VALUES (NEW.expression_id,
+            CASE NEW.state WHEN 'leased' THEN 'task_dispatched' WHEN 'done' THEN 'task_completed' ELSE 'task_requeued' END,
+            NEW.id,
+            CASE WHEN OLD.state = 'leased' OR NEW.state = 'leased' THEN NEW.agent_id END,
+            CASE WHEN NEW.state = 'done' THEN CAST(NEW.result AS TEXT) END);
+END;
+-- +goose StatementEnd
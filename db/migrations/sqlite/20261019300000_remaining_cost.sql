@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Оставшееся время открытых задач выражения для политики sjf, уменьшается при решении каждой задачи.
+ALTER TABLE expressions
+    ADD COLUMN remaining_cost INTEGER NOT NULL DEFAULT 0;
+UPDATE expressions
+SET remaining_cost = (SELECT COALESCE(sum(cost), 0)
+                      FROM tasks
+                      WHERE tasks.expression_id = expressions.id
+                        AND state IN ('pending', 'leased'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE expressions
+    DROP COLUMN remaining_cost;
+-- +goose StatementEnd
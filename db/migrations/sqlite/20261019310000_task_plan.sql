@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- left_id и right_id обнуляются по мере счёта, план выражения строится по исходным связям.
+-- У задач, сохранённых до миграции, известны только ещё не посчитанные связи.
+ALTER TABLE tasks
+    ADD COLUMN plan_left_id TEXT;
+ALTER TABLE tasks
+    ADD COLUMN plan_right_id TEXT;
+UPDATE tasks
+SET plan_left_id  = left_id,
+    plan_right_id = right_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tasks
+    DROP COLUMN plan_right_id;
+ALTER TABLE tasks
+    DROP COLUMN plan_left_id;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Время последнего прогресса импорта: задания без прогресса дольше RETRY_STUCK_S завершаются с ошибкой.
+ALTER TABLE imports
+    ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+UPDATE imports
+SET updated_at = COALESCE(finished_at, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE imports
+    DROP COLUMN updated_at;
+-- +goose StatementEnd
@@ -2,6 +2,7 @@ package logic
 
 import (
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"sync"
 	"time"
 )
@@ -9,19 +10,18 @@ import (
 func Worker(tasks <-chan models.Task, results chan<- models.Task, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for task := range tasks {
-		var res float64
-		switch task.Operation {
-		case "+":
-			res = task.Arg1 + task.Arg2
-		case "-":
-			res = task.Arg1 - task.Arg2
-		case "*":
-			res = task.Arg1 * task.Arg2
-		case "/":
-			res = task.Arg1 / task.Arg2
+		op, ok := calc.Lookup(task.Operation)
+		if !ok {
+			task.Error = calc.ErrUnknownOperation.Error()
+		} else if res, err := op.Eval(task.Arg1, task.Arg2); err != nil {
+			task.Error = err.Error()
+		} else {
+			task.Result = res
+		}
+		select {
+		case <-time.After(task.OperationTime):
+			results <- task
+		case <-task.Done:
 		}
-		task.Result = res
-		time.Sleep(task.OperationTime)
-		results <- task
 	}
 }
@@ -2,6 +2,7 @@ package logic
 
 import (
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"sync"
 	"testing"
 	"time"
@@ -180,3 +181,47 @@ func TestWorker(t *testing.T) {
 	close(tasks)
 	close(results)
 }
+
+func TestWorkerCancel(t *testing.T) {
+	tasks := make(chan models.Task, 1)
+	results := make(chan models.Task, 1)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go Worker(tasks, results, wg)
+	done := make(chan struct{})
+	tasks <- models.Task{Operation: "+", Arg1: 2, Arg2: 2, OperationTime: time.Hour, Done: done}
+	close(done)
+	close(tasks)
+	wg.Wait()
+	select {
+	case res := <-results:
+		t.Errorf("Ожидал, что отменённая задача не вернёт результат, получил: %+v", res)
+	default:
+	}
+}
+
+func TestWorkerError(t *testing.T) {
+	tasks := make(chan models.Task, 1)
+	results := make(chan models.Task, 1)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go Worker(tasks, results, wg)
+	defer close(tasks)
+	tests := []struct {
+		name      string
+		operation string
+		expected  error
+	}{
+		{name: "division by zero", operation: "/", expected: calc.ErrDivByZero},
+		{name: "unknown operation", operation: "%", expected: calc.ErrUnknownOperation},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tasks <- models.Task{Operation: test.operation, Arg1: 3, Arg2: 0, OperationTime: time.Millisecond}
+			result := <-results
+			if result.Error != test.expected.Error() {
+				t.Errorf("Ожидал ошибку %q, получил %q", test.expected, result.Error)
+			}
+		})
+	}
+}
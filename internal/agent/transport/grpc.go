@@ -7,7 +7,10 @@ import (
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"io"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -19,6 +22,9 @@ type Client struct {
 	logger  *zap.SugaredLogger
 	Ping    time.Duration
 	Port    int
+	workers int
+	// Каналы, закрытие которых прерывает задачу у воркера.
+	aborts sync.Map
 }
 
 func NewAgent(cntGoroutines int, logger *zap.SugaredLogger, ping time.Duration, port int, client *grpc.ClientConn) *Client {
@@ -29,6 +35,7 @@ func NewAgent(cntGoroutines int, logger *zap.SugaredLogger, ping time.Duration,
 		logger:  logger,
 		Ping:    ping,
 		Port:    port,
+		workers: cntGoroutines,
 	}
 }
 
@@ -54,12 +61,22 @@ func (c *Client) getTask(ctx context.Context, stream grpc.BidiStreamingClient[pb
 				c.logger.Errorf("Ошибка преобразования string в uuid: %v", err)
 				return err
 			}
+			if msg.Cancel {
+				if done, ok := c.aborts.LoadAndDelete(id); ok {
+					close(done.(chan struct{}))
+					c.logger.Debugf("Отменил задачу: %s", id)
+				}
+				continue
+			}
+			done := make(chan struct{})
+			c.aborts.Store(id, done)
 			c.In <- models.Task{
 				ID:            id,
 				Operation:     msg.Operation,
 				Arg1:          msg.Arg1,
 				Arg2:          msg.Arg2,
 				OperationTime: time.Duration(msg.OperationTime) * time.Millisecond,
+				Done:          done,
 			}
 		}
 	}
@@ -79,12 +96,17 @@ func (c *Client) sendTask(ctx context.Context, stream grpc.BidiStreamingClient[p
 				if !ok {
 					return nil
 				}
+				if _, ok := c.aborts.LoadAndDelete(task.ID); !ok {
+					c.logger.Debugf("Результат отменённой задачи %s не отправлен", task.ID)
+					continue
+				}
 				err := stream.Send(&pb.TaskWithResult{
 					ID:        task.ID.String(),
 					Operation: task.Operation,
 					Arg1:      task.Arg1,
 					Arg2:      task.Arg2,
 					Result:    task.Result,
+					Error:     task.Error,
 				})
 				if err != nil {
 					c.logger.Errorf("Ошибка отправки задачи: %v", err)
@@ -98,6 +120,10 @@ func (c *Client) sendTask(ctx context.Context, stream grpc.BidiStreamingClient[p
 }
 
 func (c *Client) Run(ctx context.Context) {
+	host, _ := os.Hostname()
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		"workers", strconv.Itoa(c.workers),
+		"agent", host+"-"+strconv.Itoa(os.Getpid()))
 	stream, err := c.client.GiveTakeTask(ctx)
 	if err != nil {
 		c.logger.Fatalf("Ошибка запуска: %v", err)
@@ -2,18 +2,33 @@ package application
 
 import (
 	"context"
+	"fmt"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/background"
 	config2 "github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/eta"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/importer"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/postgres"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/sqlite"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/retention"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/transport/grpc"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/transport/http/server"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/webhook"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
+	"go.uber.org/zap"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 )
 
+// shutdownTimeout - сколько при остановке ждать фоновую работу.
+const shutdownTimeout = 10 * time.Second
+
 type Application struct {
 	config *config2.Config
 }
@@ -24,29 +39,151 @@ func New() *Application {
 	}
 }
 
+// repository выбирает хранилище по DATABASE_URL: memory://, sqlite://path, иначе Postgres.
+func (a *Application) repository() (repository.Repository, func(), error) {
+	switch {
+	case strings.HasPrefix(a.config.URLdb, "memory://"):
+		r, err := memory.NewRepository(a.config.Cache, a.config.Scheduler)
+		return r, func() {}, err
+	case strings.HasPrefix(a.config.URLdb, "sqlite://"):
+		db, err := sqlite.Open(a.config.URLdb)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ошибка открытия SQLite: %w", err)
+		}
+		if err = goose.SetDialect("sqlite3"); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("ошибка постановки диалекта SQLite: %w", err)
+		}
+		if err = goose.Up(db, "db/migrations/sqlite/"); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("ошибка наката миграции: %w", err)
+		}
+		r, err := sqlite.NewRepository(db, a.config.Cache, a.config.Scheduler)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return r, func() { db.Close() }, nil
+	}
+	pool, err := pgxpool.New(context.Background(), a.config.URLdb)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка подключения к СУБД: %w", err)
+	}
+	db := stdlib.OpenDBFromPool(pool)
+	if err = goose.SetDialect("postgres"); err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("ошибка постановки диалекта Postgres: %w", err)
+	}
+	if err = goose.Up(db, "db/migrations/postgres/"); err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("ошибка наката миграции: %w", err)
+	}
+	r, err := postgres.NewRepository(pool, a.config.Cache, a.config.Scheduler)
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+	return r, pool.Close, nil
+}
+
+// listen держит подписку хранилища на готовые задачи. Пока её нет,
+// задачи раздаются опросом раз в PING.
+func listen(ctx context.Context, logger *zap.SugaredLogger, l repository.Listener) {
+	for {
+		err := l.Listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warnf("Подписка на готовые задачи отвалилась, переподключаюсь: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// trimCache раз в Interval подрезает кэш результатов по TTL и размеру.
+func trimCache(ctx context.Context, logger *zap.SugaredLogger, r repository.Repository, cfg config2.Cache) {
+	if cfg.Size <= 0 || cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := r.TrimCache(ctx)
+		if err != nil {
+			logger.Errorf("Ошибка чистки кэша: %v", err)
+		} else if n > 0 {
+			logger.Debugf("Из кэша удалено записей: %d", n)
+		}
+	}
+}
+
+// sweepStuck при запуске и дальше раз в stuckAfter подбирает работу, брошенную остановленным
+// оркестратором: разбирает выражения без задач и завершает с ошибкой зависшие импорты.
+func sweepStuck(ctx context.Context, logger *zap.SugaredLogger, a *ast.AST, r repository.Repository, stuckAfter time.Duration) {
+	if stuckAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(stuckAfter)
+	defer ticker.Stop()
+	for {
+		n, err := a.Replan(ctx)
+		if err != nil {
+			logger.Errorf("Ошибка разбора выражений без задач: %v", err)
+		}
+		if n > 0 {
+			logger.Infof("Разобрано выражений без задач: %d", n)
+		}
+		failed, err := r.FailStaleImports(ctx, stuckAfter)
+		if err != nil {
+			logger.Errorf("Ошибка завершения зависших импортов: %v", err)
+		} else if failed > 0 {
+			logger.Warnf("Завершено с ошибкой зависших импортов: %d", failed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (a *Application) Run(ctx context.Context) int {
 	logger := config2.SetupLogger(a.config.Mode)
 	defer logger.Sync()
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
-	pool, err := pgxpool.New(context.Background(), a.config.URLdb)
+	r, closeRepo, err := a.repository()
 	if err != nil {
-		logger.Fatalf("Ошибка подключения к СУБД: %v", err)
+		logger.Fatalf("Ошибка создания репозитория: %v", err)
 	}
-	defer pool.Close()
-	db := stdlib.OpenDBFromPool(pool)
-	if err = goose.SetDialect("postgres"); err != nil {
-		logger.Fatalf("Ошибка постановки диалекта Postgres: %v", err)
+	defer closeRepo()
+	if l, ok := r.(repository.Listener); ok {
+		go listen(ctx, logger, l)
 	}
-	if err = goose.Up(db, "db/migrations/"); err != nil {
-		logger.Fatalf("Ошибка наката миграции: %v", err)
-	}
-	r := postgres.NewRepository(pool)
-	AST := ast.NewAST(r, logger)
-	g := grpc.NewServer(logger, a.config, r)
+	AST := ast.NewAST(r, logger, a.config)
+	est := eta.NewEstimator(r, a.config.Delay, a.config.GRPC.Ping)
+	g := grpc.NewServer(logger, a.config, r, est)
 	go g.Run()
+	go g.Reap(ctx)
 	logger.Info("Запуск gRPC сервера")
-	shutdownFunc := server.Run(logger, a.config.Addr, AST, r, a.config.JWTSecret)
+	job := retention.NewJob(r, a.config.Retention, logger)
+	go job.Run(ctx)
+	go trimCache(ctx, logger, r, a.config.Cache)
+	go webhook.NewDispatcher(r, a.config.Webhooks, logger).Run(ctx)
+	bg := background.New()
+	bg.Go(func(ctx context.Context) {
+		sweepStuck(ctx, logger, AST, r, a.config.StuckAfter)
+	})
+	imp := importer.New(AST, r, bg, a.config.BatchMax, logger)
+	shutdownFunc := server.Run(logger, AST, r, bg, est, g, job, imp, a.config)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
@@ -55,6 +192,13 @@ func (a *Application) Run(ctx context.Context) int {
 		logger.Errorf("Ошибка при закрытии сервера: %v", err)
 		return 1
 	}
+	// Ждём разбор начатых выражений, остальное подберёт sweepStuck при следующем запуске.
+	bgCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = bg.Shutdown(bgCtx); err != nil {
+		logger.Errorf("Фоновая работа не завершилась за %v: %v", shutdownTimeout, err)
+		return 1
+	}
 	logger.Info("Сервер закрыт.")
 	return 0
 }
@@ -2,14 +2,17 @@ package ast
 
 import (
 	"context"
+	"errors"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
-	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/postgres"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
 	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type node struct {
@@ -21,23 +24,25 @@ type node struct {
 }
 
 type handleError interface {
-	handleError(ctx context.Context, id int, err error)
+	handleError(ctx context.Context, id int, err error) *models.Expressions
 }
 
 type AST struct {
-	r      *postgres.Repository
-	logger *zap.SugaredLogger
+	r          repository.Repository
+	logger     *zap.SugaredLogger
+	delay      config.Delay
+	stuckAfter time.Duration
+	inline     config.Inline
 }
 
-func NewAST(r *postgres.Repository, logger *zap.SugaredLogger) *AST {
-	return &AST{r: r, logger: logger}
+func NewAST(r repository.Repository, logger *zap.SugaredLogger, cfg *config.Config) *AST {
+	return &AST{r: r, logger: logger, delay: cfg.Delay, stuckAfter: cfg.StuckAfter, inline: cfg.Inline}
 }
 
 func (a AST) buildAST(tokens []string) *node {
 	var stack []*node
 	for _, token := range tokens {
-		switch token {
-		case "+", "-", "*", "/":
+		if calc.IsOperator(token) {
 			right := stack[len(stack)-1]
 			stack = stack[:len(stack)-1]
 			left := stack[len(stack)-1]
@@ -47,7 +52,7 @@ func (a AST) buildAST(tokens []string) *node {
 				left:  left,
 				right: right,
 			})
-		default:
+		} else {
 			stack = append(stack, &node{
 				value: token,
 			})
@@ -56,69 +61,66 @@ func (a AST) buildAST(tokens []string) *node {
 	return stack[0]
 }
 
+func (a AST) newTask(n *node) (*models.Task, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		a.logger.Errorf("Ошибка создания uuid: %v", err)
+		return nil, err
+	}
+	return &models.Task{
+		ID:        id,
+		Operation: n.value,
+	}, nil
+}
+
 func (a AST) calcLvl(
 	ctx context.Context,
 	n *node,
 ) ([]*models.Task, error) {
+	task, err := a.newTask(n)
+	if err != nil {
+		return []*models.Task{}, err
+	}
 	if !calc.IsOperator(n.left.value) && !calc.IsOperator(n.right.value) {
-		arg1, err := strconv.ParseFloat(n.left.value, 64)
+		task.Arg1, err = strconv.ParseFloat(n.left.value, 64)
 		if err != nil {
 			a.logger.Errorf("Ошибка преобразования 1 операнда: %s", err)
 			return []*models.Task{}, err
 		}
-		arg2, err := strconv.ParseFloat(n.right.value, 64)
+		task.Arg2, err = strconv.ParseFloat(n.right.value, 64)
 		if err != nil {
 			a.logger.Errorf("Ошибка преобразования 2 операнда: %s", err)
 			return []*models.Task{}, err
 		}
-		id, err := uuid.NewV7()
-		if err != nil {
-			a.logger.Errorf("Ошибка создания uuid: %v", err)
-			return []*models.Task{}, err
-		}
-		task := &models.Task{
-			ID:        id,
-			Operation: n.value,
-			Arg1:      arg1,
-			Arg2:      arg2,
-		}
-		return []*models.Task{task}, err
+		return []*models.Task{task}, nil
 	} else if calc.IsOperator(n.left.value) && !calc.IsOperator(n.right.value) {
 		tasks, err := a.calcLvl(ctx, n.left)
 		if err != nil {
 			a.logger.Errorf("Ошибка вычесления левого поддерева: %s", err)
 			return []*models.Task{}, err
 		}
-		arg2, err := strconv.ParseFloat(n.right.value, 64)
+		task.Arg2, err = strconv.ParseFloat(n.right.value, 64)
 		if err != nil {
 			a.logger.Errorf("Ошибка преобразования 2 операнда: %s", err)
 			return []*models.Task{}, err
 		}
 		leftID := tasks[len(tasks)-1].ID
-		tasks = append(tasks, &models.Task{
-			Operation: n.value,
-			Arg2:      arg2,
-			LeftID:    &leftID,
-		})
-		return tasks, nil
+		task.LeftID = &leftID
+		return append(tasks, task), nil
 	} else if !calc.IsOperator(n.left.value) && calc.IsOperator(n.right.value) {
 		tasks, err := a.calcLvl(ctx, n.right)
 		if err != nil {
-			a.logger.Errorf("Ошибка вычесления левого поддерева: %s", err)
+			a.logger.Errorf("Ошибка вычесления правого поддерева: %s", err)
 			return []*models.Task{}, err
 		}
-		arg1, err := strconv.ParseFloat(n.left.value, 64)
+		task.Arg1, err = strconv.ParseFloat(n.left.value, 64)
 		if err != nil {
 			a.logger.Errorf("Ошибка преобразования 1 операнда: %s", err)
 			return []*models.Task{}, err
 		}
 		rightID := tasks[len(tasks)-1].ID
-		tasks = append(tasks, &models.Task{
-			Operation: n.value,
-			Arg1:      arg1,
-			LeftID:    &rightID,
-		})
-		return tasks, nil
+		task.RightID = &rightID
+		return append(tasks, task), nil
 	} else {
 		tasks1, err := a.calcLvl(ctx, n.left)
 		if err != nil {
@@ -130,13 +132,64 @@ func (a AST) calcLvl(
 		}
 		leftID := tasks1[len(tasks1)-1].ID
 		rightID := tasks2[len(tasks2)-1].ID
+		task.LeftID = &leftID
+		task.RightID = &rightID
 		tasks := append(tasks1, tasks2...)
-		tasks = append(tasks, &models.Task{
-			Operation: n.value,
-			LeftID:    &leftID,
-			RightID:   &rightID,
-		})
-		return tasks, nil
+		return append(tasks, task), nil
+	}
+}
+
+func taskKey(task *models.Task) string {
+	arg1 := strconv.FormatFloat(task.Arg1, 'g', -1, 64)
+	if task.LeftID != nil {
+		arg1 = task.LeftID.String()
+	}
+	arg2 := strconv.FormatFloat(task.Arg2, 'g', -1, 64)
+	if task.RightID != nil {
+		arg2 = task.RightID.String()
+	}
+	return task.Operation + "(" + arg1 + "," + arg2 + ")"
+}
+
+// Одинаковые поддеревья схлопываются в одну задачу, результат которой уходит всем родителям.
+func dedupTasks(tasks []*models.Task) []*models.Task {
+	seen := make(map[string]uuid.UUID, len(tasks))
+	replaced := make(map[uuid.UUID]uuid.UUID)
+	res := make([]*models.Task, 0, len(tasks))
+	for _, task := range tasks {
+		if task.LeftID != nil {
+			if id, ok := replaced[*task.LeftID]; ok {
+				task.LeftID = &id
+			}
+		}
+		if task.RightID != nil {
+			if id, ok := replaced[*task.RightID]; ok {
+				task.RightID = &id
+			}
+		}
+		key := taskKey(task)
+		if id, ok := seen[key]; ok {
+			replaced[task.ID] = id
+			continue
+		}
+		seen[key] = task.ID
+		res = append(res, task)
+	}
+	return res
+}
+
+// Для каждой задачи считается путь от неё до корня: сколько ещё ждать выражению после её старта.
+func (a AST) setCriticalPath(tasks []*models.Task) {
+	downstream := make(map[uuid.UUID]time.Duration, len(tasks))
+	for i := len(tasks) - 1; i >= 0; i-- {
+		task := tasks[i]
+		task.OperationTime = a.delay.Get(task.Operation)
+		task.CriticalPath = task.OperationTime + downstream[task.ID]
+		for _, dep := range []*uuid.UUID{task.LeftID, task.RightID} {
+			if dep != nil {
+				downstream[*dep] = max(downstream[*dep], task.CriticalPath)
+			}
+		}
 	}
 }
 
@@ -148,89 +201,177 @@ func (a AST) Process(
 	tasks, err := a.calcLvl(ctx, root)
 	if err != nil {
 		a.handleError(ctx, id, err)
+		return
 	}
+	tasks = dedupTasks(tasks)
+	a.setCriticalPath(tasks)
 	err = a.r.SaveTasks(ctx, tasks, id)
+	if errors.Is(err, repository.ErrAlreadyPlanned) {
+		a.logger.Debugf("Выражение %d уже разобрано или отменено, задачи отброшены", id)
+		return
+	}
 	if err != nil {
 		a.handleError(ctx, id, err)
 	}
 }
 
-func (a AST) Calc(
-	ctx context.Context,
-	expression string,
-	id int,
-) {
+func (a AST) parse(expression string) ([]string, error) {
 	if !calc.RightString(expression) {
-		a.handleError(ctx, id, calc.ErrInvalidBracket)
-		a.logger.Errorf("Ошибка вычисления: %v", calc.ErrInvalidBracket)
-		a.logger.Debug("Оркестратор завершил работу.")
-		return
+		return nil, calc.ErrInvalidBracket
 	}
 	if calc.IsLetter(expression) {
-		a.handleError(ctx, id, calc.ErrInvalidOperands)
-		a.logger.Errorf("Ошибка вычисления: %v", calc.ErrInvalidOperands)
-		a.logger.Debug("Оркестратор завершил работу.")
-		return
+		return nil, calc.ErrInvalidOperands
 	}
 	if expression == "" || expression == " " {
-		a.handleError(ctx, id, calc.ErrEmptyExpression)
-		a.logger.Errorf("Ошибка вычисления: %v", calc.ErrEmptyExpression)
-		a.logger.Debug("Оркестратор завершил работу.")
-		return
+		return nil, calc.ErrEmptyExpression
 	}
 	expression = strings.ReplaceAll(expression, " ", "")
 	tokens := calc.Tokenize(expression)
 	tokens = calc.InfixToPostfix(tokens)
 	if !calc.CountOp(tokens) {
-		a.handleError(ctx, id, calc.ErrInvalidOperands)
-		a.logger.Errorf("Ошибка вычисления: %v", calc.ErrInvalidOperands)
+		return nil, calc.ErrInvalidOperands
+	}
+	return tokens, nil
+}
+
+func (a AST) Validate(expression string) error {
+	_, err := a.parse(expression)
+	return err
+}
+
+// Тривиальные выражения считаются прямо в оркестраторе, без агентов.
+func (a AST) isInline(tokens []string) bool {
+	ops := 0
+	var delay time.Duration
+	for _, token := range tokens {
+		if calc.IsOperator(token) {
+			ops++
+			delay += a.delay.Get(token)
+		}
+	}
+	return (a.inline.MaxOps > 0 && ops <= a.inline.MaxOps) ||
+		(a.inline.MaxDelay > 0 && delay <= a.inline.MaxDelay)
+}
+
+func (a AST) complete(ctx context.Context, id int, res float64) *models.Expressions {
+	resStr := strconv.FormatFloat(res, 'f', 2, 64)
+	expression := models.Expressions{
+		ID:     int64(id),
+		Status: models.StatusDone,
+		Result: &resStr,
+	}
+	_, err := a.r.Set(ctx, expression)
+	if errors.Is(err, repository.ErrInvalidTransition) {
+		a.logger.Warnf("Попытка обновить неактуальную задачу ID %d", id)
+		return nil
+	}
+	if err != nil {
+		a.logger.Error("Ошибка сохранения успешного результата",
+			zap.Error(err),
+			zap.Int("id", id),
+			zap.Float64("результат", res))
+		return nil
+	}
+	a.logger.Debug("Успешно сохранено выражение",
+		zap.Int("id", id),
+		zap.Float64("результат", res))
+	return &expression
+}
+
+// Calc возвращает выражение, если оно досчиталось сразу(или сразу упало с ошибкой).
+// Иначе задачи уходят агентам и возвращается nil.
+func (a AST) Calc(
+	ctx context.Context,
+	expression string,
+	id int,
+) *models.Expressions {
+	tokens, err := a.parse(expression)
+	if err != nil {
+		a.logger.Errorf("Ошибка вычисления: %v", err)
 		a.logger.Debug("Оркестратор завершил работу.")
-		return
+		return a.handleError(ctx, id, err)
 	}
-	if res, err := strconv.ParseFloat(expression, 64); err == nil {
-		resStr := strconv.FormatFloat(res, 'f', 2, 64)
-		currentStatus, err := a.r.GetStatus(ctx, int64(id))
-		if err != nil || currentStatus != "Подсчёт" {
-			a.logger.Warnf("Попытка обновить неактуальную задачу ID %d", id)
-			return
-		}
-		if _, err := a.r.Set(ctx, models.Expressions{
-			ID:     int64(id),
-			Status: "Выполнено",
-			Result: &resStr,
-		}); err != nil {
-			a.logger.Error("Ошибка сохранения успешного результата",
-				zap.Error(err),
-				zap.Int("id", id),
-				zap.Float64("результат", res))
-		} else {
-			a.logger.Debug("Успешно сохранено выражение",
-				zap.Int("id", id),
-				zap.Float64("результат", res))
+	if len(tokens) == 1 {
+		res, err := strconv.ParseFloat(tokens[0], 64)
+		if err != nil {
+			return a.handleError(ctx, id, calc.ErrInvalidOperands)
 		}
-		return
+		return a.complete(ctx, id, res)
+	}
+	if a.isInline(tokens) {
+		res, err := calc.Calc(expression)
+		if err != nil {
+			return a.handleError(ctx, id, err)
+		}
+		a.logger.Debugf("Выражение %d посчитано сразу", id)
+		return a.complete(ctx, id, res)
 	}
 	ast := a.buildAST(tokens)
 	a.Process(ctx, ast, id)
+	return nil
 }
 
-func (a AST) handleError(ctx context.Context, id int, err error) {
-	var status string
+// Retry заново строит граф задач выражения из сохранённого текста.
+// Возвращает ID задач прошлой попытки, которые надо отменить у агентов.
+func (a AST) Retry(ctx context.Context, userID, id int) ([]uuid.UUID, error) {
+	expression, ids, err := a.r.Retry(ctx, userID, id, a.stuckAfter)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Debugf("Перезапускаю выражение %d", id)
+	a.Calc(ctx, expression, id)
+	return ids, nil
+}
+
+// CalcAll строит задачи выражений по очереди и останавливается, когда ctx отменён.
+// Начатое выражение дописывается до конца. Возвращает число разобранных выражений.
+func (a AST) CalcAll(ctx context.Context, ids []int, expressions []string) int {
+	for i, id := range ids {
+		if ctx.Err() != nil {
+			return i
+		}
+		a.Calc(context.WithoutCancel(ctx), expressions[i], id)
+	}
+	return len(ids)
+}
+
+// replanBatch - сколько выражений без задач Replan забирает за раз.
+const replanBatch = 100
+
+// Replan разбирает выражения, которые остались без задач: оркестратор остановился между
+// ответом клиенту и разбором. Возвращает число разобранных выражений.
+func (a AST) Replan(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		ids, expressions, err := a.r.ClaimUnplanned(ctx, a.stuckAfter, replanBatch)
+		if err != nil {
+			return total, err
+		}
+		n := a.CalcAll(ctx, ids, expressions)
+		total += n
+		if n < replanBatch {
+			return total, nil
+		}
+	}
+}
+
+func (a AST) handleError(ctx context.Context, id int, err error) *models.Expressions {
 	var result string
 
 	if ok := slices.Contains(calc.Errors, err); ok {
-		status = "Ошибка"
 		result = err.Error()
 	} else {
-		status = "Ошибка"
 		result = "Что-то пошло не так"
 	}
 	a.logger.Errorf("Ошибка: %v", err)
-	if _, dbErr := a.r.Set(ctx, models.Expressions{
+	expression := models.Expressions{
 		ID:     int64(id),
-		Status: status,
+		Status: models.StatusFailed,
 		Result: &result,
-	}); dbErr != nil {
+	}
+	if _, dbErr := a.r.Set(ctx, expression); dbErr != nil {
 		a.logger.Errorf("Ошибка сохранения ошибки :): %v", dbErr)
+		return nil
 	}
+	return &expression
 }
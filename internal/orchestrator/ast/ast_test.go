@@ -1,142 +1,272 @@
 package ast
 
 import (
-	"github.com/Cool-Andrey/Calculating/internal/agent/logic"
+	"context"
+	"errors"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
 	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"go.uber.org/zap"
 	"testing"
+	"time"
 )
 
+var delay = config.Delay{
+	"TIME_ADDITION_MS":        time.Second,
+	"TIME_SUBTRACTION_MS":     3 * time.Second,
+	"TIME_MULTIPLICATIONS_MS": 2 * time.Second,
+	"TIME_DIVISIONS_MS":       4 * time.Second,
+}
+
+var lease = repository.Lease{Agent: "test", Stream: "stream", TTL: time.Minute}
+
+func newAST(t *testing.T, cfg *config.Config) (*AST, *memory.Repository) {
+	r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAST(r, zap.NewNop().Sugar(), cfg), r
+}
+
+func submit(t *testing.T, r repository.Repository, expression string) int {
+	id, err := r.SetWithExpression(context.Background(), 1, models.Expressions{Status: models.StatusPending}, expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
 func TestCalc(t *testing.T) {
-	logger := zap.NewNop().Sugar()
+	ctx := context.Background()
 
 	t.Run("Correct expression", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
-		errors := make(chan error, 1)
-		done := make(chan int, 1)
-		expression := "2 + 3 * 4"
-		go Calc(expression, logger, tasks, results, errors, done, 1)
-		task := <-tasks
-		if task.Operation != "*" || task.Arg1 != 3 || task.Arg2 != 4 {
-			t.Errorf("Ожидал задачу: * 3 4, получил: %s %.2f %.2f", task.Operation, task.Arg1, task.Arg2)
+		a, r := newAST(t, &config.Config{Delay: delay})
+		id := submit(t, r, "2 + 3 * 4")
+		if e := a.Calc(ctx, "2 + 3 * 4", id); e != nil {
+			t.Fatalf("Ожидал, что выражение уйдёт агентам, получил %+v", e)
 		}
-		results <- 12
-		task = <-tasks
-		if task.Operation != "+" || task.Arg1 != 2 || task.Arg2 != 12 {
-			t.Errorf("Ожидал задачу: + 2 12, получил: %s %.2f %.2f", task.Operation, task.Arg1, task.Arg2)
+		task, err := r.GetTask(ctx, lease)
+		if err != nil || task.Operation != "*" || task.Arg1 != 3 || task.Arg2 != 4 {
+			t.Fatalf("Ожидал задачу: * 3 4, получил: %s %.2f %.2f, %v", task.Operation, task.Arg1, task.Arg2, err)
 		}
-		results <- 14
-		<-done
-		select {
-		case err := <-errors:
-			t.Errorf("Ожидал отсутствие ошибок, получил: %v", err)
-		default:
+		task.Result = 12
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
 		}
-	})
-
-	t.Run("Division by zero", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
-		errors := make(chan error, 1)
-		done := make(chan int, 1)
-		expression := "2/0"
-		go Calc(expression, logger, tasks, results, errors, done, 2)
-		err := <-errors
-		if err != calc.ErrDivByZero {
-			t.Errorf("Ожидал ошибку: %v, получил: %v", calc.ErrDivByZero, err)
+		task, err = r.GetTask(ctx, lease)
+		if err != nil || task.Operation != "+" || task.Arg1 != 2 || task.Arg2 != 12 {
+			t.Fatalf("Ожидал задачу: + 2 12, получил: %s %.2f %.2f, %v", task.Operation, task.Arg1, task.Arg2, err)
 		}
-		<-done
-	})
-
-	t.Run("With letters", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
-		errors := make(chan error, 1)
-		done := make(chan int, 1)
-		expression := "2 + a"
-		go Calc(expression, logger, tasks, results, errors, done, 3)
-		err := <-errors
-		if err != calc.ErrInvalidOperands {
-			t.Errorf("Ожидал ошибку: %v, получил: %v", calc.ErrInvalidOperands, err)
+		task.Result = 14
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
 		}
-		<-done
-	})
-
-	t.Run("Empty expression", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
-		errors := make(chan error, 1)
-		done := make(chan int, 1)
-		expression := ""
-		go Calc(expression, logger, tasks, results, errors, done, 4)
-		err := <-errors
-		if err != calc.ErrEmptyExpression {
-			t.Errorf("Ожидал ошибку: %v, получил: %v", calc.ErrEmptyExpression, err)
+		if e, _ := r.Get(ctx, 1, id); e.Status != models.StatusDone || e.Result == nil || *e.Result != "14.00" {
+			t.Errorf("Ожидал результат 14.00, получил %+v", e)
 		}
-		<-done
 	})
 
-	t.Run("Invalid brackets", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
-		errors := make(chan error, 1)
-		done := make(chan int, 1)
-		expression := "2 + (3 * 4"
-		go Calc(expression, logger, tasks, results, errors, done, 5)
-		err := <-errors
-		if err != calc.ErrInvalidBracket {
-			t.Errorf("Ожидал ошибку: %v, получил: %v", calc.ErrInvalidBracket, err)
+	t.Run("Division by zero", func(t *testing.T) {
+		a, r := newAST(t, &config.Config{Delay: delay})
+		id := submit(t, r, "2/0")
+		a.Calc(ctx, "2/0", id)
+		task, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
 		}
-		<-done
-	})
-
-	t.Run("Invalid operators", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
-		errors := make(chan error, 1)
-		done := make(chan int, 1)
-		expression := "2 + + 3"
-		go Calc(expression, logger, tasks, results, errors, done, 6)
-		err := <-errors
-		if err != calc.ErrInvalidOperands {
-			t.Errorf("Ожидал ошибку: %v, получил: %v", calc.ErrInvalidOperands, err)
+		task.Error = calc.ErrDivByZero.Error()
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
+		}
+		if e, _ := r.Get(ctx, 1, id); e.Status != models.StatusFailed || e.Result == nil || *e.Result != calc.ErrDivByZero.Error() {
+			t.Errorf("Ожидал ошибку: %v, получил: %+v", calc.ErrDivByZero, e)
 		}
-		<-done
 	})
+
+	tests := []struct {
+		name       string
+		expression string
+		expected   error
+	}{
+		{name: "With letters", expression: "2 + a", expected: calc.ErrInvalidOperands},
+		{name: "Empty expression", expression: "", expected: calc.ErrEmptyExpression},
+		{name: "Invalid brackets", expression: "2 + (3 * 4", expected: calc.ErrInvalidBracket},
+		{name: "Invalid operators", expression: "2 + + 3", expected: calc.ErrInvalidOperands},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, r := newAST(t, &config.Config{Delay: delay})
+			id := submit(t, r, test.expression)
+			e := a.Calc(ctx, test.expression, id)
+			if e == nil || e.Status != models.StatusFailed || *e.Result != test.expected.Error() {
+				t.Errorf("Ожидал ошибку: %v, получил: %+v", test.expected, e)
+			}
+		})
+	}
 }
 
 func TestCalcLvl(t *testing.T) {
-	logger := zap.NewNop().Sugar()
+	ctx := context.Background()
+	a, _ := newAST(t, &config.Config{Delay: delay})
 	t.Run("Simple addition", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
 		n := &node{value: "+", left: &node{value: "2"}, right: &node{value: "3"}}
-		results <- 5
-		result, err := calcLvl(n, tasks, results, logger, 1)
+		tasks, err := a.calcLvl(ctx, n)
 		if err != nil {
 			t.Errorf("Ожидал отсутствие ошибок, получил: %v", err)
 		}
-		if result != 5 {
-			t.Errorf("Ожидал результат: 5, получил: %.2f", result)
+		if len(tasks) != 1 || tasks[0].Operation != "+" || tasks[0].Arg1 != 2 || tasks[0].Arg2 != 3 {
+			t.Errorf("Ожидал задачу: + 2 3, получил: %+v", tasks)
 		}
 	})
 
 	t.Run("Division by zero", func(t *testing.T) {
-		t.Parallel()
-		tasks := make(chan logic.Task, 1)
-		results := make(chan float64, 1)
+		// Деление на ноль теперь ловит агент, в графе это обычная задача.
 		n := &node{value: "/", left: &node{value: "2"}, right: &node{value: "0"}}
-		_, err := calcLvl(n, tasks, results, logger, 2)
-		if err != calc.ErrDivByZero {
-			t.Errorf("Ожидал ошибку: %v, получил: %v", calc.ErrDivByZero, err)
+		tasks, err := a.calcLvl(ctx, n)
+		if err != nil || len(tasks) != 1 || tasks[0].Arg2 != 0 {
+			t.Errorf("Ожидал задачу: / 2 0, получил: %+v, %v", tasks, err)
 		}
 	})
 }
+
+func TestReplan(t *testing.T) {
+	ctx := context.Background()
+	a, r := newAST(t, &config.Config{Delay: delay, StuckAfter: -time.Second})
+	id := submit(t, r, "2 + 3")
+	stopped, cancel := context.WithCancel(ctx)
+	cancel()
+	if n := a.CalcAll(stopped, []int{id}, []string{"2 + 3"}); n != 0 {
+		t.Fatalf("Ожидал, что после остановки ничего не разберётся, получил %d", n)
+	}
+	n, err := a.Replan(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Ожидал разбор одного выражения без задач, получил %d, %v", n, err)
+	}
+	if task, err := r.GetTask(ctx, lease); err != nil || task.Operation != "+" {
+		t.Errorf("Ожидал задачу: + 2 3, получил %+v, %v", task, err)
+	}
+	if n, err = a.Replan(ctx); err != nil || n != 0 {
+		t.Errorf("Ожидал, что разобранное выражение не разбирается снова, получил %d, %v", n, err)
+	}
+	// Запоздавший разбор того же выражения отбрасывается и не роняет его.
+	if e := a.Calc(ctx, "2 + 3", id); e != nil {
+		t.Errorf("Ожидал, что повторный разбор ничего не вернёт, получил %+v", e)
+	}
+	if e, _ := r.Get(ctx, 1, id); e.Status == models.StatusFailed {
+		t.Errorf("Повторный разбор уронил выражение: %+v", e)
+	}
+}
+
+func TestDedupTasks(t *testing.T) {
+	ctx := context.Background()
+	a, _ := newAST(t, &config.Config{Delay: delay})
+	// (1+2)*(1+2) + (1+2)*(1+2): сложение и умножение считаются по одному разу.
+	tokens, err := a.parse("(1+2)*(1+2)+(1+2)*(1+2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := a.calcLvl(ctx, a.buildAST(tokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks = dedupTasks(tasks)
+	if len(tasks) != 3 {
+		t.Fatalf("Ожидал 3 задачи после схлопывания, получил %d", len(tasks))
+	}
+	sum, mul, root := tasks[0], tasks[1], tasks[2]
+	if sum.Operation != "+" || sum.LeftID != nil || mul.Operation != "*" || root.Operation != "+" {
+		t.Fatalf("Ожидал задачи + 1 2, * и + в порядке зависимостей, получил %+v", tasks)
+	}
+	if *mul.LeftID != sum.ID || *mul.RightID != sum.ID || *root.LeftID != mul.ID || *root.RightID != mul.ID {
+		t.Errorf("Ожидал, что родители ссылаются на оставшиеся задачи, получил %+v", tasks)
+	}
+	// Операнды в другом порядке - другая задача: вычитание не коммутативно.
+	tokens, _ = a.parse("(1-2)*(2-1)")
+	tasks, _ = a.calcLvl(ctx, a.buildAST(tokens))
+	if tasks = dedupTasks(tasks); len(tasks) != 3 {
+		t.Errorf("Ожидал 3 задачи для разных вычитаний, получил %d", len(tasks))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	a, r := newAST(t, &config.Config{Delay: delay, StuckAfter: time.Hour})
+	id := submit(t, r, "2 + 3")
+	a.Calc(ctx, "2 + 3", id)
+	stale, err := r.GetTask(ctx, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Retry(ctx, 1, id); !errors.Is(err, repository.ErrNotRetryable) {
+		t.Fatalf("Ожидал, что свежее выражение не перезапускается, получил %v", err)
+	}
+	// Отрицательный срок делает зависшим любое считающееся выражение.
+	a = NewAST(r, a.logger, &config.Config{Delay: delay, StuckAfter: -time.Second})
+	ids, err := a.Retry(ctx, 1, id)
+	if err != nil || len(ids) != 1 || ids[0] != stale.ID {
+		t.Fatalf("Ожидал отмену выданной задачи %s, получил %v, %v", stale.ID, ids, err)
+	}
+	stale.Result = 5
+	if err = r.UpdateTask(ctx, &stale); !errors.Is(err, repository.ErrTaskDiscarded) {
+		t.Errorf("Ожидал, что результат прошлой попытки отбросится, получил %v", err)
+	}
+	task, err := r.GetTask(ctx, lease)
+	if err != nil || task.ID == stale.ID || task.Operation != "+" {
+		t.Fatalf("Ожидал новую задачу + 2 3, получил %+v, %v", task, err)
+	}
+	task.Result = 5
+	if err = r.UpdateTask(ctx, &task); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := r.Get(ctx, 1, id); e.Status != models.StatusDone || *e.Result != "5.00" {
+		t.Errorf("Ожидал результат 5.00, получил %+v", e)
+	}
+	attempts, err := r.GetAttempts(ctx, 1, id)
+	if err != nil || len(attempts) != 1 || attempts[0].Attempt != 1 {
+		t.Errorf("Ожидал в истории одну прошлую попытку, получил %+v, %v", attempts, err)
+	}
+}
+
+func TestInline(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		inline     config.Inline
+		expression string
+		result     string
+	}{
+		{name: "By operations", inline: config.Inline{MaxOps: 2}, expression: "2 + 3 * 4", result: "14.00"},
+		// Два сложения по секунде укладываются в 2с, умножение с ними уже нет.
+		{name: "By delay", inline: config.Inline{MaxDelay: 2 * time.Second}, expression: "1 + 2 + 3", result: "6.00"},
+		{name: "Too many operations", inline: config.Inline{MaxOps: 1}, expression: "2 + 3 * 4"},
+		{name: "Too slow", inline: config.Inline{MaxDelay: 2 * time.Second}, expression: "1 + 2 * 3"},
+		{name: "Disabled", expression: "2 + 3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, r := newAST(t, &config.Config{Delay: delay, Inline: test.inline})
+			id := submit(t, r, test.expression)
+			e := a.Calc(ctx, test.expression, id)
+			if test.result == "" {
+				if e != nil {
+					t.Fatalf("Ожидал, что выражение уйдёт агентам, получил %+v", e)
+				}
+				if _, err := r.GetTask(ctx, lease); err != nil {
+					t.Errorf("Ожидал задачу для агентов, получил %v", err)
+				}
+				return
+			}
+			if e == nil || e.Status != models.StatusDone || *e.Result != test.result {
+				t.Fatalf("Ожидал результат %s сразу, получил %+v", test.result, e)
+			}
+			if saved, _ := r.Get(ctx, 1, id); saved.Status != models.StatusDone || *saved.Result != test.result {
+				t.Errorf("Ожидал сохранённый результат %s, получил %+v", test.result, saved)
+			}
+			if _, err := r.GetTask(ctx, lease); !errors.Is(err, repository.ErrNotFound) {
+				t.Errorf("Ожидал, что задач для агентов нет, получил %v", err)
+			}
+		})
+	}
+}
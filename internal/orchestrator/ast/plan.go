@@ -0,0 +1,125 @@
+package ast
+
+import (
+	"context"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Plan строит план по сохранённому графу задач выражения id. Разбор expression нужен,
+// только если задач нет: выражение ещё не разобрано, посчитано сразу или вычищено.
+func (a AST) Plan(ctx context.Context, id int, expression string) (models.Plan, error) {
+	saved, err := a.r.GetPlanTasks(ctx, id)
+	if err != nil {
+		return models.Plan{}, err
+	}
+	tasks := make([]*models.Task, len(saved))
+	for i := range saved {
+		tasks[i] = &saved[i]
+	}
+	if tasks, ok := order(tasks); ok && len(tasks) > 0 {
+		return buildPlan(tasks), nil
+	}
+	tokens, err := a.parse(expression)
+	if err != nil {
+		return models.Plan{}, err
+	}
+	if len(tokens) == 1 {
+		return models.Plan{Tasks: []models.PlanTask{}, Levels: []int{}}, nil
+	}
+	tasks, err = a.calcLvl(ctx, a.buildAST(tokens))
+	if err != nil {
+		return models.Plan{}, err
+	}
+	tasks = dedupTasks(tasks)
+	a.setCriticalPath(tasks)
+	return buildPlan(tasks), nil
+}
+
+// order раскладывает задачи так, чтобы зависимости шли раньше зависящих от них, как в calcLvl.
+// false - граф неполный: часть задач уже удалена, например при отмене.
+func order(tasks []*models.Task) ([]*models.Task, bool) {
+	byID := make(map[uuid.UUID]*models.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+	parents := make(map[uuid.UUID]int, len(tasks))
+	for _, task := range tasks {
+		for _, dep := range []*uuid.UUID{task.LeftID, task.RightID} {
+			if dep == nil {
+				continue
+			}
+			if _, ok := byID[*dep]; !ok {
+				return nil, false
+			}
+			parents[*dep]++
+		}
+	}
+	res := make([]*models.Task, 0, len(tasks))
+	visited := make(map[uuid.UUID]bool, len(tasks))
+	var visit func(task *models.Task)
+	visit = func(task *models.Task) {
+		if visited[task.ID] {
+			return
+		}
+		visited[task.ID] = true
+		for _, dep := range []*uuid.UUID{task.LeftID, task.RightID} {
+			if dep != nil {
+				visit(byID[*dep])
+			}
+		}
+		res = append(res, task)
+	}
+	for _, task := range tasks {
+		if parents[task.ID] == 0 {
+			visit(task)
+		}
+	}
+	return res, len(res) == len(tasks)
+}
+
+// Задачи идут в топологическом порядке: дети раньше родителей.
+func buildPlan(tasks []*models.Task) models.Plan {
+	levels := make(map[uuid.UUID]int, len(tasks))
+	finish := make(map[uuid.UUID]time.Duration, len(tasks))
+	plan := models.Plan{Tasks: make([]models.PlanTask, 0, len(tasks)), Levels: []int{}}
+	var criticalPath time.Duration
+	for _, task := range tasks {
+		level := 0
+		var start time.Duration
+		pt := models.PlanTask{
+			ID:        task.ID,
+			Operation: task.Operation,
+			LeftID:    task.LeftID,
+			RightID:   task.RightID,
+		}
+		if task.LeftID != nil {
+			level = max(level, levels[*task.LeftID]+1)
+			start = max(start, finish[*task.LeftID])
+		} else {
+			arg1 := task.Arg1
+			pt.Arg1 = &arg1
+		}
+		if task.RightID != nil {
+			level = max(level, levels[*task.RightID]+1)
+			start = max(start, finish[*task.RightID])
+		} else {
+			arg2 := task.Arg2
+			pt.Arg2 = &arg2
+		}
+		opTime := task.OperationTime
+		levels[task.ID] = level
+		finish[task.ID] = start + opTime
+		criticalPath = max(criticalPath, finish[task.ID])
+		pt.Level = level
+		pt.OperationTime = opTime.Milliseconds()
+		for len(plan.Levels) <= level {
+			plan.Levels = append(plan.Levels, 0)
+		}
+		plan.Levels[level]++
+		plan.Tasks = append(plan.Tasks, pt)
+	}
+	plan.CriticalPath = criticalPath.Milliseconds()
+	return plan
+}
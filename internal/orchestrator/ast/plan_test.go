@@ -0,0 +1,100 @@
+package ast
+
+import (
+	"context"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/google/uuid"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildPlan(t *testing.T) {
+	// (1+2) - 3*4: сложение и умножение независимы, вычитание ждёт обоих.
+	sum := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 1, Arg2: 2, OperationTime: time.Second}
+	mul := &models.Task{ID: uuid.New(), Operation: "*", Arg1: 3, Arg2: 4, OperationTime: 5 * time.Second}
+	sub := &models.Task{ID: uuid.New(), Operation: "-", LeftID: &sum.ID, RightID: &mul.ID, OperationTime: time.Second}
+	tasks, ok := order([]*models.Task{sub, mul, sum})
+	if !ok {
+		t.Fatal("Ожидал полный граф")
+	}
+	plan := buildPlan(tasks)
+	if len(plan.Tasks) != 3 || plan.Tasks[2].ID != sub.ID || plan.Tasks[2].Level != 1 {
+		t.Fatalf("Ожидал вычитание последним на уровне 1, получил %+v", plan.Tasks)
+	}
+	if !slices.Equal(plan.Levels, []int{2, 1}) {
+		t.Errorf("Ожидал 2 параллельные задачи на уровне 0 и 1 на уровне 1, получил %v", plan.Levels)
+	}
+	if plan.CriticalPath != 6000 {
+		t.Errorf("Ожидал критический путь 6000 мс через умножение, получил %d", plan.CriticalPath)
+	}
+	if plan.Tasks[2].Arg1 != nil || plan.Tasks[2].Arg2 != nil || plan.Tasks[0].Arg1 == nil {
+		t.Errorf("Ожидал аргументы только у задач без зависимостей, получил %+v", plan.Tasks)
+	}
+	if _, ok = order([]*models.Task{sub, sum}); ok {
+		t.Error("Ожидал, что граф без умножения неполный")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	ctx := context.Background()
+	const expression = "(1+2)*(3+4)-(1+2)"
+
+	t.Run("From expression", func(t *testing.T) {
+		a, _ := newAST(t, &config.Config{Delay: delay})
+		plan, err := a.Plan(ctx, 0, expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Tasks) != 4 || !slices.Equal(plan.Levels, []int{2, 1, 1}) || plan.CriticalPath != 6000 {
+			t.Errorf("Ожидал 4 задачи по уровням [2 1 1] и путь 6000 мс, получил %+v", plan)
+		}
+		if _, err = a.Plan(ctx, 0, "2+"); err == nil {
+			t.Error("Ожидал ошибку разбора")
+		}
+	})
+
+	t.Run("From saved tasks", func(t *testing.T) {
+		a, r := newAST(t, &config.Config{Delay: delay})
+		id := submit(t, r, expression)
+		a.Calc(ctx, expression, id)
+		task, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.Result = 3
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
+		}
+		// Задержки поменялись после разбора: план должен показать сохранённые.
+		slower := config.Delay{"TIME_ADDITION_MS": time.Minute}
+		b := NewAST(r, a.logger, &config.Config{Delay: slower})
+		plan, err := b.Plan(ctx, id, expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Tasks) != 4 || !slices.Equal(plan.Levels, []int{2, 1, 1}) || plan.CriticalPath != 6000 {
+			t.Errorf("Ожидал сохранённый граф из 4 задач и путь 6000 мс, получил %+v", plan)
+		}
+		if !slices.ContainsFunc(plan.Tasks, func(pt models.PlanTask) bool { return pt.ID == task.ID }) {
+			t.Errorf("Ожидал в плане посчитанную задачу %s", task.ID)
+		}
+	})
+
+	t.Run("Partial graph", func(t *testing.T) {
+		a, r := newAST(t, &config.Config{Delay: delay})
+		id := submit(t, r, expression)
+		a.Calc(ctx, expression, id)
+		if _, err := r.GetTask(ctx, lease); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Cancel(ctx, 1, id); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := a.Plan(ctx, id, expression)
+		if err != nil || len(plan.Tasks) != 4 {
+			t.Errorf("Ожидал план из текста, когда часть задач удалена, получил %+v, %v", plan, err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+// Package background ведёт работу, которая продолжается после ответа клиенту: разбор пачек,
+// переборов и импортов. Работа привязана к жизни оркестратора, а не запроса.
+package background
+
+import (
+	"context"
+	"sync"
+)
+
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mux    sync.Mutex
+	closed bool
+}
+
+func New() *Group {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Group{ctx: ctx, cancel: cancel}
+}
+
+// Go запускает fn в фоне. ctx отменяется при остановке: fn должна проверять его
+// между единицами работы и выходить. После Shutdown fn не запускается.
+func (g *Group) Go(fn func(ctx context.Context)) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.closed {
+		return
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn(g.ctx)
+	}()
+}
+
+// Shutdown отменяет фоновую работу и ждёт её завершения, но не дольше ctx.
+func (g *Group) Shutdown(ctx context.Context) error {
+	g.mux.Lock()
+	g.closed = true
+	g.mux.Unlock()
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
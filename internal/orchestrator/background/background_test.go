@@ -0,0 +1,42 @@
+package background
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	g := New()
+	stopped := make(chan struct{})
+	g.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	if err := g.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Ожидал, что Shutdown дождётся фоновой работы")
+	}
+	ran := false
+	g.Go(func(context.Context) { ran = true })
+	if ran {
+		t.Error("Ожидал, что после Shutdown работа не запускается")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	g := New()
+	release := make(chan struct{})
+	defer close(release)
+	g.Go(func(context.Context) { <-release })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Ожидал таймаут ожидания, получил %v", err)
+	}
+}
@@ -2,18 +2,57 @@ package config
 
 import (
 	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"github.com/ilyakaznacheev/cleanenv"
 	"log"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-type Delay struct {
-	Plus     time.Duration
-	Minus    time.Duration
-	Multiple time.Duration
-	Divide   time.Duration
+// Delay - задержки операций по ключу calc.Operation.DelayEnv.
+type Delay map[string]time.Duration
+
+func (d Delay) Get(operation string) time.Duration {
+	op, ok := calc.Lookup(operation)
+	if !ok {
+		return 0
+	}
+	return d[op.DelayEnv]
+}
+
+// delayFromEnv собирает задержки операций. Встроенные читает cleanenv, задержку оператора,
+// зарегистрированного в calc позже, - lookup по его DelayEnv, а без неё берётся TIME_DEFAULT_MS.
+func delayFromEnv(env envConfig, lookup func(string) (string, bool)) (Delay, error) {
+	delay := Delay{
+		"TIME_ADDITION_MS":        time.Duration(env.Delay.Plus) * time.Millisecond,
+		"TIME_SUBTRACTION_MS":     time.Duration(env.Delay.Minus) * time.Millisecond,
+		"TIME_MULTIPLICATIONS_MS": time.Duration(env.Delay.Multiple) * time.Millisecond,
+		"TIME_DIVISIONS_MS":       time.Duration(env.Delay.Divide) * time.Millisecond,
+		"TIME_POWER_MS":           time.Duration(env.Delay.Power) * time.Millisecond,
+	}
+	for name, d := range delay {
+		if d < 0 {
+			return nil, fmt.Errorf("задержка %s не может быть отрицательной", name)
+		}
+	}
+	for _, op := range calc.Operations() {
+		if _, ok := delay[op.DelayEnv]; ok {
+			continue
+		}
+		ms := env.Delay.Default
+		if value, ok := lookup(op.DelayEnv); ok {
+			var err error
+			if ms, err = strconv.Atoi(value); err != nil || ms < 0 {
+				return nil, fmt.Errorf("задержка %s должна быть неотрицательным целым, получил %q", op.DelayEnv, value)
+			}
+		}
+		delay[op.DelayEnv] = time.Duration(ms) * time.Millisecond
+	}
+	return delay, nil
 }
 
 type GRPCConfig struct {
@@ -21,15 +60,109 @@ type GRPCConfig struct {
 	Port           int
 	Ping           time.Duration
 	ComputingPower int
+	Lease          time.Duration
+}
+
+type Cache struct {
+	Size     int
+	TTL      time.Duration
+	Interval time.Duration
+}
+
+type Scheduler struct {
+	Policy string
+	Aging  time.Duration
+}
+
+type Inline struct {
+	MaxOps   int
+	MaxDelay time.Duration
+}
+
+// RetentionRule - что делать с выражениями в статусе Status, которые закончили считаться
+// больше After назад: удалить или перенести в архив.
+type RetentionRule struct {
+	Status  models.Status
+	After   time.Duration
+	Archive bool
+}
+
+func (r RetentionRule) Action() string {
+	if r.Archive {
+		return "archive"
+	}
+	return "delete"
+}
+
+type Retention struct {
+	Rules    []RetentionRule
+	Interval time.Duration
+}
+
+// Webhooks - доставка вебхуков: раз в Interval из outbox забирается до Batch доставок.
+// Неудачная попытка повторяется через Backoff, 2*Backoff, 4*Backoff... пока не кончатся MaxAttempts.
+// AllowPrivate разрешает слать вебхуки во внутреннюю сеть.
+type Webhooks struct {
+	Interval     time.Duration
+	Timeout      time.Duration
+	Backoff      time.Duration
+	MaxAttempts  int
+	Batch        int
+	AllowPrivate bool
+}
+
+// Imports - ограничения на загружаемый файл импорта.
+type Imports struct {
+	MaxLines int
+	MaxBytes int64
+}
+
+// parseRetention разбирает правила вида "failed=delete:7,done=archive:90", срок в днях.
+// Вместо кода статуса можно писать русскую подпись.
+func parseRetention(s string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		code, rest, ok := strings.Cut(item, "=")
+		action, days, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("правило %q: ожидал статус=действие:дни", item)
+		}
+		status, known := models.ParseStatus(code)
+		if !known || !status.Terminal() {
+			return nil, fmt.Errorf("правило %q: чистить можно только посчитанные, упавшие и отменённые выражения", item)
+		}
+		if action != "delete" && action != "archive" {
+			return nil, fmt.Errorf("правило %q: действие должно быть delete или archive", item)
+		}
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("правило %q: срок должен быть натуральным числом дней", item)
+		}
+		rules = append(rules, RetentionRule{Status: status, After: time.Duration(n) * 24 * time.Hour, Archive: action == "archive"})
+	}
+	return rules, nil
 }
 
 type Config struct {
-	Addr      string
-	JWTSecret string
-	URLdb     string
-	Delay     Delay
-	Mode      Mode
-	GRPC      GRPCConfig
+	Addr       string
+	JWTSecret  string
+	AdminToken string
+	URLdb      string
+	Delay      Delay
+	Mode       Mode
+	GRPC       GRPCConfig
+	Cache      Cache
+	Scheduler  Scheduler
+	StuckAfter time.Duration
+	Inline     Inline
+	BatchMax   int
+	Retention  Retention
+	Webhooks   Webhooks
+	Imports    Imports
 }
 
 type envConfig struct {
@@ -40,22 +173,57 @@ type envConfig struct {
 	DBPassword string `env:"DATABASE_PASSWORD"`
 	DBName     string `env:"DATABASE_NAME"`
 	JWTSecret  string `env:"JWT_SECRET" env-required:"true"`
+	AdminToken string `env:"ADMIN_TOKEN"`
 	Delay      struct {
 		Plus     int `env:"TIME_ADDITION_MS" env-default:"1000"`
 		Minus    int `env:"TIME_SUBTRACTION_MS" env-default:"1000"`
 		Multiple int `env:"TIME_MULTIPLICATIONS_MS" env-default:"1000"`
 		Divide   int `env:"TIME_DIVISIONS_MS" env-default:"1000"`
+		Power    int `env:"TIME_POWER_MS" env-default:"1000"`
+		Default  int `env:"TIME_DEFAULT_MS" env-default:"1000"`
 	}
 	Mode struct {
 		Console   string `env:"MODE_CONSOLE" env-default:"Dev"`
 		File      string `env:"MODE_FILE" env-default:"Prod"`
 		CleanFile string `env:"DEL_FILE" env-default:"False"`
 	}
+	Scheduler struct {
+		Policy string `env:"SCHEDULER_POLICY" env-default:"critical_path"`
+		Aging  int    `env:"PRIORITY_AGING_S" env-default:"60"`
+	}
+	StuckAfter int `env:"RETRY_STUCK_S" env-default:"300"`
+	BatchMax   int `env:"BATCH_MAX" env-default:"1000"`
+	Inline     struct {
+		MaxOps   int `env:"INLINE_MAX_OPS" env-default:"1"`
+		MaxDelay int `env:"INLINE_MAX_DELAY_MS" env-default:"0"`
+	}
+	Cache struct {
+		Size     int `env:"CACHE_SIZE" env-default:"10000"`
+		TTL      int `env:"CACHE_TTL_S" env-default:"3600"`
+		Interval int `env:"CACHE_TRIM_INTERVAL_S" env-default:"60"`
+	}
+	Retention struct {
+		Rules    string `env:"RETENTION_RULES"`
+		Interval int    `env:"RETENTION_INTERVAL_S" env-default:"3600"`
+	}
+	Webhooks struct {
+		Interval     int  `env:"WEBHOOK_INTERVAL_MS" env-default:"1000"`
+		Timeout      int  `env:"WEBHOOK_TIMEOUT_S" env-default:"10"`
+		Backoff      int  `env:"WEBHOOK_BACKOFF_S" env-default:"5"`
+		MaxAttempts  int  `env:"WEBHOOK_MAX_ATTEMPTS" env-default:"8"`
+		Batch        int  `env:"WEBHOOK_BATCH" env-default:"50"`
+		AllowPrivate bool `env:"WEBHOOK_ALLOW_PRIVATE" env-default:"false"`
+	}
+	Imports struct {
+		MaxLines int `env:"IMPORT_MAX_LINES" env-default:"100000"`
+		MaxSize  int `env:"IMPORT_MAX_SIZE_MB" env-default:"10"`
+	}
 	GRPCConfig struct {
 		Host           string `env:"GRPC_HOST" env-default:"0.0.0.0"`
 		Port           int    `env:"GRPC_PORT" env-default:"50051"`
 		Ping           int    `env:"PING" env-default:"1000"`
 		ComputingPower int    `env:"COMPUTING_POWER" env-default:"2"`
+		Lease          int    `env:"TASK_LEASE_S" env-default:"30"`
 	}
 }
 
@@ -91,16 +259,20 @@ func ConfigFromEnv(agent bool) *Config {
 			env.URLdb = pgURL.String()
 		}
 	}
+	retention, err := parseRetention(env.Retention.Rules)
+	if err != nil {
+		log.Fatalf("Ошибка в RETENTION_RULES: %s", err)
+	}
+	delay, err := delayFromEnv(env, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Ошибка в задержках операций: %s", err)
+	}
 	return &Config{
-		Addr:      "8080",
-		URLdb:     env.URLdb,
-		JWTSecret: env.JWTSecret,
-		Delay: Delay{
-			Plus:     time.Duration(env.Delay.Plus) * time.Millisecond,
-			Minus:    time.Duration(env.Delay.Minus) * time.Millisecond,
-			Multiple: time.Duration(env.Delay.Multiple) * time.Millisecond,
-			Divide:   time.Duration(env.Delay.Divide) * time.Millisecond,
-		},
+		Addr:       "8080",
+		URLdb:      env.URLdb,
+		JWTSecret:  env.JWTSecret,
+		AdminToken: env.AdminToken,
+		Delay:      delay,
 		Mode: Mode{
 			Console:   env.Mode.Console,
 			File:      env.Mode.File,
@@ -111,6 +283,38 @@ func ConfigFromEnv(agent bool) *Config {
 			Ping:           time.Duration(env.GRPCConfig.Ping) * time.Millisecond,
 			ComputingPower: env.GRPCConfig.ComputingPower,
 			Host:           env.GRPCConfig.Host,
+			Lease:          time.Duration(env.GRPCConfig.Lease) * time.Second,
+		},
+		Cache: Cache{
+			Size:     env.Cache.Size,
+			TTL:      time.Duration(env.Cache.TTL) * time.Second,
+			Interval: time.Duration(env.Cache.Interval) * time.Second,
+		},
+		Scheduler: Scheduler{
+			Policy: env.Scheduler.Policy,
+			Aging:  time.Duration(env.Scheduler.Aging) * time.Second,
+		},
+		StuckAfter: time.Duration(env.StuckAfter) * time.Second,
+		Inline: Inline{
+			MaxOps:   env.Inline.MaxOps,
+			MaxDelay: time.Duration(env.Inline.MaxDelay) * time.Millisecond,
+		},
+		BatchMax: env.BatchMax,
+		Retention: Retention{
+			Rules:    retention,
+			Interval: time.Duration(env.Retention.Interval) * time.Second,
+		},
+		Webhooks: Webhooks{
+			Interval:     time.Duration(env.Webhooks.Interval) * time.Millisecond,
+			Timeout:      time.Duration(env.Webhooks.Timeout) * time.Second,
+			Backoff:      time.Duration(env.Webhooks.Backoff) * time.Second,
+			MaxAttempts:  env.Webhooks.MaxAttempts,
+			Batch:        env.Webhooks.Batch,
+			AllowPrivate: env.Webhooks.AllowPrivate,
+		},
+		Imports: Imports{
+			MaxLines: env.Imports.MaxLines,
+			MaxBytes: int64(env.Imports.MaxSize) << 20,
 		},
 	}
 }
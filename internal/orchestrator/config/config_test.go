@@ -0,0 +1,56 @@
+package config
+
+import (
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDelayFromEnv(t *testing.T) {
+	calc.Register(calc.Operation{
+		Symbol:     "%",
+		Arity:      2,
+		Precedence: 2,
+		Eval: func(args ...float64) (float64, error) {
+			return math.Mod(args[0], args[1]), nil
+		},
+		DelayEnv: "TIME_MODULO_MS",
+	})
+	var env envConfig
+	env.Delay.Plus, env.Delay.Power, env.Delay.Default = 100, 300, 500
+	tests := []struct {
+		name  string
+		vars  map[string]string
+		want  time.Duration
+		isErr bool
+	}{
+		{name: "Custom operator", vars: map[string]string{"TIME_MODULO_MS": "250"}, want: 250 * time.Millisecond},
+		{name: "Default", want: 500 * time.Millisecond},
+		{name: "Not a number", vars: map[string]string{"TIME_MODULO_MS": "быстро"}, isErr: true},
+		{name: "Negative", vars: map[string]string{"TIME_MODULO_MS": "-1"}, isErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay, err := delayFromEnv(env, func(name string) (string, bool) {
+				value, ok := test.vars[name]
+				return value, ok
+			})
+			if test.isErr {
+				if err == nil {
+					t.Errorf("Ожидал ошибку, получил %v", delay)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := delay.Get("%"); got != test.want {
+				t.Errorf("Ожидал задержку %% %v, получил %v", test.want, got)
+			}
+			if delay.Get("+") != 100*time.Millisecond || delay.Get("^") != 300*time.Millisecond {
+				t.Errorf("Ожидал встроенные задержки из env, получил %v", delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package eta
+
+import (
+	"context"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/google/uuid"
+	"sync/atomic"
+	"time"
+)
+
+type Estimator struct {
+	r       repository.Repository
+	delay   config.Delay
+	ping    time.Duration
+	workers atomic.Int64
+}
+
+func NewEstimator(r repository.Repository, delay config.Delay, ping time.Duration) *Estimator {
+	return &Estimator{r: r, delay: delay, ping: ping}
+}
+
+func (e *Estimator) AddWorkers(n int) {
+	e.workers.Add(int64(n))
+}
+
+func (e *Estimator) Workers() int {
+	return int(e.workers.Load())
+}
+
+// Оценка снизу: выражение не посчитается быстрее своего критического пути
+// и быстрее, чем все воркеры разгребут очередь вместе с его задачами.
+func (e *Estimator) Estimate(ctx context.Context, id int) (*time.Time, error) {
+	workers := e.Workers()
+	if workers <= 0 {
+		return nil, nil
+	}
+	tasks, err := e.r.GetExpressionTasks(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := e.r.GetQueue(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	criticalPath, levels, work := e.remaining(tasks)
+	for operation, cnt := range queue {
+		work += time.Duration(cnt) * e.delay.Get(operation)
+	}
+	res := time.Now().Add(max(criticalPath, work/time.Duration(workers)) + time.Duration(levels)*e.ping)
+	return &res, nil
+}
+
+func (e *Estimator) remaining(tasks []models.Task) (time.Duration, int, time.Duration) {
+	byID := make(map[uuid.UUID]models.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+	finish := make(map[uuid.UUID]time.Duration, len(tasks))
+	levels := make(map[uuid.UUID]int, len(tasks))
+	var walk func(id uuid.UUID) (time.Duration, int)
+	walk = func(id uuid.UUID) (time.Duration, int) {
+		if f, ok := finish[id]; ok {
+			return f, levels[id]
+		}
+		task, ok := byID[id]
+		if !ok {
+			return 0, 0
+		}
+		var start time.Duration
+		level := 1
+		for _, dep := range []*uuid.UUID{task.LeftID, task.RightID} {
+			if dep == nil {
+				continue
+			}
+			f, l := walk(*dep)
+			start = max(start, f)
+			level = max(level, l+1)
+		}
+		finish[id] = start + e.delay.Get(task.Operation)
+		levels[id] = level
+		return finish[id], level
+	}
+	var criticalPath, work time.Duration
+	var maxLevel int
+	for _, task := range tasks {
+		f, l := walk(task.ID)
+		criticalPath = max(criticalPath, f)
+		maxLevel = max(maxLevel, l)
+		work += e.delay.Get(task.Operation)
+	}
+	return criticalPath, maxLevel, work
+}
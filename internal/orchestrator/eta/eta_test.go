@@ -0,0 +1,57 @@
+package eta
+
+import (
+	"context"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	ctx := context.Background()
+	delay := config.Delay{"TIME_ADDITION_MS": time.Second, "TIME_MULTIPLICATIONS_MS": 2 * time.Second}
+	r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := ast.NewAST(r, zap.NewNop().Sugar(), &config.Config{Delay: delay})
+	submit := func(expression string) int {
+		id, err := r.SetWithExpression(ctx, 1, models.Expressions{Status: models.StatusPending}, expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Calc(ctx, expression, id)
+		return id
+	}
+	// Критический путь 3 с(сложение, потом умножение), всего работы 4 с, и ещё 1 с в очереди от другого выражения.
+	id := submit("(1+2)*(3+4)")
+	submit("5+6")
+	e := NewEstimator(r, delay, 100*time.Millisecond)
+	if eta, err := e.Estimate(ctx, id); err != nil || eta != nil {
+		t.Errorf("Ожидал, что без воркеров оценки нет, получил %v, %v", eta, err)
+	}
+	cases := []struct {
+		workers int
+		want    time.Duration
+	}{
+		// Один воркер разгребает всю работу подряд: 5 с плюс ожидание опроса на двух уровнях.
+		{workers: 1, want: 5200 * time.Millisecond},
+		// Воркеров много: упираемся в критический путь.
+		{workers: 4, want: 3200 * time.Millisecond},
+	}
+	for _, c := range cases {
+		e.AddWorkers(c.workers - e.Workers())
+		before := time.Now()
+		eta, err := e.Estimate(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eta == nil || eta.Before(before.Add(c.want)) || eta.After(time.Now().Add(c.want)) {
+			t.Errorf("Ожидал оценку через %v при %d воркерах, получил %v", c.want, c.workers, eta)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package importer
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/background"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"go.uber.org/zap"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Parse читает загруженный файл. В CSV первая колонка - выражение, вторая, необязательная, - внешняя
+// ссылка, заголовок "expression,..." пропускается. В остальных файлах выражение - вся строка.
+// Пустые строки пропускаются, но номера строк остаются как в файле.
+func Parse(r io.Reader, isCSV bool, maxLines int) ([]models.ImportLine, error) {
+	var lines []models.ImportLine
+	add := func(n int, expression, ref string) error {
+		// Excel пишет в начало UTF-8 файла BOM.
+		if n == 1 {
+			expression = strings.TrimPrefix(expression, "\ufeff")
+		}
+		expression = strings.TrimSpace(expression)
+		if expression == "" {
+			return nil
+		}
+		if len(lines) == maxLines {
+			return calc.ErrImportTooLarge
+		}
+		lines = append(lines, models.ImportLine{Line: n, Expression: expression, Ref: strings.TrimSpace(ref)})
+		return nil
+	}
+	if !isCSV {
+		scanner := bufio.NewScanner(r)
+		for n := 1; scanner.Scan(); n++ {
+			if err := add(n, scanner.Text(), ""); err != nil {
+				return nil, err
+			}
+		}
+		if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+			return nil, calc.ErrImportTooLarge
+		}
+		return lines, scanner.Err()
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", calc.ErrImportCSV, err)
+		}
+		n, _ := reader.FieldPos(0)
+		if n == 1 && strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(record[0], "\ufeff")), "expression") {
+			continue
+		}
+		ref := ""
+		if len(record) > 1 {
+			ref = record[1]
+		}
+		if err = add(n, record[0], ref); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Importer создаёт выражения из разобранного файла в фоне, порциями по chunk строк.
+type Importer struct {
+	a      *ast.AST
+	r      repository.Repository
+	bg     *background.Group
+	chunk  int
+	logger *zap.SugaredLogger
+}
+
+func New(a *ast.AST, r repository.Repository, bg *background.Group, chunk int, logger *zap.SugaredLogger) *Importer {
+	return &Importer{a: a, r: r, bg: bg, chunk: max(chunk, 1), logger: logger}
+}
+
+// Start заводит задание импорта и сразу возвращает его ID, строки разбираются уже после ответа.
+func (im *Importer) Start(ctx context.Context, userID int, filename, priority string, lines []models.ImportLine) (int, error) {
+	id, err := im.r.CreateImport(ctx, userID, filename, len(lines))
+	if err != nil {
+		return 0, err
+	}
+	im.bg.Go(func(ctx context.Context) {
+		im.run(ctx, userID, id, priority, lines)
+	})
+	return id, nil
+}
+
+func (im *Importer) run(ctx context.Context, userID, id int, priority string, lines []models.ImportLine) {
+	state := models.ImportDone
+	for chunk := range slices.Chunk(lines, im.chunk) {
+		if ctx.Err() != nil {
+			im.logger.Warnf("Импорт %d прерван остановкой оркестратора", id)
+			state = models.ImportFailed
+			break
+		}
+		if err := im.process(ctx, userID, id, priority, chunk); err != nil {
+			im.logger.Errorf("Ошибка импорта %d: %v", id, err)
+			state = models.ImportFailed
+			break
+		}
+	}
+	// Итог пишем и при остановке, иначе задание так и останется running.
+	if err := im.r.FinishImport(context.WithoutCancel(ctx), id, state); err != nil {
+		im.logger.Errorf("Ошибка завершения импорта %d: %v", id, err)
+		return
+	}
+	im.logger.Infof("Импорт %d завершён: %s", id, state)
+}
+
+func (im *Importer) process(ctx context.Context, userID, id int, priority string, lines []models.ImportLine) error {
+	var values []models.Expressions
+	var expressions []string
+	var errs []models.ImportError
+	for _, line := range lines {
+		if err := im.a.Validate(line.Expression); err != nil {
+			errs = append(errs, models.ImportError{Line: line.Line, Ref: line.Ref, Error: err.Error()})
+			continue
+		}
+		values = append(values, models.Expressions{Status: models.StatusPending, Priority: priority, ExternalRef: line.Ref})
+		expressions = append(expressions, line.Expression)
+	}
+	// Порцию записываем целиком и при остановке: выражения, до которых не дошёл разбор, подберёт Replan.
+	write := context.WithoutCancel(ctx)
+	var ids []int
+	if len(values) > 0 {
+		var err error
+		if ids, err = im.r.SetBatch(write, userID, values, expressions); err != nil {
+			return err
+		}
+	}
+	// Сначала строим задачи: записанные выражения должны посчитаться, даже если прогресс не запишется.
+	im.a.CalcAll(ctx, ids, expressions)
+	return im.r.AddImportProgress(write, id, len(ids), errs)
+}
@@ -0,0 +1,119 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/background"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name  string
+		file  string
+		isCSV bool
+		want  []models.ImportLine
+		err   error
+	}{
+		{
+			name: "Text",
+			file: "2+2\n\n  3*4 \n",
+			want: []models.ImportLine{{Line: 1, Expression: "2+2"}, {Line: 3, Expression: "3*4"}},
+		},
+		{
+			name:  "CSV",
+			file:  "\ufeffexpression,ref\n2+2,A-1\n\"(1+2)*3\"\n",
+			isCSV: true,
+			want:  []models.ImportLine{{Line: 2, Expression: "2+2", Ref: "A-1"}, {Line: 3, Expression: "(1+2)*3"}},
+		},
+		{name: "Broken CSV", file: "2+2,\"A-1\n", isCSV: true, err: calc.ErrImportCSV},
+		{name: "Too many lines", file: "1\n2\n3\n4\n", err: calc.ErrImportTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(c.file), c.isCSV, 3)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Ожидал ошибку %v, получил %v", c.err, err)
+			}
+			if c.err == nil && !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Ожидал %+v, получил %+v", c.want, got)
+			}
+		})
+	}
+}
+
+func newImporter(t *testing.T) (*Importer, *memory.Repository) {
+	r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zap.NewNop().Sugar()
+	return New(ast.NewAST(r, logger, &config.Config{}), r, background.New(), 2, logger), r
+}
+
+func TestImporter(t *testing.T) {
+	ctx := context.Background()
+	im, r := newImporter(t)
+	lines := []models.ImportLine{
+		{Line: 1, Expression: "2+2", Ref: "A-1"},
+		{Line: 2, Expression: "2+", Ref: "A-2"},
+		{Line: 4, Expression: "3*4"},
+	}
+	id, err := im.Start(ctx, 1, "data.csv", "", lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job models.Import
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if job, err = r.GetImport(ctx, 1, id); err != nil {
+			t.Fatal(err)
+		}
+		if job.State != models.ImportRunning || time.Now().After(deadline) {
+			break
+		}
+	}
+	if job.State != models.ImportDone || job.Total != 3 || job.Processed != 3 || job.Created != 2 || job.Failed != 1 {
+		t.Fatalf("Ожидал завершённый импорт 2 из 3, получил %+v", job)
+	}
+	want := []models.ImportError{{Line: 2, Ref: "A-2", Error: calc.ErrInvalidOperands.Error()}}
+	if !reflect.DeepEqual(job.Errors, want) {
+		t.Errorf("Ожидал ошибки %+v, получил %+v", want, job.Errors)
+	}
+	first, _, _ := r.GetAll(ctx, 1, repository.ListQuery{Limit: 1})
+	if len(first) != 1 || first[0].ExternalRef != "A-1" {
+		t.Errorf("Ожидал выражение со ссылкой A-1, получил %+v", first)
+	}
+	if _, err = r.GetImport(ctx, 2, id); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Чужой импорт виден: %v", err)
+	}
+}
+
+func TestImporterShutdown(t *testing.T) {
+	ctx := context.Background()
+	im, r := newImporter(t)
+	lines := []models.ImportLine{{Line: 1, Expression: "2+2"}, {Line: 2, Expression: "3*4"}, {Line: 3, Expression: "5-1"}}
+	id, err := r.CreateImport(ctx, 1, "", len(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, cancel := context.WithCancel(ctx)
+	cancel()
+	im.run(stopped, 1, id, "", lines)
+	job, err := r.GetImport(ctx, 1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != models.ImportFailed || job.FinishedAt == nil || job.Processed != 0 {
+		t.Errorf("Ожидал прерванный импорт с ошибкой, получил %+v", job)
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Состояния импорта.
+const (
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportFailed  = "failed"
+)
+
+// ImportLine - строка загруженного файла. Line считается с единицы, как в редакторе.
+type ImportLine struct {
+	Line       int
+	Expression string
+	Ref        string
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Ref   string `json:"ref,omitempty"`
+	Error string `json:"error"`
+}
+
+// Import - задание импорта. Processed = Created + Failed, импорт закончен, когда Processed = Total.
+type Import struct {
+	ID         int           `json:"id"`
+	Filename   string        `json:"filename,omitempty"`
+	State      string        `json:"state"`
+	Total      int           `json:"total"`
+	Processed  int           `json:"processed"`
+	Created    int           `json:"created"`
+	Failed     int           `json:"failed"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+	Errors     []ImportError `json:"errors"`
+}
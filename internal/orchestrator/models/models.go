@@ -15,6 +15,29 @@ type Task struct {
 	LeftID        *uuid.UUID
 	RightID       *uuid.UUID
 	OperationTime time.Duration `json:"operation_time"`
+	CriticalPath  time.Duration
+	Done          <-chan struct{} `json:"-"`
+	// Error - ошибка вычисления у агента. Непустая роняет выражение, Result тогда не смотрят.
+	Error string `json:"-"`
+}
+
+// TaskTiming - жизненный цикл задачи. Agent пустой, если результат взят из кэша.
+type TaskTiming struct {
+	ID           uuid.UUID  `json:"id"`
+	Operation    string     `json:"operation"`
+	Agent        string     `json:"agent,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	QueueWaitMs  *int64     `json:"queue_wait_ms,omitempty"`
+	RunTimeMs    *int64     `json:"run_time_ms,omitempty"`
+}
+
+func (t *TaskTiming) SetDurations() {
+	t.QueueWaitMs = sinceMs(t.CreatedAt, t.DispatchedAt)
+	if t.DispatchedAt != nil {
+		t.RunTimeMs = sinceMs(*t.DispatchedAt, t.CompletedAt)
+	}
 }
 
 type TaskWrapper struct {
@@ -22,7 +45,165 @@ type TaskWrapper struct {
 }
 
 type Expressions struct {
-	ID     int64   `json:"id"`
-	Status string  `json:"status"`
-	Result *string `json:"result"`
+	ID          int64      `json:"id"`
+	Status      Status     `json:"status"`
+	StatusLabel string     `json:"status_label,omitempty"`
+	Result      *string    `json:"result"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+	ExternalRef string     `json:"external_ref,omitempty"`
+	Priority    string     `json:"priority,omitempty"`
+	ETA         *time.Time `json:"eta,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// StartedAt - первая задача ушла агенту, FinishedAt - выражение посчитано, упало или отменено.
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	QueueWaitMs *int64     `json:"queue_wait_ms,omitempty"`
+	WallTimeMs  *int64     `json:"wall_time_ms,omitempty"`
+}
+
+func (e *Expressions) Localize() {
+	e.StatusLabel = e.Status.Label()
+}
+
+// SetDurations считает ожидание в очереди и полное время от создания до завершения.
+func (e *Expressions) SetDurations() {
+	e.QueueWaitMs = sinceMs(e.CreatedAt, e.StartedAt)
+	e.WallTimeMs = sinceMs(e.CreatedAt, e.FinishedAt)
+}
+
+// ExportRow - строка выгрузки истории выражений.
+type ExportRow struct {
+	ID          int64      `json:"id"`
+	Expression  string     `json:"expression"`
+	ExternalRef string     `json:"external_ref,omitempty"`
+	Status      Status     `json:"status"`
+	Result      *string    `json:"result"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+func sinceMs(from time.Time, to *time.Time) *int64 {
+	if to == nil {
+		return nil
+	}
+	ms := to.Sub(from).Milliseconds()
+	return &ms
+}
+
+const (
+	PriorityBatch = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorities = []string{"batch", "normal", "high"}
+
+func ParsePriority(s string) (int, bool) {
+	if s == "" {
+		return PriorityNormal, true
+	}
+	for p, name := range priorities {
+		if name == s {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+func PriorityName(p int) string {
+	if p < 0 || p >= len(priorities) {
+		return ""
+	}
+	return priorities[p]
+}
+
+type PlanTask struct {
+	ID            uuid.UUID  `json:"id"`
+	Operation     string     `json:"operation"`
+	Arg1          *float64   `json:"arg1"`
+	Arg2          *float64   `json:"arg2"`
+	LeftID        *uuid.UUID `json:"left_id"`
+	RightID       *uuid.UUID `json:"right_id"`
+	Level         int        `json:"level"`
+	OperationTime int64      `json:"operation_time"`
+}
+
+type Plan struct {
+	Tasks        []PlanTask `json:"tasks"`
+	Levels       []int      `json:"levels"`
+	CriticalPath int64      `json:"critical_path"`
+}
+
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Size   int64 `json:"size"`
+}
+
+// Типы событий истории выражения.
+const (
+	EventSubmitted      = "submitted"
+	EventParsed         = "parsed"
+	EventTaskDispatched = "task_dispatched"
+	EventTaskCompleted  = "task_completed"
+	EventTaskRequeued   = "task_requeued"
+	EventTaskCancelled  = "task_cancelled"
+	EventTaskFailed     = "task_failed"
+	EventCompleted      = "completed"
+	EventErrored        = "errored"
+	EventCancelled      = "cancelled"
+	EventRetried        = "retried"
+)
+
+// Event - один переход выражения или его задачи. Agent - только у событий, связанных с агентом,
+// Detail - результат или статус, из которого перезапустили.
+type Event struct {
+	ID        int64      `json:"id"`
+	Type      string     `json:"type"`
+	TaskID    *uuid.UUID `json:"task_id,omitempty"`
+	Agent     string     `json:"agent,omitempty"`
+	Detail    string     `json:"detail,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// PurgeResult - сколько выражений в статусе Status удалила или перенесла в архив чистка.
+type PurgeResult struct {
+	Status Status `json:"status"`
+	Action string `json:"action"`
+	Count  int64  `json:"count"`
+}
+
+type Attempt struct {
+	Attempt     int       `json:"attempt"`
+	Status      Status    `json:"status"`
+	StatusLabel string    `json:"status_label,omitempty"`
+	Result      *string   `json:"result"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+type SweepRow struct {
+	Values      map[string]float64 `json:"values"`
+	ID          int64              `json:"id"`
+	Status      Status             `json:"status"`
+	StatusLabel string             `json:"status_label,omitempty"`
+	Result      *string            `json:"result"`
+}
+
+type Sweep struct {
+	ID          int        `json:"id"`
+	Expression  string     `json:"expression"`
+	Status      Status     `json:"status"`
+	StatusLabel string     `json:"status_label,omitempty"`
+	Total       int        `json:"total"`
+	Done        int        `json:"done"`
+	Results     []SweepRow `json:"results,omitempty"`
+}
+
+func (s *Sweep) Localize() {
+	s.StatusLabel = s.Status.Label()
+	for i := range s.Results {
+		s.Results[i].StatusLabel = s.Results[i].Status.Label()
+	}
 }
@@ -0,0 +1,69 @@
+package models
+
+import "slices"
+
+// Status - стабильный код статуса выражения. Код хранится в СУБД и отдаётся в API,
+// подпись для людей - отдельно, через Label.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+var statusLabels = map[Status]string{
+	StatusPending:   "В очереди",
+	StatusRunning:   "Подсчёт",
+	StatusDone:      "Выполнено",
+	StatusFailed:    "Ошибка",
+	StatusCancelled: "Отменено",
+}
+
+// transitions - разрешённые переходы. В pending выражение возвращается только перезапуском.
+var transitions = map[Status][]Status{
+	StatusPending: {StatusPending, StatusRunning, StatusDone, StatusFailed, StatusCancelled},
+	StatusRunning: {StatusPending, StatusDone, StatusFailed, StatusCancelled},
+	StatusFailed:  {StatusPending},
+}
+
+// ParseStatus принимает код или русскую подпись: старые клиенты фильтруют по подписям.
+func ParseStatus(s string) (Status, bool) {
+	for status, label := range statusLabels {
+		if s == string(status) || s == label {
+			return status, true
+		}
+	}
+	return "", false
+}
+
+func (s Status) Label() string {
+	return statusLabels[s]
+}
+
+// Active - выражение ещё считается.
+func (s Status) Active() bool {
+	return s == StatusPending || s == StatusRunning
+}
+
+func (s Status) Terminal() bool {
+	return s == StatusDone || s == StatusFailed || s == StatusCancelled
+}
+
+func (s Status) CanTransition(to Status) bool {
+	return slices.Contains(transitions[s], to)
+}
+
+// StatusesTo возвращает статусы, из которых можно перейти в to. Нужен для UPDATE ... WHERE status IN (...).
+func StatusesTo(to Status) []Status {
+	var res []Status
+	for from, targets := range transitions {
+		if slices.Contains(targets, to) {
+			res = append(res, from)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
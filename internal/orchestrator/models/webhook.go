@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Состояния записи outbox вебхуков.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// WebhookPayload - тело вебхука. Снимок выражения на момент, когда оно пришло в конечный статус.
+type WebhookPayload struct {
+	ID         int64      `json:"id"`
+	Status     Status     `json:"status"`
+	Result     *string    `json:"result"`
+	Attempt    int        `json:"attempt"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// Webhook - доставка из outbox, которую пора отправить. Attempt - номер этой попытки.
+type Webhook struct {
+	ID           int64
+	ExpressionID int64
+	URL          string
+	Payload      []byte
+	Secret       string
+	Attempt      int
+}
+
+type WebhookDelivery struct {
+	WebhookID  int64     `json:"-"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Delivered - получатель ответил 2xx.
+func (d WebhookDelivery) Delivered() bool {
+	return d.StatusCode >= 200 && d.StatusCode < 300
+}
+
+// WebhookLog - вебхук выражения и журнал попыток его доставки.
+type WebhookLog struct {
+	ID            int64             `json:"id"`
+	URL           string            `json:"url"`
+	State         string            `json:"state"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt *time.Time        `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Deliveries    []WebhookDelivery `json:"deliveries"`
+}
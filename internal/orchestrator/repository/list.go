@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"time"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+var ErrInvalidQuery = errors.New("некорректные параметры выборки")
+
+// Сортировки списка выражений. Минус - по убыванию.
+var Sorts = map[string]struct {
+	Column string
+	Desc   bool
+}{
+	"id":          {"id", false},
+	"-id":         {"id", true},
+	"created_at":  {"created_at", false},
+	"-created_at": {"created_at", true},
+}
+
+// ListQuery - фильтры и страница для GetAll. Нулевые поля не фильтруют.
+type ListQuery struct {
+	Limit       int
+	After       *Cursor
+	Status      models.Status
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Search      string
+	Sort        string
+}
+
+// PageSize - Limit в пределах (0, MaxLimit], по умолчанию DefaultLimit.
+func (q ListQuery) PageSize() int {
+	if q.Limit <= 0 {
+		return DefaultLimit
+	}
+	return min(q.Limit, MaxLimit)
+}
+
+// Cursor - последняя строка прошлой страницы. Сортировка всегда добивается ID,
+// поэтому пары (created_at, id) хватает для любой из Sorts.
+type Cursor struct {
+	ID        int64
+	CreatedAt time.Time
+}
+
+func (c Cursor) String() string {
+	raw := fmt.Sprintf("%d:%d", c.ID, c.CreatedAt.UnixMicro())
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidQuery
+	}
+	var id, micro int64
+	if _, err = fmt.Sscanf(string(raw), "%d:%d", &id, &micro); err != nil {
+		return nil, ErrInvalidQuery
+	}
+	return &Cursor{ID: id, CreatedAt: time.UnixMicro(micro)}, nil
+}
+
+// Page обрезает выборку из limit+1 строк до limit и возвращает курсор следующей страницы.
+func Page(rows []models.Expressions, limit int) ([]models.Expressions, string) {
+	if len(rows) <= limit {
+		return rows, ""
+	}
+	rows = rows[:limit]
+	last := rows[limit-1]
+	return rows, Cursor{ID: last.ID, CreatedAt: last.CreatedAt}.String()
+}
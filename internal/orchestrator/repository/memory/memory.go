@@ -0,0 +1,1155 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"github.com/Cool-Andrey/Calculating/pkg/calc/safeStructures"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ repository.Repository = (*Repository)(nil)
+
+type expression struct {
+	userID       int
+	text         string
+	priority     int
+	mainTaskID   *uuid.UUID
+	attempt      int
+	startedAt    time.Time
+	sweepID      int
+	sweepValues  map[string]float64
+	attemptsDone []models.Attempt
+	// Суммарное время открытых задач, как колонка expressions.remaining_cost.
+	remaining time.Duration
+}
+
+// Состояния задачи, как в колонке tasks.state.
+const (
+	statePending   = "pending"
+	stateLeased    = "leased"
+	stateDone      = "done"
+	stateCancelled = "cancelled"
+	stateFailed    = "failed"
+)
+
+type task struct {
+	models.Task
+	priority     int
+	createdAt    time.Time
+	state        string
+	stream       string
+	leaseUntil   time.Time
+	agent        string
+	dispatchedAt *time.Time
+	completedAt  *time.Time
+	// Исходные связи графа: LeftID и RightID обнуляются, когда зависимость посчитана.
+	planLeftID  *uuid.UUID
+	planRightID *uuid.UUID
+}
+
+func (t *task) open() bool {
+	return t.state == statePending || t.state == stateLeased
+}
+
+type user struct {
+	id   int
+	hash []byte
+}
+
+type cacheKey struct {
+	operation  string
+	arg1, arg2 float64
+}
+
+type cacheEntry struct {
+	result    float64
+	createdAt time.Time
+}
+
+type webhook struct {
+	models.WebhookLog
+	expressionID  int
+	userID        int
+	payload       []byte
+	nextAttemptAt time.Time
+}
+
+type importJob struct {
+	models.Import
+	userID    int
+	updatedAt time.Time
+}
+
+type sweep struct {
+	userID     int
+	expression string
+	ids        []int
+}
+
+// Repository хранит всё в памяти процесса. Один мьютекс на всё хранилище
+// заменяет транзакции: изменения графа задач видны только целиком.
+type Repository struct {
+	repository.Broadcaster
+	mux         sync.Mutex
+	ids         *safeStructures.SafeId
+	sweepIDs    *safeStructures.SafeId
+	expressions *safeStructures.SafeMap
+	meta        map[int]*expression
+	tasks       map[uuid.UUID]*task
+	userIDs     *safeStructures.SafeId
+	users       map[string]user
+	sweeps      map[int]*sweep
+	archive     map[int]models.Expressions
+	events      map[int][]models.Event
+	eventID     int64
+	webhooks    []*webhook
+	webhookID   int64
+	secrets     map[int]string
+	imports     map[int]*importJob
+	cache       map[cacheKey]cacheEntry
+	cacheCfg    config.Cache
+	hits        int64
+	misses      int64
+	less        func(r *Repository, a, b *task, now time.Time) int
+	aging       time.Duration
+}
+
+// Те же политики, что и в postgres.
+var policies = map[string]func(r *Repository, a, b *task, now time.Time) int{
+	"fifo": func(_ *Repository, a, b *task, _ time.Time) int {
+		return cmp.Or(cmp.Compare(a.ExpressionID, b.ExpressionID), a.createdAt.Compare(b.createdAt))
+	},
+	"critical_path": func(_ *Repository, a, b *task, now time.Time) int {
+		scoreA := a.CriticalPath + now.Sub(a.createdAt)
+		scoreB := b.CriticalPath + now.Sub(b.createdAt)
+		return cmp.Or(cmp.Compare(scoreB, scoreA), cmp.Compare(a.ExpressionID, b.ExpressionID))
+	},
+	"sjf": func(r *Repository, a, b *task, _ time.Time) int {
+		return cmp.Or(cmp.Compare(r.remaining(a.ExpressionID), r.remaining(b.ExpressionID)), cmp.Compare(a.ExpressionID, b.ExpressionID))
+	},
+}
+
+func NewRepository(cache config.Cache, scheduler config.Scheduler) (*Repository, error) {
+	less, ok := policies[scheduler.Policy]
+	if !ok {
+		return nil, fmt.Errorf("неизвестная политика планировщика: %s", scheduler.Policy)
+	}
+	return &Repository{
+		ids:         safeStructures.NewSafeId(),
+		sweepIDs:    safeStructures.NewSafeId(),
+		expressions: safeStructures.NewSafeMap(),
+		meta:        make(map[int]*expression),
+		tasks:       make(map[uuid.UUID]*task),
+		userIDs:     safeStructures.NewSafeId(),
+		users:       make(map[string]user),
+		sweeps:      make(map[int]*sweep),
+		archive:     make(map[int]models.Expressions),
+		events:      make(map[int][]models.Event),
+		secrets:     make(map[int]string),
+		imports:     make(map[int]*importJob),
+		cache:       make(map[cacheKey]cacheEntry),
+		cacheCfg:    cache,
+		less:        less,
+		aging:       scheduler.Aging,
+	}, nil
+}
+
+func (r *Repository) cost(expressionID int) time.Duration {
+	var sum time.Duration
+	for _, t := range r.tasks {
+		if t.ExpressionID == expressionID && t.open() {
+			sum += t.OperationTime
+		}
+	}
+	return sum
+}
+
+func (r *Repository) remaining(expressionID int) time.Duration {
+	if e, ok := r.meta[expressionID]; ok {
+		return e.remaining
+	}
+	return 0
+}
+
+func (r *Repository) priority(t *task, now time.Time) int {
+	if r.aging <= 0 {
+		return t.priority
+	}
+	return min(models.PriorityHigh, t.priority+int(now.Sub(t.createdAt)/r.aging))
+}
+
+func (r *Repository) insert(userID int, value models.Expressions, text string, priority int) int {
+	id := r.ids.Get()
+	// Точность как у курсора, иначе строка на границе страницы потеряется.
+	createdAt := time.Now().Truncate(time.Microsecond)
+	r.expressions.Set(id, models.Expressions{ID: int64(id), Status: value.Status, CallbackURL: value.CallbackURL,
+		ExternalRef: value.ExternalRef, Priority: models.PriorityName(priority), CreatedAt: createdAt})
+	r.meta[id] = &expression{userID: userID, text: text, priority: priority, attempt: 1, startedAt: time.Now()}
+	r.addEvent(id, models.EventSubmitted, nil, "", "")
+	if value.Status.Terminal() {
+		r.addEvent(id, statusEvent(value.Status), nil, "", "")
+		r.enqueueWebhook(id)
+	}
+	return id
+}
+
+// addEvent пишет историю так же, как триггеры postgres и sqlite. Вызывается под мьютексом.
+func (r *Repository) addEvent(id int, eventType string, taskID *uuid.UUID, agent, detail string) {
+	r.eventID++
+	r.events[id] = append(r.events[id], models.Event{
+		ID:        r.eventID,
+		Type:      eventType,
+		TaskID:    taskID,
+		Agent:     agent,
+		Detail:    detail,
+		CreatedAt: time.Now(),
+	})
+}
+
+func statusEvent(status models.Status) string {
+	switch status {
+	case models.StatusDone:
+		return models.EventCompleted
+	case models.StatusFailed:
+		return models.EventErrored
+	}
+	return models.EventCancelled
+}
+
+// owned возвращает выражение, только если оно принадлежит пользователю. Вызывается под мьютексом.
+func (r *Repository) owned(userID, id int) (*expression, bool) {
+	e, ok := r.meta[id]
+	if !ok || e.userID != userID {
+		return nil, false
+	}
+	return e, true
+}
+
+func (r *Repository) Get(_ context.Context, userID, key int) (models.Expressions, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.owned(userID, key); !ok {
+		return models.Expressions{}, repository.ErrNotFound
+	}
+	return withResult(r.expressions.Get(key)), nil
+}
+
+// withResult повторяет COALESCE(result, ”) из postgres.
+func withResult(e models.Expressions) models.Expressions {
+	if e.Result == nil {
+		empty := ""
+		e.Result = &empty
+	}
+	return e
+}
+
+func (r *Repository) Set(_ context.Context, value models.Expressions) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if value.Result == nil {
+		return int64(r.insert(0, value, "", models.PriorityNormal)), nil
+	}
+	id := int(value.ID)
+	e, ok := r.meta[id]
+	if !ok || !r.expressions.Get(id).Status.CanTransition(value.Status) {
+		return value.ID, repository.ErrInvalidTransition
+	}
+	r.start(id)
+	r.setResult(id, value.Status, value.Result)
+	e.mainTaskID = nil
+	return value.ID, nil
+}
+
+// setResult меняет статус. Конечный статус ставит finished_at, пишет событие и, как триггеры
+// postgres и sqlite, кладёт вебхук в outbox.
+func (r *Repository) setResult(id int, status models.Status, result *string) {
+	e := r.expressions.Get(id)
+	changed := status.Terminal() && status != e.Status
+	if changed {
+		detail := ""
+		if result != nil {
+			detail = *result
+		}
+		r.addEvent(id, statusEvent(status), nil, "", detail)
+		now := time.Now()
+		e.FinishedAt = &now
+	}
+	e.Status = status
+	e.Result = result
+	r.expressions.Set(id, e)
+	if changed {
+		r.enqueueWebhook(id)
+	}
+}
+
+func (r *Repository) enqueueWebhook(id int) {
+	e := r.expressions.Get(id)
+	if e.CallbackURL == "" {
+		return
+	}
+	meta := r.meta[id]
+	payload, _ := json.Marshal(models.WebhookPayload{
+		ID:         e.ID,
+		Status:     e.Status,
+		Result:     e.Result,
+		Attempt:    meta.attempt,
+		FinishedAt: e.FinishedAt,
+	})
+	now := time.Now()
+	r.webhookID++
+	r.webhooks = append(r.webhooks, &webhook{
+		WebhookLog: models.WebhookLog{
+			ID:         r.webhookID,
+			URL:        e.CallbackURL,
+			State:      models.WebhookPending,
+			CreatedAt:  now,
+			Deliveries: []models.WebhookDelivery{},
+		},
+		expressionID:  id,
+		userID:        meta.userID,
+		payload:       payload,
+		nextAttemptAt: now,
+	})
+}
+
+func (r *Repository) start(id int) {
+	e := r.expressions.Get(id)
+	if e.StartedAt == nil {
+		now := time.Now()
+		e.StartedAt = &now
+		r.expressions.Set(id, e)
+	}
+}
+
+func matches(e models.Expressions, text string, lq repository.ListQuery) bool {
+	switch {
+	case lq.Status != "" && e.Status != lq.Status:
+		return false
+	case !lq.CreatedFrom.IsZero() && e.CreatedAt.Before(lq.CreatedFrom):
+		return false
+	case !lq.CreatedTo.IsZero() && !e.CreatedAt.Before(lq.CreatedTo):
+		return false
+	case lq.Search != "" && !strings.Contains(text, lq.Search):
+		return false
+	}
+	return true
+}
+
+func (r *Repository) GetAll(_ context.Context, userID int, lq repository.ListQuery) ([]models.Expressions, string, error) {
+	sort := repository.Sorts[lq.Sort]
+	compare := func(a, b models.Expressions) int {
+		c := cmp.Compare(a.ID, b.ID)
+		if sort.Column == "created_at" {
+			c = cmp.Or(a.CreatedAt.Compare(b.CreatedAt), c)
+		}
+		if sort.Desc {
+			return -c
+		}
+		return c
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var res []models.Expressions
+	for _, e := range r.expressions.GetAll() {
+		meta, ok := r.owned(userID, int(e.ID))
+		if !ok || !matches(e, meta.text, lq) {
+			continue
+		}
+		if lq.After != nil && compare(e, models.Expressions{ID: lq.After.ID, CreatedAt: lq.After.CreatedAt}) <= 0 {
+			continue
+		}
+		res = append(res, withResult(e))
+	}
+	slices.SortFunc(res, compare)
+	res, next := repository.Page(res, lq.PageSize())
+	return res, next, nil
+}
+
+// Export собирает снимок под блокировкой, а fn вызывает уже без неё: fn пишет в сеть.
+func (r *Repository) Export(_ context.Context, userID int, lq repository.ListQuery, fn func(models.ExportRow) error) error {
+	r.mux.Lock()
+	var rows []models.ExportRow
+	for _, e := range r.expressions.GetAll() {
+		meta, ok := r.owned(userID, int(e.ID))
+		if !ok || !matches(e, meta.text, lq) {
+			continue
+		}
+		rows = append(rows, models.ExportRow{ID: e.ID, Expression: meta.text, ExternalRef: e.ExternalRef, Status: e.Status,
+			Result: e.Result, CreatedAt: e.CreatedAt, StartedAt: e.StartedAt, FinishedAt: e.FinishedAt})
+	}
+	r.mux.Unlock()
+	slices.SortFunc(rows, func(a, b models.ExportRow) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) SetWithExpression(_ context.Context, userID int, value models.Expressions, text string) (int, error) {
+	priority, ok := models.ParsePriority(value.Priority)
+	if !ok {
+		return 0, calc.ErrInvalidPriority
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.insert(userID, value, text, priority), nil
+}
+
+func (r *Repository) SetBatch(_ context.Context, userID int, values []models.Expressions, expressions []string) ([]int, error) {
+	priorities := make([]int, len(values))
+	for i, value := range values {
+		priority, ok := models.ParsePriority(value.Priority)
+		if !ok {
+			return nil, calc.ErrInvalidPriority
+		}
+		priorities[i] = priority
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	ids := make([]int, len(values))
+	for i, value := range values {
+		ids[i] = r.insert(userID, value, expressions[i], priorities[i])
+	}
+	return ids, nil
+}
+
+func (r *Repository) CreateSweep(_ context.Context, userID int, template, priority string, expressions []string, values []map[string]float64) (int, []int, error) {
+	p, ok := models.ParsePriority(priority)
+	if !ok {
+		return 0, nil, calc.ErrInvalidPriority
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	sweepID := r.sweepIDs.Get()
+	s := &sweep{userID: userID, expression: template, ids: make([]int, len(expressions))}
+	for i, text := range expressions {
+		id := r.insert(userID, models.Expressions{Status: models.StatusPending}, text, p)
+		r.meta[id].sweepID = sweepID
+		r.meta[id].sweepValues = values[i]
+		s.ids[i] = id
+	}
+	r.sweeps[sweepID] = s
+	return sweepID, s.ids, nil
+}
+
+func (r *Repository) GetSweep(_ context.Context, userID, id int) (models.Sweep, error) {
+	res := models.Sweep{ID: id, Status: models.StatusDone}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	s, ok := r.sweeps[id]
+	if !ok || s.userID != userID {
+		return res, repository.ErrNotFound
+	}
+	res.Expression = s.expression
+	for _, exprID := range s.ids {
+		e := r.expressions.Get(exprID)
+		res.Total++
+		if e.Status.Active() {
+			res.Status = models.StatusRunning
+		} else {
+			res.Done++
+		}
+		res.Results = append(res.Results, models.SweepRow{
+			Values: r.meta[exprID].sweepValues,
+			ID:     e.ID,
+			Status: e.Status,
+			Result: e.Result,
+		})
+	}
+	if res.Status.Active() {
+		res.Results = nil
+	}
+	return res, nil
+}
+
+func (r *Repository) GetExpression(_ context.Context, userID, id int) (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	e, ok := r.owned(userID, id)
+	if !ok {
+		return "", repository.ErrNotFound
+	}
+	return e.text, nil
+}
+
+func (r *Repository) CreateUser(_ context.Context, login, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.users[login]; !ok {
+		r.users[login] = user{id: r.userIDs.Get(), hash: hash}
+	}
+	return nil
+}
+
+func (r *Repository) VerifyUser(_ context.Context, login, password string) (int, bool, error) {
+	r.mux.Lock()
+	u, ok := r.users[login]
+	r.mux.Unlock()
+	if !ok {
+		return 0, false, nil
+	}
+	return u.id, bcrypt.CompareHashAndPassword(u.hash, []byte(password)) == nil, nil
+}
+
+func (r *Repository) SaveTasks(_ context.Context, tasks []*models.Task, id int) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	e, ok := r.meta[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if e.mainTaskID != nil || r.expressions.Get(id).Status != models.StatusPending {
+		return repository.ErrAlreadyPlanned
+	}
+	now := time.Now()
+	for _, t := range tasks {
+		saved := &task{Task: *t, priority: e.priority, createdAt: now, state: statePending, planLeftID: t.LeftID, planRightID: t.RightID}
+		saved.ExpressionID = id
+		saved.Done = nil
+		r.tasks[t.ID] = saved
+	}
+	mainID := tasks[len(tasks)-1].ID
+	e.mainTaskID = &mainID
+	e.remaining = r.cost(id)
+	r.addEvent(id, models.EventParsed, &mainID, "", "")
+	r.Notify()
+	return nil
+}
+
+// resolveTask - аналог одноимённой функции postgres: вызывается под мьютексом.
+func (r *Repository) resolveTask(id uuid.UUID, result float64) {
+	for exprID, e := range r.meta {
+		if e.mainTaskID != nil && *e.mainTaskID == id && r.expressions.Get(exprID).Status.CanTransition(models.StatusDone) {
+			resStr := strconv.FormatFloat(result, 'f', 2, 64)
+			r.start(exprID)
+			r.setResult(exprID, models.StatusDone, &resStr)
+		}
+	}
+	if t, ok := r.tasks[id]; ok {
+		agent := ""
+		if t.state == stateLeased {
+			agent = t.agent
+		}
+		r.addEvent(t.ExpressionID, models.EventTaskCompleted, &t.ID, agent, strconv.FormatFloat(result, 'g', -1, 64))
+		if e, ok := r.meta[t.ExpressionID]; ok {
+			e.remaining -= t.OperationTime
+		}
+		now := time.Now()
+		t.Result = result
+		t.state = stateDone
+		t.stream = ""
+		t.completedAt = &now
+	}
+	resolved := false
+	for _, t := range r.tasks {
+		if t.LeftID != nil && *t.LeftID == id {
+			t.Arg1 = result
+			t.LeftID = nil
+			resolved = true
+		}
+		if t.RightID != nil && *t.RightID == id {
+			t.Arg2 = result
+			t.RightID = nil
+			resolved = true
+		}
+	}
+	if resolved {
+		r.Notify()
+	}
+}
+
+// failTask - аналог одноимённой функции postgres: вызывается под мьютексом.
+func (r *Repository) failTask(t *task, msg string) {
+	now := time.Now()
+	r.addEvent(t.ExpressionID, models.EventTaskFailed, &t.ID, t.agent, "")
+	t.state = stateFailed
+	t.stream = ""
+	t.completedAt = &now
+	if r.expressions.Get(t.ExpressionID).Status.CanTransition(models.StatusFailed) {
+		r.start(t.ExpressionID)
+		r.setResult(t.ExpressionID, models.StatusFailed, &msg)
+		r.meta[t.ExpressionID].mainTaskID = nil
+	}
+	r.cancelTasks(t.ExpressionID)
+}
+
+func (r *Repository) UpdateTask(_ context.Context, t *models.Task) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	saved, ok := r.tasks[t.ID]
+	if !ok || !saved.open() {
+		return repository.ErrTaskDiscarded
+	}
+	if t.Error != "" {
+		r.failTask(saved, t.Error)
+		return nil
+	}
+	// Ключ кэша берём из сохранённой задачи: операции и аргументам от агента верить нельзя.
+	stored := models.Task{Operation: saved.Operation, Arg1: saved.Arg1, Arg2: saved.Arg2, Result: t.Result}
+	ready := saved.LeftID == nil && saved.RightID == nil
+	r.resolveTask(t.ID, t.Result)
+	if ready {
+		r.cacheResult(&stored)
+	}
+	return nil
+}
+
+func (r *Repository) cacheResult(t *models.Task) {
+	if r.cacheCfg.Size <= 0 || math.IsInf(t.Result, 0) || math.IsNaN(t.Result) {
+		return
+	}
+	r.cache[cacheKey{t.Operation, t.Arg1, t.Arg2}] = cacheEntry{result: t.Result, createdAt: time.Now()}
+}
+
+func (r *Repository) TrimCache(_ context.Context) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var n int64
+	for key, entry := range r.cache {
+		if time.Since(entry.createdAt) > r.cacheCfg.TTL {
+			delete(r.cache, key)
+			n++
+		}
+	}
+	if len(r.cache) <= r.cacheCfg.Size {
+		return n, nil
+	}
+	keys := make([]cacheKey, 0, len(r.cache))
+	for key := range r.cache {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b cacheKey) int {
+		return r.cache[b].createdAt.Compare(r.cache[a].createdAt)
+	})
+	for _, key := range keys[r.cacheCfg.Size:] {
+		delete(r.cache, key)
+		n++
+	}
+	return n, nil
+}
+
+func (r *Repository) fromCache(t *task) bool {
+	if r.cacheCfg.Size <= 0 {
+		return false
+	}
+	entry, ok := r.cache[cacheKey{t.Operation, t.Arg1, t.Arg2}]
+	if !ok || time.Since(entry.createdAt) > r.cacheCfg.TTL {
+		r.misses++
+		return false
+	}
+	r.resolveTask(t.ID, entry.result)
+	r.hits++
+	return true
+}
+
+func (r *Repository) CacheStats(_ context.Context) (models.CacheStats, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return models.CacheStats{Hits: r.hits, Misses: r.misses, Size: int64(len(r.cache))}, nil
+}
+
+func (r *Repository) ready() []*task {
+	var res []*task
+	for _, t := range r.tasks {
+		if t.LeftID == nil && t.RightID == nil && t.open() {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func (r *Repository) GetTask(_ context.Context, lease repository.Lease) (models.Task, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for {
+		now := time.Now()
+		ready := slices.DeleteFunc(r.ready(), func(t *task) bool {
+			return t.state != statePending
+		})
+		if len(ready) == 0 {
+			return models.Task{}, repository.ErrNotFound
+		}
+		next := slices.MinFunc(ready, func(a, b *task) int {
+			return cmp.Or(cmp.Compare(r.priority(b, now), r.priority(a, now)), r.less(r, a, b, now))
+		})
+		if !r.fromCache(next) {
+			next.state = stateLeased
+			next.stream = lease.Stream
+			next.leaseUntil = now.Add(lease.TTL)
+			next.dispatchedAt = &now
+			next.agent = lease.Agent
+			r.addEvent(next.ExpressionID, models.EventTaskDispatched, &next.ID, next.agent, "")
+			r.start(next.ExpressionID)
+			if e := r.expressions.Get(next.ExpressionID); e.Status == models.StatusPending {
+				e.Status = models.StatusRunning
+				r.expressions.Set(next.ExpressionID, e)
+			}
+			return models.Task{
+				ID:           next.ID,
+				ExpressionID: next.ExpressionID,
+				Operation:    next.Operation,
+				Arg1:         next.Arg1,
+				Arg2:         next.Arg2,
+			}, nil
+		}
+	}
+}
+
+func (r *Repository) requeue(expired func(t *task) bool) []uuid.UUID {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	ids := []uuid.UUID{}
+	for id, t := range r.tasks {
+		if t.state == stateLeased && expired(t) {
+			t.state = statePending
+			t.stream = ""
+			t.leaseUntil = time.Time{}
+			r.addEvent(t.ExpressionID, models.EventTaskRequeued, &t.ID, t.agent, "")
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		r.Notify()
+	}
+	return ids
+}
+
+func (r *Repository) RequeueExpired(_ context.Context) ([]uuid.UUID, error) {
+	now := time.Now()
+	return r.requeue(func(t *task) bool {
+		return t.leaseUntil.Before(now)
+	}), nil
+}
+
+func (r *Repository) ReleaseStream(_ context.Context, stream string) ([]uuid.UUID, error) {
+	return r.requeue(func(t *task) bool {
+		return t.stream == stream
+	}), nil
+}
+
+func (r *Repository) GetExpressionTasks(_ context.Context, id int) ([]models.Task, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var res []models.Task
+	for _, t := range r.tasks {
+		if t.ExpressionID == id && t.open() {
+			res = append(res, models.Task{
+				ID:           t.ID,
+				ExpressionID: id,
+				Operation:    t.Operation,
+				LeftID:       t.LeftID,
+				RightID:      t.RightID,
+			})
+		}
+	}
+	return res, nil
+}
+
+func (r *Repository) GetPlanTasks(_ context.Context, id int) ([]models.Task, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	e, ok := r.meta[id]
+	if !ok || e.mainTaskID == nil {
+		return nil, nil
+	}
+	var res []models.Task
+	seen := make(map[uuid.UUID]bool)
+	queue := []uuid.UUID{*e.mainTaskID}
+	for len(queue) > 0 {
+		tid := queue[0]
+		queue = queue[1:]
+		t, ok := r.tasks[tid]
+		if !ok || seen[tid] {
+			continue
+		}
+		seen[tid] = true
+		res = append(res, models.Task{
+			ID:            t.ID,
+			ExpressionID:  id,
+			Operation:     t.Operation,
+			Arg1:          t.Arg1,
+			Arg2:          t.Arg2,
+			LeftID:        t.planLeftID,
+			RightID:       t.planRightID,
+			OperationTime: t.OperationTime,
+		})
+		for _, dep := range []*uuid.UUID{t.planLeftID, t.planRightID} {
+			if dep != nil {
+				queue = append(queue, *dep)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (r *Repository) GetQueue(_ context.Context, exceptID int) (map[string]int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res := make(map[string]int)
+	for _, t := range r.ready() {
+		if t.ExpressionID != exceptID {
+			res[t.Operation]++
+		}
+	}
+	return res, nil
+}
+
+func (r *Repository) GetTaskTimings(_ context.Context, userID, id int) ([]models.TaskTiming, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res := []models.TaskTiming{}
+	if _, ok := r.owned(userID, id); !ok {
+		return res, nil
+	}
+	for _, t := range r.tasks {
+		if t.ExpressionID != id {
+			continue
+		}
+		timing := models.TaskTiming{
+			ID:           t.ID,
+			Operation:    t.Operation,
+			Agent:        t.agent,
+			CreatedAt:    t.createdAt,
+			DispatchedAt: t.dispatchedAt,
+			CompletedAt:  t.completedAt,
+		}
+		timing.SetDurations()
+		res = append(res, timing)
+	}
+	slices.SortFunc(res, func(a, b models.TaskTiming) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID.String(), b.ID.String()))
+	})
+	return res, nil
+}
+
+func (r *Repository) dropTasks(id int) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for taskID, t := range r.tasks {
+		if t.ExpressionID == id {
+			ids = append(ids, taskID)
+			delete(r.tasks, taskID)
+		}
+	}
+	return ids
+}
+
+// cancelTasks удаляет ждущие задачи выражения, а выданные агентам помечает отменёнными: их результат
+// отбросится, а сами они останутся в истории.
+func (r *Repository) cancelTasks(id int) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for taskID, t := range r.tasks {
+		if t.ExpressionID != id {
+			continue
+		}
+		switch t.state {
+		case statePending:
+			delete(r.tasks, taskID)
+		case stateLeased:
+			r.addEvent(id, models.EventTaskCancelled, &t.ID, t.agent, "")
+			t.state = stateCancelled
+			t.stream = ""
+			ids = append(ids, taskID)
+		}
+	}
+	return ids
+}
+
+func (r *Repository) Cancel(_ context.Context, userID, id int) ([]uuid.UUID, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	e, ok := r.owned(userID, id)
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	if !r.expressions.Get(id).Status.CanTransition(models.StatusCancelled) {
+		return nil, repository.ErrNotRunning
+	}
+	r.setResult(id, models.StatusCancelled, r.expressions.Get(id).Result)
+	e.mainTaskID = nil
+	// Посчитанные и выданные агентам задачи остаются в истории выражения, результат выданных отбросится.
+	return r.cancelTasks(id), nil
+}
+
+func (r *Repository) ClaimUnplanned(_ context.Context, stuckAfter time.Duration, limit int) ([]int, []string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var ids []int
+	for id, e := range r.meta {
+		if e.mainTaskID == nil && time.Since(e.startedAt) > stuckAfter && r.expressions.Get(id).Status == models.StatusPending {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	ids = ids[:min(len(ids), limit)]
+	expressions := make([]string, len(ids))
+	for i, id := range ids {
+		r.meta[id].startedAt = time.Now()
+		expressions[i] = r.meta[id].text
+	}
+	return ids, expressions, nil
+}
+
+func (r *Repository) Retry(_ context.Context, userID, id int, stuckAfter time.Duration) (string, []uuid.UUID, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	e, ok := r.owned(userID, id)
+	if !ok {
+		return "", nil, repository.ErrNotFound
+	}
+	current := r.expressions.Get(id)
+	stuck := time.Since(e.startedAt) > stuckAfter
+	if current.Status != models.StatusFailed && !(current.Status.Active() && stuck) {
+		return "", nil, repository.ErrNotRetryable
+	}
+	r.addEvent(id, models.EventRetried, nil, "", string(current.Status))
+	e.attemptsDone = append(e.attemptsDone, models.Attempt{
+		Attempt:    e.attempt,
+		Status:     current.Status,
+		Result:     current.Result,
+		StartedAt:  e.startedAt,
+		FinishedAt: time.Now(),
+	})
+	r.setResult(id, models.StatusPending, nil)
+	current = r.expressions.Get(id)
+	current.StartedAt, current.FinishedAt = nil, nil
+	r.expressions.Set(id, current)
+	e.mainTaskID = nil
+	e.attempt++
+	e.startedAt = time.Now()
+	return e.text, r.dropTasks(id), nil
+}
+
+func (r *Repository) GetAttempts(_ context.Context, userID, id int) ([]models.Attempt, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res := []models.Attempt{}
+	if e, ok := r.owned(userID, id); ok {
+		res = append(res, e.attemptsDone...)
+	}
+	return res, nil
+}
+
+func (r *Repository) Purge(_ context.Context, rule config.RetentionRule) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	cutoff := time.Now().Add(-rule.After)
+	var n int64
+	for _, e := range r.expressions.GetAll() {
+		finished := e.CreatedAt
+		if e.FinishedAt != nil {
+			finished = *e.FinishedAt
+		}
+		if e.Status != rule.Status || !finished.Before(cutoff) {
+			continue
+		}
+		id := int(e.ID)
+		if rule.Archive {
+			r.archive[id] = e
+		}
+		r.dropTasks(id)
+		if s, ok := r.sweeps[r.meta[id].sweepID]; ok {
+			s.ids = slices.DeleteFunc(s.ids, func(sweepExpr int) bool {
+				return sweepExpr == id
+			})
+		}
+		r.expressions.Delete(id)
+		delete(r.meta, id)
+		delete(r.events, id)
+		r.webhooks = slices.DeleteFunc(r.webhooks, func(w *webhook) bool {
+			return w.expressionID == id
+		})
+		n++
+	}
+	return n, nil
+}
+
+func (r *Repository) GetEvents(_ context.Context, userID, id int) ([]models.Event, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res := []models.Event{}
+	if _, ok := r.owned(userID, id); !ok {
+		return res, nil
+	}
+	return append(res, r.events[id]...), nil
+}
+
+func (r *Repository) WebhookSecret(_ context.Context, userID int) (string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if secret, ok := r.secrets[userID]; ok {
+		return secret, nil
+	}
+	found := false
+	for _, u := range r.users {
+		found = found || u.id == userID
+	}
+	if !found {
+		return "", repository.ErrNotFound
+	}
+	secret, err := repository.NewWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	r.secrets[userID] = secret
+	return secret, nil
+}
+
+func (r *Repository) ClaimWebhooks(_ context.Context, limit int, lease time.Duration) ([]models.Webhook, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := time.Now()
+	var res []models.Webhook
+	for _, w := range r.webhooks {
+		if len(res) == limit {
+			break
+		}
+		if w.State != models.WebhookPending || w.nextAttemptAt.After(now) {
+			continue
+		}
+		w.Attempts++
+		w.nextAttemptAt = now.Add(lease)
+		res = append(res, models.Webhook{
+			ID:           w.ID,
+			ExpressionID: int64(w.expressionID),
+			URL:          w.URL,
+			Payload:      w.payload,
+			Secret:       r.secrets[w.userID],
+			Attempt:      w.Attempts,
+		})
+	}
+	return res, nil
+}
+
+func (r *Repository) RecordDelivery(_ context.Context, d models.WebhookDelivery, retryAt time.Time) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	i := slices.IndexFunc(r.webhooks, func(w *webhook) bool {
+		return w.ID == d.WebhookID
+	})
+	if i < 0 {
+		return repository.ErrNotFound
+	}
+	w := r.webhooks[i]
+	d.CreatedAt = time.Now()
+	w.Deliveries = append(w.Deliveries, d)
+	switch {
+	case d.Delivered():
+		w.State = models.WebhookDelivered
+	case retryAt.IsZero():
+		w.State = models.WebhookFailed
+	default:
+		w.nextAttemptAt = retryAt
+	}
+	return nil
+}
+
+func (r *Repository) GetWebhooks(_ context.Context, userID, id int) ([]models.WebhookLog, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res := []models.WebhookLog{}
+	if _, ok := r.owned(userID, id); !ok {
+		return res, nil
+	}
+	for _, w := range r.webhooks {
+		if w.expressionID != id {
+			continue
+		}
+		log := w.WebhookLog
+		log.Deliveries = slices.Clone(w.Deliveries)
+		if w.State == models.WebhookPending {
+			next := w.nextAttemptAt
+			log.NextAttemptAt = &next
+		}
+		res = append(res, log)
+	}
+	return res, nil
+}
+
+func (r *Repository) CreateImport(_ context.Context, userID int, filename string, total int) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	id := len(r.imports) + 1
+	r.imports[id] = &importJob{
+		Import:    models.Import{ID: id, Filename: filename, State: models.ImportRunning, Total: total, CreatedAt: time.Now()},
+		userID:    userID,
+		updatedAt: time.Now(),
+	}
+	return id, nil
+}
+
+func (r *Repository) AddImportProgress(_ context.Context, id, created int, errs []models.ImportError) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	job, ok := r.imports[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	job.Processed += created + len(errs)
+	job.Created += created
+	job.Failed += len(errs)
+	job.Errors = append(job.Errors, errs...)
+	job.updatedAt = time.Now()
+	return nil
+}
+
+func (r *Repository) FinishImport(_ context.Context, id int, state string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	job, ok := r.imports[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	now := time.Now()
+	job.State, job.FinishedAt = state, &now
+	return nil
+}
+
+func (r *Repository) FailStaleImports(_ context.Context, stuckAfter time.Duration) (int64, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var n int64
+	now := time.Now()
+	for _, job := range r.imports {
+		if job.State == models.ImportRunning && now.Sub(job.updatedAt) > stuckAfter {
+			job.State, job.FinishedAt = models.ImportFailed, &now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *Repository) GetImport(_ context.Context, userID, id int) (models.Import, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	job, ok := r.imports[id]
+	if !ok || job.userID != userID {
+		return models.Import{}, repository.ErrNotFound
+	}
+	res := job.Import
+	res.Errors = append([]models.ImportError{}, job.Errors...)
+	slices.SortStableFunc(res.Errors, func(a, b models.ImportError) int {
+		return cmp.Compare(a.Line, b.Line)
+	})
+	return res, nil
+}
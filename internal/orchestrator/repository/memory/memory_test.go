@@ -0,0 +1,22 @@
+package memory
+
+import (
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/repotest"
+	"testing"
+)
+
+func newRepo(t *testing.T, cache config.Cache, scheduler config.Scheduler) *Repository {
+	r, err := NewRepository(cache, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, cache config.Cache, scheduler config.Scheduler) repository.Repository {
+		return newRepo(t, cache, scheduler)
+	})
+}
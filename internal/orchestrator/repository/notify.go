@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+	"sync"
+)
+
+// Listener - хранилище, которому нужен фоновый приём сигналов о готовых задачах.
+// Listen работает до отмены ctx или до ошибки соединения.
+type Listener interface {
+	Listen(ctx context.Context) error
+}
+
+// Broadcaster будит подписчиков, когда появляются готовые задачи. Сигналы склеиваются:
+// если подписчик не забрал прошлый, новый не копится. Нулевое значение готово к работе.
+type Broadcaster struct {
+	mux  sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func (b *Broadcaster) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan struct{}]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		delete(b.subs, ch)
+	}
+}
+
+func (b *Broadcaster) Notify() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
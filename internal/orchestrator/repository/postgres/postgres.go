@@ -4,28 +4,78 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
+	"math"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	_ repository.Repository = (*Repository)(nil)
+	_ repository.Listener   = (*Repository)(nil)
+)
+
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+	return err
+}
+
+// readyChannel - канал LISTEN/NOTIFY, в который пишется, когда появляются готовые задачи.
+const readyChannel = "tasks_ready"
+
 type Repository struct {
-	pool *pgxpool.Pool
+	repository.Broadcaster
+	pool    *pgxpool.Pool
+	cache   config.Cache
+	orderBy string
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+// Политики выбора готовой задачи для агента. Ожидание задачи в очереди
+// прибавляется к её критическому пути, чтобы длинные выражения не голодали.
+var policies = map[string]string{
+	"fifo":          `expression_id, created_at`,
+	"critical_path": `critical_path + EXTRACT(EPOCH FROM now() - created_at) * 1000 DESC, expression_id`,
+	"sjf":           `(SELECT remaining_cost FROM expressions e WHERE e.id = tasks.expression_id), expression_id`,
 }
 
-func NewRepository(pool *pgxpool.Pool) *Repository {
-	return &Repository{pool}
+func NewRepository(pool *pgxpool.Pool, cache config.Cache, scheduler config.Scheduler) (*Repository, error) {
+	orderBy, ok := policies[scheduler.Policy]
+	if !ok {
+		return nil, fmt.Errorf("неизвестная политика планировщика: %s", scheduler.Policy)
+	}
+	// Сначала более высокий класс приоритета. Каждые Aging ожидания задача поднимается на класс выше.
+	if scheduler.Aging > 0 {
+		orderBy = fmt.Sprintf(`LEAST(%d, priority + floor(EXTRACT(EPOCH FROM now() - created_at) / %f)) DESC, `,
+			models.PriorityHigh, scheduler.Aging.Seconds()) + orderBy
+	} else {
+		orderBy = `priority DESC, ` + orderBy
+	}
+	return &Repository{pool: pool, cache: cache, orderBy: orderBy}, nil
 }
 
-func (r *Repository) Get(ctx context.Context, key int) (models.Expressions, error) {
+const expressionColumns = `id, status, COALESCE(result, ''), COALESCE(callback_url, ''), COALESCE(external_ref, ''), priority, created_at, started_at, finished_at`
+
+func (r *Repository) Get(ctx context.Context, userID, key int) (models.Expressions, error) {
 	res := models.Expressions{}
-	q := `SELECT id, status, COALESCE(result, '') FROM expressions WHERE id = $1`
-	err := r.pool.QueryRow(ctx, q, key).Scan(&res.ID, &res.Status, &res.Result)
-	return res, err
+	var priority int
+	q := `SELECT ` + expressionColumns + ` FROM expressions WHERE id = $1 AND user_id = $2`
+	err := r.pool.QueryRow(ctx, q, key, userID).Scan(&res.ID, &res.Status, &res.Result, &res.CallbackURL, &res.ExternalRef, &priority, &res.CreatedAt,
+		&res.StartedAt, &res.FinishedAt)
+	res.Priority = models.PriorityName(priority)
+	return res, notFound(err)
 }
 
 func (r *Repository) Set(ctx context.Context, value models.Expressions) (int64, error) {
@@ -38,46 +88,266 @@ func (r *Repository) Set(ctx context.Context, value models.Expressions) (int64,
 		}
 		return int64(id), nil
 	} else {
-		q := `UPDATE expressions SET status = $2, result = $3, main_task_id=NULL WHERE id = $1`
-		_, err := r.pool.Exec(ctx, q, value.ID, value.Status, value.Result)
+		q := `UPDATE expressions
+			SET status = $2, result = $3, main_task_id = NULL, started_at = COALESCE(started_at, now()), finished_at = now()
+			WHERE id = $1 AND status IN (` + repository.StatusesTo(value.Status) + `)`
+		tag, err := r.pool.Exec(ctx, q, value.ID, value.Status, value.Result)
+		if err == nil && tag.RowsAffected() == 0 {
+			err = repository.ErrInvalidTransition
+		}
 		return value.ID, err
 	}
 }
 
-func (r *Repository) GetAll(ctx context.Context) ([]models.Expressions, error) {
+// conds - условия WHERE с нумерованными плейсхолдерами.
+type conds struct {
+	list []string
+	args []any
+}
+
+// add дописывает условие, подставляя в cond номера плейсхолдеров для values.
+func (c *conds) add(cond string, values ...any) {
+	placeholders := make([]any, len(values))
+	for i, v := range values {
+		c.args = append(c.args, v)
+		placeholders[i] = len(c.args)
+	}
+	c.list = append(c.list, fmt.Sprintf(cond, placeholders...))
+}
+
+func (c *conds) String() string {
+	return strings.Join(c.list, " AND ")
+}
+
+// listFilters - условия по фильтрам ListQuery, без курсора страницы.
+func listFilters(userID int, lq repository.ListQuery) *conds {
+	w := &conds{}
+	w.add("user_id = $%d", userID)
+	if lq.Status != "" {
+		w.add("status = $%d", lq.Status)
+	}
+	if !lq.CreatedFrom.IsZero() {
+		w.add("created_at >= $%d", lq.CreatedFrom)
+	}
+	if !lq.CreatedTo.IsZero() {
+		w.add("created_at < $%d", lq.CreatedTo)
+	}
+	if lq.Search != "" {
+		w.add("strpos(expression, $%d) > 0", lq.Search)
+	}
+	return w
+}
+
+func listQuery(userID int, lq repository.ListQuery) (string, []any) {
+	w := listFilters(userID, lq)
+	sort := repository.Sorts[lq.Sort]
+	cmp, dir := ">", "ASC"
+	if sort.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if lq.After != nil {
+		if sort.Column == "created_at" {
+			w.add("(created_at, id) "+cmp+" ($%d, $%d)", lq.After.CreatedAt, lq.After.ID)
+		} else {
+			w.add("id "+cmp+" $%d", lq.After.ID)
+		}
+	}
+	order := "id " + dir
+	if sort.Column == "created_at" {
+		order = "created_at " + dir + ", " + order
+	}
+	args := append(w.args, lq.PageSize()+1)
+	q := `SELECT ` + expressionColumns + ` FROM expressions WHERE ` + w.String() +
+		` ORDER BY ` + order + fmt.Sprintf(` LIMIT $%d`, len(args))
+	return q, args
+}
+
+func (r *Repository) GetAll(ctx context.Context, userID int, lq repository.ListQuery) ([]models.Expressions, string, error) {
 	var res []models.Expressions
-	q := `SELECT id, status, COALESCE(result, '') FROM expressions ORDER BY id`
-	rows, err := r.pool.Query(ctx, q)
+	q, args := listQuery(userID, lq)
+	rows, err := r.pool.Query(ctx, q, args...)
 	if err != nil {
-		return []models.Expressions{}, err
+		return []models.Expressions{}, "", err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var e models.Expressions
-		err = rows.Scan(&e.ID, &e.Status, &e.Result)
+		var priority int
+		err = rows.Scan(&e.ID, &e.Status, &e.Result, &e.CallbackURL, &e.ExternalRef, &priority, &e.CreatedAt, &e.StartedAt, &e.FinishedAt)
 		if err != nil {
-			return []models.Expressions{}, err
+			return []models.Expressions{}, "", err
 		}
+		e.Priority = models.PriorityName(priority)
 		res = append(res, e)
 	}
-	return res, nil
+	if err = rows.Err(); err != nil {
+		return []models.Expressions{}, "", err
+	}
+	res, next := repository.Page(res, lq.PageSize())
+	return res, next, nil
 }
 
-func (r *Repository) SetWithExpression(ctx context.Context, value models.Expressions, expression string) (int, error) {
-	q := `INSERT INTO expressions(status, expression) VALUES($1, $2) RETURNING id`
+// exportFetch - сколько строк курсора выгрузки читается за один FETCH.
+const exportFetch = 500
+
+func (r *Repository) Export(ctx context.Context, userID int, lq repository.ListQuery, fn func(models.ExportRow) error) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	w := listFilters(userID, lq)
+	q := `DECLARE export NO SCROLL CURSOR FOR
+		SELECT id, expression, COALESCE(external_ref, ''), status, result, created_at, started_at, finished_at FROM expressions
+		WHERE ` + w.String() + ` ORDER BY id`
+	if _, err = tx.Exec(ctx, q, w.args...); err != nil {
+		return err
+	}
+	for {
+		rows, err := tx.Query(ctx, fmt.Sprintf(`FETCH %d FROM export`, exportFetch))
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			n++
+			var e models.ExportRow
+			if err = rows.Scan(&e.ID, &e.Expression, &e.ExternalRef, &e.Status, &e.Result, &e.CreatedAt, &e.StartedAt, &e.FinishedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			if err = fn(e); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if n < exportFetch {
+			return nil
+		}
+	}
+}
+
+func (r *Repository) SetWithExpression(ctx context.Context, userID int, value models.Expressions, expression string) (int, error) {
+	priority, ok := models.ParsePriority(value.Priority)
+	if !ok {
+		return 0, calc.ErrInvalidPriority
+	}
+	q := `INSERT INTO expressions(status, expression, priority, user_id, callback_url, external_ref)
+		VALUES($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')) RETURNING id`
 	var id int
-	err := r.pool.QueryRow(ctx, q, value.Status, expression).Scan(&id)
+	err := r.pool.QueryRow(ctx, q, value.Status, expression, priority, userID, value.CallbackURL, value.ExternalRef).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
 	return id, nil
 }
 
-func (r *Repository) GetStatus(ctx context.Context, id int64) (string, error) {
-	q := `SELECT status FROM expressions WHERE id = $1`
-	var status string
-	err := r.pool.QueryRow(ctx, q, id).Scan(&status)
-	return status, err
+// SetBatch записывает выражения одной транзакцией и одним походом в СУБД.
+func (r *Repository) SetBatch(ctx context.Context, userID int, values []models.Expressions, expressions []string) ([]int, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	batch := &pgx.Batch{}
+	q := `INSERT INTO expressions(status, expression, priority, user_id, callback_url, external_ref)
+		VALUES($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')) RETURNING id`
+	for i, value := range values {
+		priority, ok := models.ParsePriority(value.Priority)
+		if !ok {
+			return nil, calc.ErrInvalidPriority
+		}
+		batch.Queue(q, value.Status, expressions[i], priority, userID, value.CallbackURL, value.ExternalRef)
+	}
+	results := tx.SendBatch(ctx, batch)
+	ids := make([]int, len(values))
+	for i := range values {
+		if err = results.QueryRow().Scan(&ids[i]); err != nil {
+			results.Close()
+			return nil, err
+		}
+	}
+	if err = results.Close(); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit(ctx)
+}
+
+func (r *Repository) CreateSweep(ctx context.Context, userID int, template, priority string, expressions []string, values []map[string]float64) (int, []int, error) {
+	p, ok := models.ParsePriority(priority)
+	if !ok {
+		return 0, nil, calc.ErrInvalidPriority
+	}
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+	var sweepID int
+	q := `INSERT INTO sweeps(expression, user_id) VALUES($1, $2) RETURNING id`
+	if err = tx.QueryRow(ctx, q, template, userID).Scan(&sweepID); err != nil {
+		return 0, nil, err
+	}
+	batch := &pgx.Batch{}
+	q = `INSERT INTO expressions(status, expression, priority, sweep_id, sweep_values, user_id)
+		VALUES('pending', $1, $2, $3, $4, $5) RETURNING id`
+	for i, expression := range expressions {
+		batch.Queue(q, expression, p, sweepID, values[i], userID)
+	}
+	results := tx.SendBatch(ctx, batch)
+	ids := make([]int, len(expressions))
+	for i := range expressions {
+		if err = results.QueryRow().Scan(&ids[i]); err != nil {
+			results.Close()
+			return 0, nil, err
+		}
+	}
+	if err = results.Close(); err != nil {
+		return 0, nil, err
+	}
+	return sweepID, ids, tx.Commit(ctx)
+}
+
+func (r *Repository) GetSweep(ctx context.Context, userID, id int) (models.Sweep, error) {
+	sweep := models.Sweep{ID: id, Status: models.StatusDone}
+	q := `SELECT expression FROM sweeps WHERE id = $1 AND user_id = $2`
+	if err := r.pool.QueryRow(ctx, q, id, userID).Scan(&sweep.Expression); err != nil {
+		return sweep, notFound(err)
+	}
+	q = `SELECT id, status, result, sweep_values FROM expressions WHERE sweep_id = $1 ORDER BY id`
+	rows, err := r.pool.Query(ctx, q, id)
+	if err != nil {
+		return sweep, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row models.SweepRow
+		if err = rows.Scan(&row.ID, &row.Status, &row.Result, &row.Values); err != nil {
+			return sweep, err
+		}
+		sweep.Total++
+		if row.Status.Active() {
+			sweep.Status = models.StatusRunning
+		} else {
+			sweep.Done++
+		}
+		sweep.Results = append(sweep.Results, row)
+	}
+	if sweep.Status.Active() {
+		sweep.Results = nil
+	}
+	return sweep, rows.Err()
+}
+
+func (r *Repository) GetExpression(ctx context.Context, userID, id int) (string, error) {
+	q := `SELECT COALESCE(expression, '') FROM expressions WHERE id = $1 AND user_id = $2`
+	var expression string
+	err := r.pool.QueryRow(ctx, q, id, userID).Scan(&expression)
+	return expression, notFound(err)
 }
 
 func (r *Repository) CreateUser(ctx context.Context, login, password string) error {
@@ -90,29 +360,32 @@ func (r *Repository) CreateUser(ctx context.Context, login, password string) err
 	return err
 }
 
-func (r *Repository) VerifyUser(ctx context.Context, login, password string) (bool, error) {
+func (r *Repository) VerifyUser(ctx context.Context, login, password string) (int, bool, error) {
+	var id int
 	var dbHash string
-	q := `SELECT password_hash FROM users WHERE login = $1`
-	if err := r.pool.QueryRow(ctx, q, login).Scan(&dbHash); err != nil {
+	q := `SELECT id, password_hash FROM users WHERE login = $1`
+	if err := r.pool.QueryRow(ctx, q, login).Scan(&id, &dbHash); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return false, nil
+			return 0, false, nil
 		}
-		return false, err
+		return 0, false, err
 	}
 	err := bcrypt.CompareHashAndPassword([]byte(dbHash), []byte(password))
-	return err == nil, nil
+	return id, err == nil, nil
 }
 
 func createRequest(tasks []*models.Task, id int) (string, []any) {
 	q := &strings.Builder{}
-	q.WriteString("INSERT INTO tasks(id, expression_id, operation, arg1, arg2, left_id, right_id) VALUES")
-	const requiredFields = 7
+	q.WriteString("INSERT INTO tasks(id, expression_id, operation, arg1, arg2, left_id, right_id, cost, critical_path, plan_left_id, plan_right_id) VALUES")
+	const requiredFields = 11
 	args := make([]any, 0, len(tasks)*requiredFields)
 	listLen := len(tasks)
 	for i, task := range tasks {
-		args = append(args, task.ID, id, task.Operation, task.Arg1, task.Arg2, task.LeftID, task.RightID)
+		args = append(args, task.ID, id, task.Operation, task.Arg1, task.Arg2, task.LeftID, task.RightID,
+			task.OperationTime.Milliseconds(), task.CriticalPath.Milliseconds(), task.LeftID, task.RightID)
 		base := i * requiredFields
-		fmt.Fprintf(q, "($%d,$%d,$%d,$%d,$%d, $%d, $%d)", base+1, base+2, base+3, base+4, base+5, base+6, base+7)
+		fmt.Fprintf(q, "($%d,$%d,$%d,$%d,$%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			base+1, base+2, base+3, base+4, base+5, base+6, base+7, base+8, base+9, base+10, base+11)
 		if i < listLen-1 {
 			fmt.Fprint(q, ", ")
 		}
@@ -131,39 +404,181 @@ func (r *Repository) SaveTasks(ctx context.Context, tasks []*models.Task, id int
 	if err != nil {
 		return err
 	}
-	q = "UPDATE expressions SET main_task_id=$1 WHERE id = $2"
-	_, err = tx.Exec(ctx, q, tasks[len(tasks)-1].ID, id)
+	// Граф вешается только на ожидающее разбора выражение: повторный разбор после ClaimUnplanned
+	// или отмена во время разбора откатывают вставленные задачи.
+	q = `UPDATE expressions
+		SET main_task_id = $1,
+			remaining_cost = (SELECT COALESCE(sum(cost), 0) FROM tasks WHERE expression_id = $2 AND state IN ('pending', 'leased'))
+		WHERE id = $2 AND main_task_id IS NULL AND status = 'pending'`
+	tag, err := tx.Exec(ctx, q, tasks[len(tasks)-1].ID, id)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return repository.ErrAlreadyPlanned
+	}
+	q = "UPDATE tasks SET priority = (SELECT priority FROM expressions WHERE id = $1) WHERE expression_id = $1"
+	_, err = tx.Exec(ctx, q, id)
+	if err != nil {
+		return err
+	}
+	if err = notifyReady(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
+// notifyReady будит диспетчеров всех оркестраторов. Сигнал уходит при коммите транзакции.
+func notifyReady(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, `SELECT pg_notify($1, '')`, readyChannel)
+	return err
+}
+
+func resolveTask(ctx context.Context, tx pgx.Tx, id uuid.UUID, result float64) error {
+	resStr := strconv.FormatFloat(result, 'f', 2, 64)
+	q := `UPDATE expressions
+		SET status = 'done', result = $2, started_at = COALESCE(started_at, now()), finished_at = now()
+		WHERE main_task_id = $1 AND status IN (` + repository.StatusesTo(models.StatusDone) + `)`
+	_, err := tx.Exec(ctx, q, id, resStr)
+	if err != nil {
+		return err
+	}
+	q = `UPDATE expressions e SET remaining_cost = e.remaining_cost - t.cost
+		FROM tasks t WHERE t.id = $1 AND e.id = t.expression_id`
+	_, err = tx.Exec(ctx, q, id)
+	if err != nil {
+		return err
+	}
+	q = `UPDATE tasks SET result = $2, state = 'done', completed_at = now(), lease_until = NULL, stream_id = NULL WHERE id = $1`
+	_, err = tx.Exec(ctx, q, id, result)
+	if err != nil {
+		return err
+	}
+	q = `UPDATE tasks
+		SET arg1     = CASE WHEN left_id = $1 THEN $2 ELSE arg1 END,
+			arg2     = CASE WHEN right_id = $1 THEN $2 ELSE arg2 END,
+			left_id  = NULLIF(left_id, $1),
+			right_id = NULLIF(right_id, $1)
+		WHERE left_id = $1 OR right_id = $1`
+	tag, err := tx.Exec(ctx, q, id, result)
+	if err != nil || tag.RowsAffected() == 0 {
+		return err
+	}
+	return notifyReady(ctx, tx)
+}
+
+// failTask роняет выражение с ошибкой вычисления задачи и снимает остальные его задачи.
+func failTask(ctx context.Context, tx pgx.Tx, task *models.Task) error {
+	q := `UPDATE tasks SET state = 'failed', completed_at = now(), lease_until = NULL, stream_id = NULL WHERE id = $1`
+	_, err := tx.Exec(ctx, q, task.ID)
+	if err != nil {
+		return err
+	}
+	q = `UPDATE expressions
+		SET status = 'failed', result = $2, main_task_id = NULL, started_at = COALESCE(started_at, now()), finished_at = now()
+		WHERE id = $1 AND status IN (` + repository.StatusesTo(models.StatusFailed) + `)`
+	_, err = tx.Exec(ctx, q, task.ExpressionID, task.Error)
+	if err != nil {
+		return err
+	}
+	_, err = cancelTasks(ctx, tx, task.ExpressionID)
+	return err
+}
+
 func (r *Repository) UpdateTask(ctx context.Context, task *models.Task) error {
 	tx, err := r.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
-	resStr := strconv.FormatFloat(task.Result, 'f', 2, 64)
-	q := `UPDATE expressions SET status = 'Выполнено', result = $2 WHERE main_task_id = $1`
-	_, err = tx.Exec(ctx, q, task.ID, resStr)
-	if err != nil {
-		return err
+	// Ключ кэша берём из сохранённой задачи: операции и аргументам от агента верить нельзя.
+	stored := models.Task{ID: task.ID}
+	var ready bool
+	q := `SELECT expression_id, operation, COALESCE(arg1, 0), COALESCE(arg2, 0), left_id IS NULL AND right_id IS NULL
+		FROM tasks WHERE id = $1 AND state IN ('pending', 'leased') FOR UPDATE`
+	err = tx.QueryRow(ctx, q, task.ID).Scan(&task.ExpressionID, &stored.Operation, &stored.Arg1, &stored.Arg2, &ready)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repository.ErrTaskDiscarded
 	}
-	q = `UPDATE tasks SET arg1 = $2 WHERE left_id = $1`
-	_, err = tx.Exec(ctx, q, task.ID, task.Result)
 	if err != nil {
 		return err
 	}
-	q = `UPDATE tasks SET arg2 = $2 WHERE right_id = $1`
-	_, err = tx.Exec(ctx, q, task.ID, task.Result)
+	if task.Error != "" {
+		err = failTask(ctx, tx, task)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+	err = resolveTask(ctx, tx, task.ID, task.Result)
 	if err != nil {
 		return err
 	}
+	if ready {
+		stored.Result = task.Result
+		if err = r.cacheResult(ctx, tx, &stored); err != nil {
+			return err
+		}
+	}
 	return tx.Commit(ctx)
 }
 
+func (r *Repository) cacheResult(ctx context.Context, tx pgx.Tx, task *models.Task) error {
+	if r.cache.Size <= 0 || math.IsInf(task.Result, 0) || math.IsNaN(task.Result) {
+		return nil
+	}
+	q := `INSERT INTO task_cache(operation, arg1, arg2, result) VALUES($1, $2, $3, $4)
+		ON CONFLICT (operation, arg1, arg2) DO UPDATE SET result = EXCLUDED.result, created_at = now()`
+	_, err := tx.Exec(ctx, q, task.Operation, task.Arg1, task.Arg2, task.Result)
+	return err
+}
+
+func (r *Repository) TrimCache(ctx context.Context) (int64, error) {
+	if r.cache.Size <= 0 {
+		return 0, nil
+	}
+	q := `DELETE FROM task_cache WHERE created_at < now() - make_interval(secs => $1)`
+	expired, err := r.pool.Exec(ctx, q, r.cache.TTL.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	q = `DELETE FROM task_cache WHERE ctid IN (SELECT ctid FROM task_cache ORDER BY created_at DESC OFFSET $1)`
+	evicted, err := r.pool.Exec(ctx, q, r.cache.Size)
+	if err != nil {
+		return 0, err
+	}
+	return expired.RowsAffected() + evicted.RowsAffected(), nil
+}
+
+func (r *Repository) fromCache(ctx context.Context, tx pgx.Tx, task models.Task) (bool, error) {
+	if r.cache.Size <= 0 {
+		return false, nil
+	}
+	var result float64
+	q := `SELECT result FROM task_cache
+		WHERE operation = $1 AND arg1 = $2 AND arg2 = $3 AND created_at >= now() - make_interval(secs => $4)`
+	err := tx.QueryRow(ctx, q, task.Operation, task.Arg1, task.Arg2, r.cache.TTL.Seconds()).Scan(&result)
+	if errors.Is(err, pgx.ErrNoRows) {
+		r.misses.Add(1)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = resolveTask(ctx, tx, task.ID, result); err != nil {
+		return false, err
+	}
+	r.hits.Add(1)
+	return true, nil
+}
+
+func (r *Repository) CacheStats(ctx context.Context) (models.CacheStats, error) {
+	stats := models.CacheStats{Hits: r.hits.Load(), Misses: r.misses.Load()}
+	q := `SELECT count(*) FROM task_cache`
+	err := r.pool.QueryRow(ctx, q).Scan(&stats.Size)
+	return stats, err
+}
+
 func (r *Repository) GetStatusTask(ctx context.Context, id int64) (bool, error) {
 	q := `SELECT status FROM tasks WHERE id = $1`
 	var ready bool
@@ -171,15 +586,555 @@ func (r *Repository) GetStatusTask(ctx context.Context, id int64) (bool, error)
 	return ready, err
 }
 
-func (r *Repository) GetTask(ctx context.Context) (models.Task, error) {
-	q := `SELECT id, expression_id, operation, arg1, arg2 FROM tasks WHERE left_id IS NULL AND right_id IS NULL`
+func (r *Repository) GetTask(ctx context.Context, lease repository.Lease) (models.Task, error) {
+	for {
+		task, hit, err := r.leaseTask(ctx, lease)
+		if err != nil || !hit {
+			return task, err
+		}
+	}
+}
+
+// leaseTask блокирует готовую задачу, пропуская занятые другими стримами строки, и либо
+// считает её из кэша, либо отдаёт в аренду. hit - задача посчитана из кэша, нужна следующая.
+func (r *Repository) leaseTask(ctx context.Context, lease repository.Lease) (models.Task, bool, error) {
 	var task models.Task
-	err := r.pool.QueryRow(ctx, q).Scan(&task.ID, &task.ExpressionID, &task.Operation, &task.Arg1, &task.Arg2)
-	return task, err
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return task, false, err
+	}
+	defer tx.Rollback(ctx)
+	q := `SELECT id, expression_id, operation, arg1, arg2 FROM tasks
+		WHERE left_id IS NULL AND right_id IS NULL AND state = 'pending'
+		ORDER BY ` + r.orderBy + ` LIMIT 1
+		FOR UPDATE SKIP LOCKED`
+	err = tx.QueryRow(ctx, q).Scan(&task.ID, &task.ExpressionID, &task.Operation, &task.Arg1, &task.Arg2)
+	if err != nil {
+		return task, false, notFound(err)
+	}
+	hit, err := r.fromCache(ctx, tx, task)
+	if err != nil {
+		return task, false, err
+	}
+	if !hit {
+		q = `WITH t AS (
+				UPDATE tasks
+				SET state = 'leased', lease_until = now() + make_interval(secs => $2), stream_id = $3,
+					dispatched_at = now(), agent_id = $4
+				WHERE id = $1 RETURNING expression_id
+			)
+			UPDATE expressions
+			SET started_at = COALESCE(started_at, now()), status = CASE WHEN status = 'pending' THEN 'running' ELSE status END
+			WHERE id = (SELECT expression_id FROM t)`
+		_, err = tx.Exec(ctx, q, task.ID, lease.TTL.Seconds(), lease.Stream, lease.Agent)
+		if err != nil {
+			return task, false, err
+		}
+	}
+	return task, hit, tx.Commit(ctx)
+}
+
+func (r *Repository) requeue(ctx context.Context, q string, args ...any) ([]uuid.UUID, error) {
+	rows, err := r.pool.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil || len(ids) == 0 {
+		return ids, err
+	}
+	_, err = r.pool.Exec(ctx, `SELECT pg_notify($1, '')`, readyChannel)
+	return ids, err
+}
+
+// Listen слушает readyChannel на отдельном соединении, которое не возвращается в пул.
+func (r *Repository) Listen(ctx context.Context) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	pgConn := conn.Hijack()
+	defer pgConn.Close(context.Background())
+	if _, err = pgConn.Exec(ctx, "LISTEN "+readyChannel); err != nil {
+		return err
+	}
+	for {
+		if _, err = pgConn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		r.Notify()
+	}
 }
 
-func (r *Repository) RemoveTask(ctx context.Context, id uuid.UUID) error {
-	q := `DELETE FROM tasks WHERE id = $1`
-	_, err := r.pool.Exec(ctx, q, id)
+func (r *Repository) RequeueExpired(ctx context.Context) ([]uuid.UUID, error) {
+	q := `UPDATE tasks SET state = 'pending', lease_until = NULL, stream_id = NULL
+		WHERE state = 'leased' AND lease_until < now() RETURNING id`
+	return r.requeue(ctx, q)
+}
+
+func (r *Repository) ReleaseStream(ctx context.Context, stream string) ([]uuid.UUID, error) {
+	q := `UPDATE tasks SET state = 'pending', lease_until = NULL, stream_id = NULL
+		WHERE state = 'leased' AND stream_id = $1 RETURNING id`
+	return r.requeue(ctx, q, stream)
+}
+
+func (r *Repository) GetTaskTimings(ctx context.Context, userID, id int) ([]models.TaskTiming, error) {
+	q := `SELECT t.id, t.operation, COALESCE(t.agent_id, ''), t.created_at, t.dispatched_at, t.completed_at
+		FROM tasks t JOIN expressions e ON e.id = t.expression_id
+		WHERE e.id = $1 AND e.user_id = $2
+		ORDER BY t.created_at, t.dispatched_at NULLS LAST`
+	rows, err := r.pool.Query(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []models.TaskTiming{}
+	for rows.Next() {
+		var t models.TaskTiming
+		err = rows.Scan(&t.ID, &t.Operation, &t.Agent, &t.CreatedAt, &t.DispatchedAt, &t.CompletedAt)
+		if err != nil {
+			return nil, err
+		}
+		t.SetDurations()
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) GetExpressionTasks(ctx context.Context, id int) ([]models.Task, error) {
+	q := `SELECT id, operation, left_id, right_id FROM tasks WHERE expression_id = $1 AND state IN ('pending', 'leased')`
+	rows, err := r.pool.Query(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []models.Task
+	for rows.Next() {
+		task := models.Task{ExpressionID: id}
+		err = rows.Scan(&task.ID, &task.Operation, &task.LeftID, &task.RightID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, task)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) GetPlanTasks(ctx context.Context, id int) ([]models.Task, error) {
+	q := `WITH RECURSIVE plan AS (
+			SELECT t.id, t.operation, t.arg1, t.arg2, t.plan_left_id, t.plan_right_id, t.cost
+			FROM tasks t JOIN expressions e ON e.main_task_id = t.id
+			WHERE e.id = $1
+			UNION
+			SELECT t.id, t.operation, t.arg1, t.arg2, t.plan_left_id, t.plan_right_id, t.cost
+			FROM tasks t JOIN plan p ON t.id IN (p.plan_left_id, p.plan_right_id)
+		)
+		SELECT id, operation, arg1, arg2, plan_left_id, plan_right_id, cost FROM plan`
+	rows, err := r.pool.Query(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []models.Task
+	for rows.Next() {
+		task := models.Task{ExpressionID: id}
+		var cost int64
+		err = rows.Scan(&task.ID, &task.Operation, &task.Arg1, &task.Arg2, &task.LeftID, &task.RightID, &cost)
+		if err != nil {
+			return nil, err
+		}
+		task.OperationTime = time.Duration(cost) * time.Millisecond
+		res = append(res, task)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) GetQueue(ctx context.Context, exceptID int) (map[string]int, error) {
+	q := `SELECT operation, count(*) FROM tasks
+		WHERE left_id IS NULL AND right_id IS NULL AND state IN ('pending', 'leased') AND expression_id <> $1
+		GROUP BY operation`
+	rows, err := r.pool.Query(ctx, q, exceptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]int)
+	for rows.Next() {
+		var operation string
+		var cnt int
+		err = rows.Scan(&operation, &cnt)
+		if err != nil {
+			return nil, err
+		}
+		res[operation] = cnt
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) Cancel(ctx context.Context, userID, id int) ([]uuid.UUID, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	var status models.Status
+	q := `SELECT status FROM expressions WHERE id = $1 AND user_id = $2 FOR UPDATE`
+	err = tx.QueryRow(ctx, q, id, userID).Scan(&status)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if !status.CanTransition(models.StatusCancelled) {
+		return nil, repository.ErrNotRunning
+	}
+	q = `UPDATE expressions SET status = 'cancelled', main_task_id = NULL, finished_at = now() WHERE id = $1`
+	_, err = tx.Exec(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	// Посчитанные и выданные агентам задачи остаются в истории выражения, результат выданных отбросится.
+	ids, err := cancelTasks(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit(ctx)
+}
+
+// cancelTasks удаляет ждущие задачи выражения, а выданные агентам помечает отменёнными: их результат
+// отбросится, а сами они останутся в истории.
+func cancelTasks(ctx context.Context, tx pgx.Tx, id int) ([]uuid.UUID, error) {
+	q := `DELETE FROM tasks WHERE expression_id = $1 AND state = 'pending'`
+	_, err := tx.Exec(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	q = `UPDATE tasks SET state = 'cancelled', lease_until = NULL, stream_id = NULL
+		WHERE expression_id = $1 AND state = 'leased' RETURNING id`
+	rows, err := tx.Query(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
+// Retry сбрасывает выражение для новой попытки и возвращает его текст и ID удалённых задач прошлой попытки.
+func (r *Repository) Retry(ctx context.Context, userID, id int, stuckAfter time.Duration) (string, []uuid.UUID, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(ctx)
+	var status models.Status
+	var expression string
+	var stuck bool
+	q := `SELECT status, COALESCE(expression, ''), attempt_started_at < now() - make_interval(secs => $2)
+		FROM expressions WHERE id = $1 AND user_id = $3 FOR UPDATE`
+	err = tx.QueryRow(ctx, q, id, stuckAfter.Seconds(), userID).Scan(&status, &expression, &stuck)
+	if err != nil {
+		return "", nil, notFound(err)
+	}
+	if status != models.StatusFailed && !(status.Active() && stuck) {
+		return "", nil, repository.ErrNotRetryable
+	}
+	q = `INSERT INTO expression_attempts(expression_id, attempt, status, result, started_at)
+		SELECT id, attempt, status, result, attempt_started_at FROM expressions WHERE id = $1`
+	_, err = tx.Exec(ctx, q, id)
+	if err != nil {
+		return "", nil, err
+	}
+	q = `UPDATE expressions
+		SET status = 'pending', result = NULL, main_task_id = NULL, attempt = attempt + 1, attempt_started_at = now(),
+			started_at = NULL, finished_at = NULL
+		WHERE id = $1`
+	_, err = tx.Exec(ctx, q, id)
+	if err != nil {
+		return "", nil, err
+	}
+	q = `DELETE FROM tasks WHERE expression_id = $1 RETURNING id`
+	rows, err := tx.Query(ctx, q, id)
+	if err != nil {
+		return "", nil, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return "", nil, err
+	}
+	return expression, ids, tx.Commit(ctx)
+}
+
+func (r *Repository) ClaimUnplanned(ctx context.Context, stuckAfter time.Duration, limit int) ([]int, []string, error) {
+	q := `UPDATE expressions SET attempt_started_at = now()
+		WHERE id IN (
+			SELECT id FROM expressions
+			WHERE status = 'pending' AND main_task_id IS NULL AND attempt_started_at < now() - make_interval(secs => $1)
+			ORDER BY id LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, COALESCE(expression, '')`
+	rows, err := r.pool.Query(ctx, q, stuckAfter.Seconds(), limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	var expressions []string
+	for rows.Next() {
+		var id int
+		var expression string
+		if err = rows.Scan(&id, &expression); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		expressions = append(expressions, expression)
+	}
+	return ids, expressions, rows.Err()
+}
+
+func (r *Repository) GetAttempts(ctx context.Context, userID, id int) ([]models.Attempt, error) {
+	q := `SELECT a.attempt, a.status, a.result, a.started_at, a.finished_at
+		FROM expression_attempts a JOIN expressions e ON e.id = a.expression_id
+		WHERE e.id = $1 AND e.user_id = $2 ORDER BY a.attempt`
+	rows, err := r.pool.Query(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []models.Attempt{}
+	for rows.Next() {
+		var a models.Attempt
+		err = rows.Scan(&a.Attempt, &a.Status, &a.Result, &a.StartedAt, &a.FinishedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) Purge(ctx context.Context, rule config.RetentionRule) (int64, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	cutoff := time.Now().Add(-rule.After)
+	where := `status = $1 AND COALESCE(finished_at, created_at) < $2`
+	q := `DELETE FROM tasks WHERE expression_id IN (SELECT id FROM expressions WHERE ` + where + `)`
+	if _, err = tx.Exec(ctx, q, rule.Status, cutoff); err != nil {
+		return 0, err
+	}
+	q = `DELETE FROM expressions WHERE ` + where
+	if rule.Archive {
+		q = `WITH old AS (
+				DELETE FROM expressions WHERE ` + where + `
+				RETURNING id, user_id, status, result, expression, priority, created_at, started_at, finished_at
+			)
+			INSERT INTO expressions_archive(id, user_id, status, result, expression, priority, created_at, started_at, finished_at)
+			SELECT * FROM old`
+	}
+	tag, err := tx.Exec(ctx, q, rule.Status, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+func (r *Repository) GetEvents(ctx context.Context, userID, id int) ([]models.Event, error) {
+	q := `SELECT ev.id, ev.type, ev.task_id, COALESCE(ev.agent_id, ''), COALESCE(ev.detail, ''), ev.created_at
+		FROM expression_events ev JOIN expressions e ON e.id = ev.expression_id
+		WHERE e.id = $1 AND e.user_id = $2 ORDER BY ev.id`
+	rows, err := r.pool.Query(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []models.Event{}
+	for rows.Next() {
+		var e models.Event
+		if err = rows.Scan(&e.ID, &e.Type, &e.TaskID, &e.Agent, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) WebhookSecret(ctx context.Context, userID int) (string, error) {
+	secret, err := repository.NewWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	q := `UPDATE users SET webhook_secret = COALESCE(webhook_secret, $2) WHERE id = $1 RETURNING webhook_secret`
+	err = r.pool.QueryRow(ctx, q, userID, secret).Scan(&secret)
+	return secret, notFound(err)
+}
+
+func (r *Repository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error) {
+	q := `WITH due AS (
+			SELECT id FROM webhook_outbox
+			WHERE state = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_outbox o
+		SET attempts = attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		FROM due
+		WHERE o.id = due.id
+		RETURNING o.id, o.expression_id, o.url, o.payload, o.attempts,
+			COALESCE((SELECT webhook_secret FROM users WHERE id = o.user_id), '')`
+	rows, err := r.pool.Query(ctx, q, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []models.Webhook
+	for rows.Next() {
+		var w models.Webhook
+		var payload string
+		if err = rows.Scan(&w.ID, &w.ExpressionID, &w.URL, &payload, &w.Attempt, &w.Secret); err != nil {
+			return nil, err
+		}
+		w.Payload = []byte(payload)
+		res = append(res, w)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) RecordDelivery(ctx context.Context, d models.WebhookDelivery, retryAt time.Time) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	q := `INSERT INTO webhook_deliveries(webhook_id, attempt, status_code, error, duration_ms)
+		VALUES($1, $2, NULLIF($3, 0), NULLIF($4, ''), $5)`
+	if _, err = tx.Exec(ctx, q, d.WebhookID, d.Attempt, d.StatusCode, d.Error, d.DurationMs); err != nil {
+		return err
+	}
+	switch {
+	case d.Delivered():
+		q = `UPDATE webhook_outbox SET state = 'delivered' WHERE id = $1`
+		_, err = tx.Exec(ctx, q, d.WebhookID)
+	case retryAt.IsZero():
+		q = `UPDATE webhook_outbox SET state = 'failed' WHERE id = $1`
+		_, err = tx.Exec(ctx, q, d.WebhookID)
+	default:
+		q = `UPDATE webhook_outbox SET next_attempt_at = $2 WHERE id = $1`
+		_, err = tx.Exec(ctx, q, d.WebhookID, retryAt)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *Repository) GetWebhooks(ctx context.Context, userID, id int) ([]models.WebhookLog, error) {
+	q := `SELECT w.id, w.url, w.state, w.attempts, w.next_attempt_at, w.created_at
+		FROM webhook_outbox w JOIN expressions e ON e.id = w.expression_id
+		WHERE e.id = $1 AND e.user_id = $2 ORDER BY w.id`
+	rows, err := r.pool.Query(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	res := []models.WebhookLog{}
+	byID := map[int64]int{}
+	for rows.Next() {
+		var w models.WebhookLog
+		var next time.Time
+		if err = rows.Scan(&w.ID, &w.URL, &w.State, &w.Attempts, &next, &w.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if w.State == models.WebhookPending {
+			w.NextAttemptAt = &next
+		}
+		w.Deliveries = []models.WebhookDelivery{}
+		byID[w.ID] = len(res)
+		res = append(res, w)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	q = `SELECT d.webhook_id, d.attempt, COALESCE(d.status_code, 0), COALESCE(d.error, ''), d.duration_ms, d.created_at
+		FROM webhook_deliveries d JOIN webhook_outbox o ON o.id = d.webhook_id
+		WHERE o.expression_id = $1 ORDER BY d.id`
+	rows, err = r.pool.Query(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err = rows.Scan(&d.WebhookID, &d.Attempt, &d.StatusCode, &d.Error, &d.DurationMs, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		w := &res[byID[d.WebhookID]]
+		w.Deliveries = append(w.Deliveries, d)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) CreateImport(ctx context.Context, userID int, filename string, total int) (int, error) {
+	q := `INSERT INTO imports(user_id, filename, total) VALUES($1, NULLIF($2, ''), $3) RETURNING id`
+	var id int
+	err := r.pool.QueryRow(ctx, q, userID, filename, total).Scan(&id)
+	return id, err
+}
+
+func (r *Repository) AddImportProgress(ctx context.Context, id, created int, errs []models.ImportError) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	batch := &pgx.Batch{}
+	q := `INSERT INTO import_errors(import_id, line, ref, error) VALUES($1, $2, NULLIF($3, ''), $4)`
+	for _, e := range errs {
+		batch.Queue(q, id, e.Line, e.Ref, e.Error)
+	}
+	q = `UPDATE imports SET processed = processed + $2 + $3, created = created + $2, failed = failed + $3, updated_at = now()
+		WHERE id = $1`
+	batch.Queue(q, id, created, len(errs))
+	if err = tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *Repository) FinishImport(ctx context.Context, id int, state string) error {
+	q := `UPDATE imports SET state = $2, finished_at = now() WHERE id = $1`
+	_, err := r.pool.Exec(ctx, q, id, state)
 	return err
 }
+
+func (r *Repository) FailStaleImports(ctx context.Context, stuckAfter time.Duration) (int64, error) {
+	q := `UPDATE imports SET state = 'failed', finished_at = now()
+		WHERE state = 'running' AND updated_at < now() - make_interval(secs => $1)`
+	tag, err := r.pool.Exec(ctx, q, stuckAfter.Seconds())
+	return tag.RowsAffected(), err
+}
+
+func (r *Repository) GetImport(ctx context.Context, userID, id int) (models.Import, error) {
+	res := models.Import{Errors: []models.ImportError{}}
+	q := `SELECT id, COALESCE(filename, ''), state, total, processed, created, failed, created_at, finished_at
+		FROM imports WHERE id = $1 AND user_id = $2`
+	err := r.pool.QueryRow(ctx, q, id, userID).Scan(&res.ID, &res.Filename, &res.State, &res.Total, &res.Processed,
+		&res.Created, &res.Failed, &res.CreatedAt, &res.FinishedAt)
+	if err != nil {
+		return res, notFound(err)
+	}
+	q = `SELECT line, COALESCE(ref, ''), error FROM import_errors WHERE import_id = $1 ORDER BY line`
+	rows, err := r.pool.Query(ctx, q, id)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e models.ImportError
+		if err = rows.Scan(&e.Line, &e.Ref, &e.Error); err != nil {
+			return res, err
+		}
+		res.Errors = append(res.Errors, e)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,281 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/repotest"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Тесты идут в базу из DATABASE_URL и перед каждым хранилищем очищают все её таблицы.
+const migrations = "../../../../db/migrations/postgres"
+
+var lease = repository.Lease{Agent: "test", Stream: "stream", TTL: time.Minute}
+
+func connect(t *testing.T) *pgxpool.Pool {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("DATABASE_URL не задан")
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	if err = goose.SetDialect("postgres"); err != nil {
+		t.Fatal(err)
+	}
+	goose.SetLogger(goose.NopLogger())
+	if err = goose.Up(stdlib.OpenDBFromPool(pool), migrations); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// reset очищает таблицы и заводит пользователей 1 и 2, от которых пишет repotest.
+func reset(t *testing.T, pool *pgxpool.Pool) {
+	ctx := context.Background()
+	var tables string
+	q := `SELECT string_agg(quote_ident(tablename), ', ') FROM pg_tables
+		WHERE schemaname = current_schema() AND tablename <> 'goose_db_version'`
+	if err := pool.QueryRow(ctx, q).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `TRUNCATE `+tables+` RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+	q = `INSERT INTO users(login, password_hash) VALUES ('owner', ''), ('stranger', '')`
+	if _, err := pool.Exec(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listen запускает Listen и ждёт, пока подписка начнёт доставлять сигналы.
+func listen(t *testing.T, r *Repository, pool *pgxpool.Pool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Listen(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	ready, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+	for i := 0; i < 50; i++ {
+		if _, err := pool.Exec(ctx, `SELECT pg_notify($1, '')`, readyChannel); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ready:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("Подписка на готовые задачи не заработала")
+}
+
+func newRepo(t *testing.T, cache config.Cache, scheduler config.Scheduler) *Repository {
+	pool := connect(t)
+	reset(t, pool)
+	r, err := NewRepository(pool, cache, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen(t, r, pool)
+	return r
+}
+
+func signalled(ready <-chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+// save сохраняет выражение из одной готовой задачи a+b.
+func save(t *testing.T, r *Repository, a, b float64) (int, uuid.UUID) {
+	ctx := context.Background()
+	id, err := r.SetWithExpression(ctx, 1, models.Expressions{Status: models.StatusPending}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &models.Task{ID: uuid.New(), Operation: "+", Arg1: a, Arg2: b}
+	if err = r.SaveTasks(ctx, []*models.Task{task}, id); err != nil {
+		t.Fatal(err)
+	}
+	return id, task.ID
+}
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, cache config.Cache, scheduler config.Scheduler) repository.Repository {
+		return newRepo(t, cache, scheduler)
+	})
+}
+
+func TestSkipLocked(t *testing.T) {
+	r := newRepo(t, config.Cache{}, config.Scheduler{Policy: "critical_path"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, locked := save(t, r, 1, 2)
+	_, free := save(t, r, 3, 4)
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, `SELECT id FROM tasks WHERE id = $1 FOR UPDATE`, locked); err != nil {
+		t.Fatal(err)
+	}
+	task, err := r.GetTask(ctx, lease)
+	if err != nil {
+		t.Fatalf("Ожидал, что выдача пропустит заблокированную задачу, получил %v", err)
+	}
+	if task.ID != free {
+		t.Errorf("Ожидал свободную задачу %s, получил %s", free, task.ID)
+	}
+	if _, err = r.GetTask(ctx, lease); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Ожидал, что заблокированная задача не выдастся, получил %v", err)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	r := newRepo(t, config.Cache{}, config.Scheduler{Policy: "critical_path"})
+	ctx := context.Background()
+	_, id := save(t, r, 1, 2)
+	if _, err := r.GetTask(ctx, repository.Lease{Agent: "test", Stream: "stream", TTL: -time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	ready, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+	ids, err := r.RequeueExpired(ctx)
+	if err != nil || len(ids) != 1 || ids[0] != id {
+		t.Fatalf("Ожидал возврат задачи %s, получил %v, %v", id, ids, err)
+	}
+	if !signalled(ready) {
+		t.Error("Ожидал сигнал о вернувшейся в очередь задаче")
+	}
+	var state string
+	var leased bool
+	q := `SELECT state, lease_until IS NOT NULL OR stream_id IS NOT NULL FROM tasks WHERE id = $1`
+	if err = r.pool.QueryRow(ctx, q, id).Scan(&state, &leased); err != nil {
+		t.Fatal(err)
+	}
+	if state != "pending" || leased {
+		t.Errorf("Ожидал задачу pending без аренды, получил %s, аренда %v", state, leased)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	r := newRepo(t, config.Cache{}, config.Scheduler{Policy: "critical_path"})
+	other, err := NewRepository(r.pool, r.cache, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen(t, other, r.pool)
+	ready, unsubscribe := other.Subscribe()
+	defer unsubscribe()
+	save(t, r, 1, 2)
+	if !signalled(ready) {
+		t.Error("Ожидал, что второй экземпляр узнает о готовой задаче через pg_notify")
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	r := newRepo(t, config.Cache{}, config.Scheduler{Policy: "critical_path"})
+	ctx := context.Background()
+	id, _ := save(t, r, 1, 2)
+	q := `UPDATE expressions SET status = 'done', result = '3.00', callback_url = 'https://example.com' WHERE id = $1`
+	if _, err := r.pool.Exec(ctx, q, id); err != nil {
+		t.Fatal(err)
+	}
+	events, err := r.GetEvents(ctx, 1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Type)
+	}
+	want := []string{models.EventSubmitted, models.EventParsed, models.EventCompleted}
+	if !slices.Equal(got, want) {
+		t.Errorf("Ожидал события %v, получил %v", want, got)
+	}
+	var webhooks int
+	if err = r.pool.QueryRow(ctx, `SELECT count(*) FROM webhook_outbox WHERE expression_id = $1`, id).Scan(&webhooks); err != nil {
+		t.Fatal(err)
+	}
+	if webhooks != 1 {
+		t.Errorf("Ожидал один вебхук в outbox, получил %d", webhooks)
+	}
+	if _, err = r.pool.Exec(ctx, `UPDATE expression_events SET detail = 'x' WHERE expression_id = $1`, id); err == nil {
+		t.Error("Ожидал, что история событий не меняется")
+	}
+}
+
+func TestStatusMigration(t *testing.T) {
+	pool := connect(t)
+	reset(t, pool)
+	ctx := context.Background()
+	db := stdlib.OpenDBFromPool(pool)
+	t.Cleanup(func() {
+		if err := goose.Up(db, migrations); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := goose.DownTo(db, migrations, 20261019230000); err != nil {
+		t.Fatal(err)
+	}
+	q := `INSERT INTO expressions(status, user_id, started_at) VALUES
+		('Подсчёт', 1, NULL), ('Подсчёт', 1, now()), ('Выполнено', 1, now()), ('Ошибка', 1, now()), ('Отменено', 1, now())`
+	if _, err := pool.Exec(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+	count := `SELECT count(*) FROM expression_events`
+	var before, after int
+	if err := pool.QueryRow(ctx, count).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := pool.Query(ctx, `SELECT status FROM expressions ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var status string
+		if err = rows.Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, status)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"pending", "running", "done", "failed", "cancelled"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Ожидал статусы %v, получил %v", want, got)
+	}
+	if err = pool.QueryRow(ctx, count).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("Перевод статусов записал %d лишних событий", after-before)
+	}
+}
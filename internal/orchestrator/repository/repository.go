@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/google/uuid"
+	"time"
+)
+
+var (
+	ErrNotFound      = errors.New("не найдено")
+	ErrTaskDiscarded = errors.New("задачи уже нет, результат отброшен")
+	ErrNotRunning    = errors.New("выражение уже не считается")
+	ErrNotRetryable  = errors.New("перезапустить можно только упавшее или зависшее выражение")
+	// ErrAlreadyPlanned - у выражения уже есть задачи или оно больше не ждёт разбора(например, отменено).
+	ErrAlreadyPlanned = errors.New("выражение уже разобрано или не ждёт разбора")
+	// ErrInvalidTransition - статус выражения нельзя сменить на запрошенный, например досчитать отменённое.
+	ErrInvalidTransition = errors.New("недопустимая смена статуса выражения")
+)
+
+// Методы с userID видят и меняют только выражения этого пользователя.
+// Чужое выражение для них не отличается от несуществующего: ErrNotFound.
+type Expressions interface {
+	Get(ctx context.Context, userID, key int) (models.Expressions, error)
+	Set(ctx context.Context, value models.Expressions) (int64, error)
+	GetAll(ctx context.Context, userID int, q ListQuery) ([]models.Expressions, string, error)
+	// Export отдаёт в fn выражения пользователя по возрастанию id, не собирая их в память.
+	// Из q учитываются только фильтры: limit, after и sort выгрузке не нужны.
+	Export(ctx context.Context, userID int, q ListQuery, fn func(models.ExportRow) error) error
+	SetWithExpression(ctx context.Context, userID int, value models.Expressions, expression string) (int, error)
+	SetBatch(ctx context.Context, userID int, values []models.Expressions, expressions []string) ([]int, error)
+	CreateSweep(ctx context.Context, userID int, template, priority string, expressions []string, values []map[string]float64) (int, []int, error)
+	GetSweep(ctx context.Context, userID, id int) (models.Sweep, error)
+	GetExpression(ctx context.Context, userID, id int) (string, error)
+	// Cancel отменяет выражение: ждущие задачи удаляет, выданные агентам помечает отменёнными и возвращает их ID.
+	Cancel(ctx context.Context, userID, id int) ([]uuid.UUID, error)
+	Retry(ctx context.Context, userID, id int, stuckAfter time.Duration) (string, []uuid.UUID, error)
+	// ClaimUnplanned забирает до limit выражений, которые дольше stuckAfter ждут разбора без задач,
+	// и откладывает их ещё на stuckAfter, чтобы другой оркестратор не разобрал их же.
+	ClaimUnplanned(ctx context.Context, stuckAfter time.Duration, limit int) ([]int, []string, error)
+	GetAttempts(ctx context.Context, userID, id int) ([]models.Attempt, error)
+	GetEvents(ctx context.Context, userID, id int) ([]models.Event, error)
+	// Purge удаляет или архивирует выражения по правилу вместе с их задачами. Возвращает, сколько убрал.
+	Purge(ctx context.Context, rule config.RetentionRule) (int64, error)
+}
+
+// Lease - кому и на сколько отдаётся задача.
+type Lease struct {
+	Agent  string
+	Stream string
+	TTL    time.Duration
+}
+
+type Tasks interface {
+	SaveTasks(ctx context.Context, tasks []*models.Task, id int) error
+	UpdateTask(ctx context.Context, task *models.Task) error
+	// GetTask отдаёт готовую задачу в аренду стриму агента. Пока аренда не истекла,
+	// задачу не получит никто другой.
+	GetTask(ctx context.Context, lease Lease) (models.Task, error)
+	// RequeueExpired возвращает в очередь задачи с истёкшей арендой.
+	RequeueExpired(ctx context.Context) ([]uuid.UUID, error)
+	// ReleaseStream возвращает в очередь задачи, арендованные закрывшимся стримом.
+	ReleaseStream(ctx context.Context, stream string) ([]uuid.UUID, error)
+	// Subscribe подписывает на сигналы о новых готовых задачах. Второе значение - отписка.
+	Subscribe() (<-chan struct{}, func())
+	GetTaskTimings(ctx context.Context, userID, id int) ([]models.TaskTiming, error)
+	GetExpressionTasks(ctx context.Context, id int) ([]models.Task, error)
+	// GetPlanTasks отдаёт задачи, достижимые от главной задачи выражения по исходным связям графа.
+	// Задачи, удалённые при отмене, в ответ не попадают, и связи на них остаются висячими.
+	GetPlanTasks(ctx context.Context, id int) ([]models.Task, error)
+	GetQueue(ctx context.Context, exceptID int) (map[string]int, error)
+	CacheStats(ctx context.Context) (models.CacheStats, error)
+	// TrimCache удаляет из кэша просроченные записи и самые старые сверх CACHE_SIZE.
+	// Запускается по расписанию, между запусками кэш может быть немного больше.
+	TrimCache(ctx context.Context) (int64, error)
+}
+
+// Webhooks - outbox вебхуков. Записи в него попадают в той же транзакции, что и конечный статус
+// выражения с callback_url, поэтому ни одно уведомление не теряется.
+type Webhooks interface {
+	// WebhookSecret возвращает ключ подписи вебхуков пользователя и создаёт его при первом обращении.
+	WebhookSecret(ctx context.Context, userID int) (string, error)
+	// ClaimWebhooks забирает до limit доставок, которым пора уйти, и откладывает их на lease,
+	// чтобы другой оркестратор не отправил их же.
+	ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error)
+	// RecordDelivery пишет попытку в журнал. Нулевой retryAt у неудачной попытки - больше не пытаться.
+	RecordDelivery(ctx context.Context, d models.WebhookDelivery, retryAt time.Time) error
+	GetWebhooks(ctx context.Context, userID, id int) ([]models.WebhookLog, error)
+}
+
+// Imports - задания импорта выражений из файла. Сами выражения создаются через SetBatch.
+type Imports interface {
+	CreateImport(ctx context.Context, userID int, filename string, total int) (int, error)
+	// AddImportProgress засчитывает обработанную порцию строк: created новых выражений и errs ошибочных строк.
+	AddImportProgress(ctx context.Context, id, created int, errs []models.ImportError) error
+	FinishImport(ctx context.Context, id int, state string) error
+	// FailStaleImports завершает с ошибкой задания, прогресс которых не менялся дольше stuckAfter:
+	// их оркестратор остановился посреди импорта.
+	FailStaleImports(ctx context.Context, stuckAfter time.Duration) (int64, error)
+	GetImport(ctx context.Context, userID, id int) (models.Import, error)
+}
+
+type Users interface {
+	CreateUser(ctx context.Context, login, password string) error
+	VerifyUser(ctx context.Context, login, password string) (int, bool, error)
+}
+
+// Repository - всё хранилище оркестратора. Реализации: postgres, sqlite и memory.
+type Repository interface {
+	Expressions
+	Tasks
+	Webhooks
+	Imports
+	Users
+}
@@ -0,0 +1,799 @@
+// Package repotest - общий набор проверок для всех реализаций repository.Repository.
+package repotest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/google/uuid"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Выражения набор создаёт от пользователя owner, чужим считается owner+1.
+const owner = 1
+
+var lease = repository.Lease{Agent: "test", Stream: "stream", TTL: time.Minute}
+
+// Factory создаёт пустое хранилище с настройками кэша cache и планировщика scheduler.
+// Пользователи owner и owner+1 должны существовать, если этого требуют внешние ключи.
+type Factory func(t *testing.T, cache config.Cache, scheduler config.Scheduler) repository.Repository
+
+// save сохраняет выражение из задач tasks, последняя из них - главная.
+func save(t *testing.T, r repository.Repository, tasks ...*models.Task) int {
+	ctx := context.Background()
+	id, err := r.SetWithExpression(ctx, owner, models.Expressions{Status: models.StatusPending}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SaveTasks(ctx, tasks, id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// saveSum сохраняет (a+b)*c: задача умножения ждёт результат сложения.
+func saveSum(t *testing.T, r repository.Repository, a, b, c float64) int {
+	sum := &models.Task{ID: uuid.New(), Operation: "+", Arg1: a, Arg2: b}
+	mul := &models.Task{ID: uuid.New(), Operation: "*", LeftID: &sum.ID, Arg2: c}
+	return save(t, r, sum, mul)
+}
+
+// signalled ждёт сигнал о готовых задачах. У Postgres он приходит через LISTEN асинхронно.
+func signalled(ready <-chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func solve(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	for {
+		task, err := r.GetTask(ctx, lease)
+		if errors.Is(err, repository.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch task.Operation {
+		case "+":
+			task.Result = task.Arg1 + task.Arg2
+		case "*":
+			task.Result = task.Arg1 * task.Arg2
+		}
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Run прогоняет общий набор проверок на хранилищах, созданных newRepo.
+func Run(t *testing.T, factory Factory) {
+	ctx := context.Background()
+	newRepo := func(t *testing.T, cacheSize int) repository.Repository {
+		return factory(t, config.Cache{Size: cacheSize, TTL: time.Hour}, config.Scheduler{Policy: "critical_path", Aging: time.Minute})
+	}
+	t.Run("Task graph", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		task, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Operation != "+" {
+			t.Errorf("Ожидал первой готовую задачу +, получил %s", task.Operation)
+		}
+		task.Result = task.Arg1 + task.Arg2
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
+		}
+		solve(t, r)
+		res, err := r.Get(ctx, owner, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != models.StatusDone || res.Result == nil || *res.Result != "20.00" {
+			t.Errorf("Ожидал Выполнено 20.00, получил %v", res)
+		}
+		if res.StartedAt == nil || res.FinishedAt == nil || res.FinishedAt.Before(*res.StartedAt) {
+			t.Errorf("Ожидал время начала и окончания подсчёта, получил %v - %v", res.StartedAt, res.FinishedAt)
+		}
+		timings, err := r.GetTaskTimings(ctx, owner, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timings) != 2 {
+			t.Fatalf("Ожидал 2 задачи в истории, получил %d", len(timings))
+		}
+		for _, timing := range timings {
+			if timing.Agent != "test" || timing.CompletedAt == nil || timing.RunTimeMs == nil {
+				t.Errorf("Ожидал посчитанную агентом test задачу, получил %+v", timing)
+			}
+		}
+		if _, err = r.Get(ctx, owner, 100); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал ErrNotFound, получил %v", err)
+		}
+	})
+
+	t.Run("Isolation", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		if _, err := r.Get(ctx, owner+1, id); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал ErrNotFound для чужого выражения, получил %v", err)
+		}
+		if _, err := r.Cancel(ctx, owner+1, id); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал ErrNotFound при отмене чужого выражения, получил %v", err)
+		}
+		if all, _, _ := r.GetAll(ctx, owner+1, repository.ListQuery{}); len(all) != 0 {
+			t.Errorf("Ожидал пустой список чужих выражений, получил %v", all)
+		}
+		if events, _ := r.GetEvents(ctx, owner+1, id); len(events) != 0 {
+			t.Errorf("Ожидал пустую историю чужого выражения, получил %v", events)
+		}
+		if attempts, _ := r.GetAttempts(ctx, owner+1, id); len(attempts) != 0 {
+			t.Errorf("Ожидал пустые попытки чужого выражения, получил %v", attempts)
+		}
+		if logs, _ := r.GetWebhooks(ctx, owner+1, id); len(logs) != 0 {
+			t.Errorf("Ожидал пустой журнал вебхуков чужого выражения, получил %v", logs)
+		}
+		if all, _, _ := r.GetAll(ctx, owner, repository.ListQuery{}); len(all) != 1 {
+			t.Errorf("Ожидал одно своё выражение, получил %v", all)
+		}
+	})
+
+	t.Run("Listing", func(t *testing.T) {
+		r := newRepo(t, 0)
+		for i := 0; i < 5; i++ {
+			saveSum(t, r, 2, 3, 4)
+		}
+		if _, err := r.Cancel(ctx, owner, 2); err != nil {
+			t.Fatal(err)
+		}
+		for _, sort := range []string{"id", "-id", "created_at", "-created_at"} {
+			var got []int64
+			lq := repository.ListQuery{Limit: 2, Sort: sort}
+			for {
+				page, next, err := r.GetAll(ctx, owner, lq)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range page {
+					got = append(got, e.ID)
+				}
+				if next == "" {
+					break
+				}
+				if lq.After, err = repository.ParseCursor(next); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(got) != 5 || (got[0] < got[4]) != (sort[0] != '-') {
+				t.Errorf("%s: ожидал 5 выражений по порядку, получил %v", sort, got)
+			}
+		}
+		cancelled, _, _ := r.GetAll(ctx, owner, repository.ListQuery{Status: models.StatusCancelled})
+		if len(cancelled) != 1 || cancelled[0].ID != 2 {
+			t.Errorf("Ожидал одно отменённое выражение 2, получил %v", cancelled)
+		}
+		future, _, _ := r.GetAll(ctx, owner, repository.ListQuery{CreatedFrom: time.Now().Add(time.Hour)})
+		if len(future) != 0 {
+			t.Errorf("Ожидал пустой список из будущего, получил %v", future)
+		}
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		r := newRepo(t, 0)
+		// Больше двух страниц выгрузки и sqlite, и postgres.
+		n := 1001
+		values := make([]models.Expressions, n)
+		texts := make([]string, n)
+		for i := range values {
+			values[i].Status = models.StatusPending
+			texts[i] = strconv.Itoa(i) + "+1"
+		}
+		if _, err := r.SetBatch(ctx, owner, values, texts); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Cancel(ctx, owner, 2); err != nil {
+			t.Fatal(err)
+		}
+		var got []models.ExportRow
+		err := r.Export(ctx, owner, repository.ListQuery{}, func(e models.ExportRow) error {
+			got = append(got, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != n || got[n-1].ID != int64(n) || got[n-1].Expression != texts[n-1] {
+			t.Fatalf("Ожидал %d выражений по возрастанию id, получил %d", n, len(got))
+		}
+		var cancelled []int64
+		_ = r.Export(ctx, owner, repository.ListQuery{Status: models.StatusCancelled}, func(e models.ExportRow) error {
+			cancelled = append(cancelled, e.ID)
+			return nil
+		})
+		if !slices.Equal(cancelled, []int64{2}) {
+			t.Errorf("Ожидал одно отменённое выражение 2, получил %v", cancelled)
+		}
+		stop := errors.New("stop")
+		calls := 0
+		err = r.Export(ctx, owner, repository.ListQuery{}, func(models.ExportRow) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("Ожидал остановку на первой строке, получил %v после %d", err, calls)
+		}
+		if err = r.Export(ctx, owner+1, repository.ListQuery{}, func(e models.ExportRow) error {
+			return fmt.Errorf("чужое выражение %d", e.ID)
+		}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		r := newRepo(t, 10)
+		saveSum(t, r, 2, 3, 4)
+		solve(t, r)
+		id := saveSum(t, r, 2, 3, 4)
+		if _, err := r.GetTask(ctx, lease); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал, что всё выражение посчитается из кэша, получил %v", err)
+		}
+		if res, _ := r.Get(ctx, owner, id); res.Result == nil || *res.Result != "20.00" {
+			t.Errorf("Ожидал 20.00 из кэша, получил %v", res)
+		}
+		stats, _ := r.CacheStats(ctx)
+		if stats.Hits != 2 || stats.Size != 2 {
+			t.Errorf("Ожидал 2 попадания и 2 записи, получил %+v", stats)
+		}
+		if n, err := r.TrimCache(ctx); err != nil || n != 0 {
+			t.Errorf("Ожидал, что свежие записи останутся, удалено %d, %v", n, err)
+		}
+	})
+
+	t.Run("Cache key", func(t *testing.T) {
+		r := newRepo(t, 10)
+		save(t, r, &models.Task{ID: uuid.New(), Operation: "+", Arg1: 2, Arg2: 3})
+		task, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Агент вернул чужие операцию и аргументы: в кэш попадает сохранённая задача 2+3.
+		task.Operation, task.Arg1, task.Arg2, task.Result = "*", 7, 7, 5
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
+		}
+		id := save(t, r, &models.Task{ID: uuid.New(), Operation: "+", Arg1: 2, Arg2: 3})
+		if _, err = r.GetTask(ctx, lease); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал, что 2+3 посчитается из кэша, получил %v", err)
+		}
+		if res, _ := r.Get(ctx, owner, id); res.Result == nil || *res.Result != "5.00" {
+			t.Errorf("Ожидал 5.00 из кэша, получил %+v", res)
+		}
+		save(t, r, &models.Task{ID: uuid.New(), Operation: "*", Arg1: 7, Arg2: 7})
+		if task, err = r.GetTask(ctx, lease); err != nil || task.Operation != "*" {
+			t.Errorf("Ожидал, что 7*7 не возьмётся из кэша, получил %+v, %v", task, err)
+		}
+	})
+	t.Run("Cache TTL", func(t *testing.T) {
+		r := factory(t, config.Cache{Size: 10, TTL: 100 * time.Millisecond}, config.Scheduler{Policy: "critical_path"})
+		saveSum(t, r, 2, 3, 4)
+		solve(t, r)
+		time.Sleep(200 * time.Millisecond)
+		saveSum(t, r, 2, 3, 4)
+		if _, err := r.GetTask(ctx, lease); err != nil {
+			t.Errorf("Ожидал, что просроченная запись не используется до чистки, получил %v", err)
+		}
+		if n, err := r.TrimCache(ctx); err != nil || n != 2 {
+			t.Errorf("Ожидал удаление 2 просроченных записей, удалено %d, %v", n, err)
+		}
+		if stats, _ := r.CacheStats(ctx); stats.Size != 0 || stats.Hits != 0 {
+			t.Errorf("Ожидал пустой кэш без попаданий, получил %+v", stats)
+		}
+	})
+
+	t.Run("Cache size", func(t *testing.T) {
+		r := newRepo(t, 1)
+		saveSum(t, r, 2, 3, 4)
+		solve(t, r)
+		if stats, _ := r.CacheStats(ctx); stats.Size != 2 {
+			t.Errorf("Ожидал, что до чистки в кэше 2 записи, получил %+v", stats)
+		}
+		if n, err := r.TrimCache(ctx); err != nil || n != 1 {
+			t.Errorf("Ожидал вытеснение одной записи, удалено %d, %v", n, err)
+		}
+		if stats, _ := r.CacheStats(ctx); stats.Size != 1 {
+			t.Errorf("Ожидал 1 запись после чистки, получил %+v", stats)
+		}
+	})
+
+	t.Run("Leasing", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		if e, _ := r.Get(ctx, owner, id); e.Status != models.StatusPending {
+			t.Errorf("Ожидал pending до выдачи задач, получил %s", e.Status)
+		}
+		task, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, _ := r.Get(ctx, owner, id); e.Status != models.StatusRunning {
+			t.Errorf("Ожидал running после выдачи задачи, получил %s", e.Status)
+		}
+		other := repository.Lease{Agent: "other", Stream: "other", TTL: -time.Millisecond}
+		if _, err = r.GetTask(ctx, other); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал, что арендованная задача не уйдёт второму стриму, получил %v", err)
+		}
+		if ids, _ := r.ReleaseStream(ctx, lease.Stream); len(ids) != 1 || ids[0] != task.ID {
+			t.Errorf("Ожидал возврат задачи %s закрывшегося стрима, получил %v", task.ID, ids)
+		}
+		if _, err = r.GetTask(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+		if ids, _ := r.RequeueExpired(ctx); len(ids) != 1 || ids[0] != task.ID {
+			t.Errorf("Ожидал возврат задачи %s с истёкшей арендой, получил %v", task.ID, ids)
+		}
+		solve(t, r)
+		if ids, _ := r.RequeueExpired(ctx); len(ids) != 0 {
+			t.Errorf("Ожидал, что посчитанные задачи не вернутся в очередь, получил %v", ids)
+		}
+	})
+
+	t.Run("Policies", func(t *testing.T) {
+		// Выражение A: две задачи по 3с и их произведение, B: одна задача на 4с с длинным критическим путём.
+		// Первую задачу берём и возвращаем, затем решаем a1: у A остаётся 3с работы против 4с у B.
+		tests := []struct {
+			policy string
+			first  string
+			second string
+		}{
+			{policy: "fifo", first: "A", second: "a2"},
+			{policy: "critical_path", first: "B", second: "b"},
+			{policy: "sjf", first: "B", second: "a2"},
+		}
+		for _, test := range tests {
+			t.Run(test.policy, func(t *testing.T) {
+				r := factory(t, config.Cache{}, config.Scheduler{Policy: test.policy})
+				a1 := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 1, Arg2: 1, OperationTime: 3 * time.Second, CriticalPath: 3 * time.Second}
+				a2 := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 2, Arg2: 2, OperationTime: 3 * time.Second, CriticalPath: 3 * time.Second}
+				a3 := &models.Task{ID: uuid.New(), Operation: "*", LeftID: &a1.ID, RightID: &a2.ID}
+				b := &models.Task{ID: uuid.New(), Operation: "-", Arg1: 5, Arg2: 1, OperationTime: 4 * time.Second, CriticalPath: 10 * time.Second}
+				exprs := map[int]string{save(t, r, a1, a2, a3): "A", save(t, r, b): "B"}
+				task, err := r.GetTask(ctx, lease)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if exprs[task.ExpressionID] != test.first {
+					t.Errorf("Ожидал первой задачу выражения %s, получил %s", test.first, exprs[task.ExpressionID])
+				}
+				if _, err = r.ReleaseStream(ctx, lease.Stream); err != nil {
+					t.Fatal(err)
+				}
+				a1.Result = 2
+				if err = r.UpdateTask(ctx, a1); err != nil {
+					t.Fatal(err)
+				}
+				names := map[uuid.UUID]string{a2.ID: "a2", b.ID: "b"}
+				if task, err = r.GetTask(ctx, lease); err != nil || names[task.ID] != test.second {
+					t.Errorf("Ожидал задачу %s, получил %s, %v", test.second, names[task.ID], err)
+				}
+			})
+		}
+	})
+
+	t.Run("Priorities", func(t *testing.T) {
+		// Пакетное выражение сохранено раньше срочного: без старения первым идёт срочное,
+		// с быстрым старением пакетное дорастает до срочного класса и обгоняет его по fifo.
+		tests := []struct {
+			name  string
+			aging time.Duration
+			first string
+		}{
+			{name: "Without aging", first: "high"},
+			{name: "Slow aging", aging: time.Hour, first: "high"},
+			{name: "Fast aging", aging: time.Millisecond, first: "batch"},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				r := factory(t, config.Cache{}, config.Scheduler{Policy: "fifo", Aging: test.aging})
+				exprs := make(map[int]string)
+				for _, priority := range []string{"batch", "high"} {
+					id, err := r.SetWithExpression(ctx, owner, models.Expressions{Status: models.StatusPending, Priority: priority}, "")
+					if err != nil {
+						t.Fatal(err)
+					}
+					task := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 1, Arg2: 1}
+					if err = r.SaveTasks(ctx, []*models.Task{task}, id); err != nil {
+						t.Fatal(err)
+					}
+					exprs[id] = priority
+					time.Sleep(20 * time.Millisecond)
+				}
+				task, err := r.GetTask(ctx, lease)
+				if err != nil || exprs[task.ExpressionID] != test.first {
+					t.Errorf("Ожидал первой задачу класса %s, получил %s, %v", test.first, exprs[task.ExpressionID], err)
+				}
+				if e, _ := r.Get(ctx, owner, task.ExpressionID); e.Priority != exprs[task.ExpressionID] {
+					t.Errorf("Старение не должно менять класс выражения, получил %s", e.Priority)
+				}
+			})
+		}
+	})
+	t.Run("Plan tasks", func(t *testing.T) {
+		r := newRepo(t, 0)
+		sum := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 2, Arg2: 3, OperationTime: time.Second}
+		mul := &models.Task{ID: uuid.New(), Operation: "*", LeftID: &sum.ID, Arg2: 4, OperationTime: 2 * time.Second}
+		id := save(t, r, sum, mul)
+		solve(t, r)
+		tasks, err := r.GetPlanTasks(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := slices.IndexFunc(tasks, func(task models.Task) bool { return task.ID == mul.ID })
+		if len(tasks) != 2 || i < 0 || tasks[i].LeftID == nil || *tasks[i].LeftID != sum.ID ||
+			tasks[i].OperationTime != 2*time.Second || tasks[i].Arg2 != 4 {
+			t.Errorf("Ожидал граф из 2 задач с исходной связью после счёта, получил %+v", tasks)
+		}
+		cancelled := saveSum(t, r, 2, 3, 4)
+		if _, err = r.GetTask(ctx, lease); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.Cancel(ctx, owner, cancelled); err != nil {
+			t.Fatal(err)
+		}
+		if tasks, _ = r.GetPlanTasks(ctx, cancelled); len(tasks) != 0 {
+			t.Errorf("Ожидал, что без главной задачи граф пуст, получил %+v", tasks)
+		}
+	})
+
+	t.Run("Ready signal", func(t *testing.T) {
+		r := newRepo(t, 0)
+		ready, unsubscribe := r.Subscribe()
+		defer unsubscribe()
+		saveSum(t, r, 2, 3, 4)
+		if !signalled(ready) {
+			t.Fatal("Ожидал сигнал после сохранения задач")
+		}
+		task, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.Result = task.Arg1 + task.Arg2
+		if err = r.UpdateTask(ctx, &task); err != nil {
+			t.Fatal(err)
+		}
+		if !signalled(ready) {
+			t.Error("Ожидал сигнал, когда задача умножения стала готовой")
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		solve(t, r)
+		running := saveSum(t, r, 2, 3, 4)
+		if n, _ := r.Purge(ctx, config.RetentionRule{Status: models.StatusDone, After: time.Hour, Archive: true}); n != 0 {
+			t.Errorf("Ожидал, что свежее выражение не тронется, убрано %d", n)
+		}
+		n, err := r.Purge(ctx, config.RetentionRule{Status: models.StatusDone, After: -time.Hour, Archive: true})
+		if err != nil || n != 1 {
+			t.Fatalf("Ожидал архивацию одного выражения, получил %d, %v", n, err)
+		}
+		if _, err = r.Get(ctx, owner, id); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал, что выражение уйдёт из таблицы, получил %v", err)
+		}
+		if _, err = r.Get(ctx, owner, running); err != nil {
+			t.Errorf("Ожидал, что считающееся выражение останется, получил %v", err)
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		solve(t, r)
+		events, err := r.GetEvents(ctx, owner, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.Type)
+		}
+		want := []string{
+			models.EventSubmitted, models.EventParsed,
+			models.EventTaskDispatched, models.EventTaskCompleted,
+			models.EventTaskDispatched, models.EventCompleted, models.EventTaskCompleted,
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Ожидал события %v, получил %v", want, got)
+		}
+		if events[2].Agent != lease.Agent || events[2].TaskID == nil {
+			t.Errorf("Ожидал, что у выдачи задачи будут агент и задача, получил %+v", events[2])
+		}
+		if events[5].Detail != "20.00" {
+			t.Errorf("Ожидал результат 20.00 в событии, получил %+v", events[5])
+		}
+	})
+
+	t.Run("Failed task", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		leased, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leased.Error = "деление на ноль"
+		if err = r.UpdateTask(ctx, &leased); err != nil {
+			t.Fatal(err)
+		}
+		e, err := r.Get(ctx, owner, id)
+		if err != nil || e.Status != models.StatusFailed || e.Result == nil || *e.Result != leased.Error {
+			t.Errorf("Ожидал, что выражение упадёт с ошибкой агента, получил %+v, %v", e, err)
+		}
+		if _, err = r.GetTask(ctx, lease); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал, что остальные задачи снимутся, получил %v", err)
+		}
+		if err = r.UpdateTask(ctx, &leased); !errors.Is(err, repository.ErrTaskDiscarded) {
+			t.Errorf("Ожидал, что повторный ответ отбросится, получил %v", err)
+		}
+		events, err := r.GetEvents(ctx, owner, id)
+		if err != nil || !slices.ContainsFunc(events, func(e models.Event) bool {
+			return e.Type == models.EventTaskFailed && e.TaskID != nil && *e.TaskID == leased.ID
+		}) {
+			t.Errorf("Ожидал событие падения задачи, получил %+v, %v", events, err)
+		}
+	})
+
+	t.Run("Cancel and retry", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := saveSum(t, r, 2, 3, 4)
+		leased, err := r.GetTask(ctx, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := r.Cancel(ctx, owner, id)
+		if err != nil || !slices.Equal(ids, []uuid.UUID{leased.ID}) {
+			t.Fatalf("Ожидал отмену выданной задачи %s, получил %v, %v", leased.ID, ids, err)
+		}
+		leased.Result = 5
+		if err = r.UpdateTask(ctx, &leased); !errors.Is(err, repository.ErrTaskDiscarded) {
+			t.Errorf("Ожидал, что результат отменённой задачи отбросится, получил %v", err)
+		}
+		timings, err := r.GetTaskTimings(ctx, owner, id)
+		if err != nil || len(timings) != 1 || timings[0].ID != leased.ID {
+			t.Errorf("Ожидал, что в истории останется только выданная задача, получил %+v, %v", timings, err)
+		}
+		events, err := r.GetEvents(ctx, owner, id)
+		if err != nil || !slices.ContainsFunc(events, func(e models.Event) bool {
+			return e.Type == models.EventTaskCancelled && e.TaskID != nil && *e.TaskID == leased.ID
+		}) {
+			t.Errorf("Ожидал событие отмены задачи, получил %+v, %v", events, err)
+		}
+		if _, err = r.Cancel(ctx, owner, id); !errors.Is(err, repository.ErrNotRunning) {
+			t.Errorf("Ожидал ErrNotRunning, получил %v", err)
+		}
+		if _, _, err = r.Retry(ctx, owner, id, time.Hour); !errors.Is(err, repository.ErrNotRetryable) {
+			t.Errorf("Ожидал ErrNotRetryable, получил %v", err)
+		}
+		done := "20.00"
+		if _, err = r.Set(ctx, models.Expressions{ID: int64(id), Status: models.StatusDone, Result: &done}); !errors.Is(err, repository.ErrInvalidTransition) {
+			t.Errorf("Ожидал, что отменённое выражение нельзя досчитать, получил %v", err)
+		}
+		if _, err = r.Cancel(ctx, owner, 100); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал ErrNotFound, получил %v", err)
+		}
+		errText := "деление на ноль"
+		failed := models.Expressions{ID: int64(id), Status: models.StatusFailed, Result: &errText}
+		if _, err = r.Set(ctx, failed); !errors.Is(err, repository.ErrInvalidTransition) {
+			t.Errorf("Ожидал, что отменённое выражение нельзя уронить, получил %v", err)
+		}
+		id = saveSum(t, r, 2, 3, 4)
+		failed.ID = int64(id)
+		if _, err = r.Set(ctx, failed); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = r.Retry(ctx, owner, id, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		attempts, err := r.GetAttempts(ctx, owner, id)
+		if err != nil || len(attempts) != 1 || attempts[0].Status != models.StatusFailed {
+			t.Errorf("Ожидал одну упавшую попытку, получил %v, %v", attempts, err)
+		}
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		r := newRepo(t, 0)
+		if err := r.CreateUser(ctx, "user", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		userID, _, _ := r.VerifyUser(ctx, "user", "pass")
+		secret, err := r.WebhookSecret(ctx, userID)
+		if again, _ := r.WebhookSecret(ctx, userID); err != nil || secret == "" || again != secret {
+			t.Fatalf("Ожидал постоянный ключ, получил %q и %q, %v", secret, again, err)
+		}
+		value := models.Expressions{Status: models.StatusPending, CallbackURL: "http://127.0.0.1/hook"}
+		id, err := r.SetWithExpression(ctx, userID, value, "2+2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := "4.00"
+		if _, err = r.Set(ctx, models.Expressions{ID: int64(id), Status: models.StatusDone, Result: &res}); err != nil {
+			t.Fatal(err)
+		}
+		claimed, err := r.ClaimWebhooks(ctx, 10, time.Minute)
+		if err != nil || len(claimed) != 1 || claimed[0].Secret != secret || claimed[0].Attempt != 1 {
+			t.Fatalf("Ожидал один вебхук с ключом пользователя, получил %+v, %v", claimed, err)
+		}
+		var payload models.WebhookPayload
+		if err = json.Unmarshal(claimed[0].Payload, &payload); err != nil || payload.Status != models.StatusDone ||
+			payload.Result == nil || *payload.Result != res || payload.FinishedAt == nil {
+			t.Errorf("Ожидал снимок посчитанного выражения, получил %s, %v", claimed[0].Payload, err)
+		}
+		if again, _ := r.ClaimWebhooks(ctx, 10, time.Minute); len(again) != 0 {
+			t.Errorf("Арендованный вебхук выдан повторно: %+v", again)
+		}
+		failed := models.WebhookDelivery{WebhookID: claimed[0].ID, Attempt: 1, StatusCode: 500, Error: "500"}
+		if err = r.RecordDelivery(ctx, failed, time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		claimed, _ = r.ClaimWebhooks(ctx, 10, time.Minute)
+		if len(claimed) != 1 || claimed[0].Attempt != 2 {
+			t.Fatalf("Ожидал вторую попытку, получил %+v", claimed)
+		}
+		ok := models.WebhookDelivery{WebhookID: claimed[0].ID, Attempt: 2, StatusCode: 204}
+		if err = r.RecordDelivery(ctx, ok, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		logs, err := r.GetWebhooks(ctx, userID, id)
+		if err != nil || len(logs) != 1 || logs[0].State != models.WebhookDelivered || len(logs[0].Deliveries) != 2 ||
+			logs[0].NextAttemptAt != nil {
+			t.Errorf("Ожидал доставленный со второй попытки вебхук, получил %+v, %v", logs, err)
+		}
+	})
+
+	t.Run("Imports", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id, err := r.CreateImport(ctx, owner, "data.csv", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := r.SetBatch(ctx, owner, []models.Expressions{{Status: models.StatusPending, ExternalRef: "A-1"}}, []string{"2+2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = r.AddImportProgress(ctx, id, 1, []models.ImportError{{Line: 3, Ref: "A-3", Error: "ошибка"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = r.AddImportProgress(ctx, id, 0, []models.ImportError{{Line: 2, Error: "ошибка"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = r.FinishImport(ctx, id, models.ImportDone); err != nil {
+			t.Fatal(err)
+		}
+		job, err := r.GetImport(ctx, owner, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != models.ImportDone || job.Processed != 3 || job.Created != 1 || job.Failed != 2 ||
+			job.FinishedAt == nil || len(job.Errors) != 2 || job.Errors[0].Line != 2 || job.Errors[1].Ref != "A-3" {
+			t.Errorf("Ожидал завершённый импорт с двумя ошибками по порядку строк, получил %+v", job)
+		}
+		if _, err = r.GetImport(ctx, owner+1, id); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Чужой импорт виден: %v", err)
+		}
+		if e, _ := r.Get(ctx, owner, ids[0]); e.ExternalRef != "A-1" {
+			t.Errorf("Ожидал ссылку A-1, получил %+v", e)
+		}
+		stale, err := r.CreateImport(ctx, owner, "", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.FailStaleImports(ctx, time.Hour); err != nil || n != 0 {
+			t.Errorf("Ожидал, что свежий импорт не тронут, получил %d, %v", n, err)
+		}
+		// Отрицательный срок делает зависшими все идущие импорты.
+		if n, err := r.FailStaleImports(ctx, -time.Second); err != nil || n != 1 {
+			t.Errorf("Ожидал один зависший импорт, получил %d, %v", n, err)
+		}
+		if job, _ = r.GetImport(ctx, owner, stale); job.State != models.ImportFailed || job.FinishedAt == nil {
+			t.Errorf("Ожидал зависший импорт с ошибкой, получил %+v", job)
+		}
+		if job, _ = r.GetImport(ctx, owner, id); job.State != models.ImportDone {
+			t.Errorf("Ожидал, что завершённый импорт не тронут, получил %+v", job)
+		}
+	})
+	t.Run("Unplanned", func(t *testing.T) {
+		r := newRepo(t, 0)
+		ids, err := r.SetBatch(ctx, owner, []models.Expressions{{Status: models.StatusPending}, {Status: models.StatusPending}}, []string{"2+2", "3*4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveSum(t, r, 2, 3, 4)
+		done := "4.00"
+		if _, err = r.Set(ctx, models.Expressions{ID: int64(ids[1]), Status: models.StatusDone, Result: &done}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, err := r.ClaimUnplanned(ctx, time.Hour, 10); err != nil || len(got) != 0 {
+			t.Errorf("Ожидал, что свежие выражения не забираются, получил %v, %v", got, err)
+		}
+		got, expressions, err := r.ClaimUnplanned(ctx, -time.Second, 10)
+		if err != nil || !slices.Equal(got, ids[:1]) || !slices.Equal(expressions, []string{"2+2"}) {
+			t.Fatalf("Ожидал только ожидающее выражение без задач %d, получил %v %v, %v", ids[0], got, expressions, err)
+		}
+		if got, _, err = r.ClaimUnplanned(ctx, time.Hour, 10); err != nil || len(got) != 0 {
+			t.Errorf("Ожидал, что забранное выражение отложено, получил %v, %v", got, err)
+		}
+	})
+	t.Run("Plan once", func(t *testing.T) {
+		r := newRepo(t, 0)
+		id := save(t, r, &models.Task{ID: uuid.New(), Operation: "+", Arg1: 1, Arg2: 1})
+		// Второй разбор того же выражения, например после ClaimUnplanned, не должен добавить граф.
+		second := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 1, Arg2: 1}
+		if err := r.SaveTasks(ctx, []*models.Task{second}, id); !errors.Is(err, repository.ErrAlreadyPlanned) {
+			t.Errorf("Ожидал ErrAlreadyPlanned, получил %v", err)
+		}
+		if tasks, err := r.GetExpressionTasks(ctx, id); err != nil || len(tasks) != 1 || tasks[0].ID == second.ID {
+			t.Errorf("Ожидал только задачу первого разбора, получил %+v, %v", tasks, err)
+		}
+		cancelled, err := r.SetWithExpression(ctx, owner, models.Expressions{Status: models.StatusPending}, "2+2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.Cancel(ctx, owner, cancelled); err != nil {
+			t.Fatal(err)
+		}
+		late := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 2, Arg2: 2}
+		if err = r.SaveTasks(ctx, []*models.Task{late}, cancelled); !errors.Is(err, repository.ErrAlreadyPlanned) {
+			t.Errorf("Ожидал, что отменённое до разбора выражение не получит задачи, получил %v", err)
+		}
+		if task, err := r.GetTask(ctx, lease); err != nil || task.ID == late.ID || task.ExpressionID != id {
+			t.Errorf("Ожидал в очереди только задачу первого выражения, получил %+v, %v", task, err)
+		}
+		if _, err = r.GetTask(ctx, lease); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("Ожидал, что лишних задач в очереди нет, получил %v", err)
+		}
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		r := newRepo(t, 0)
+		values := []map[string]float64{{"x": 1}, {"x": 2}}
+		sweepID, ids, err := r.CreateSweep(ctx, owner, "x+1", "", []string{"1+1", "2+1"}, values)
+		if err != nil || len(ids) != 2 {
+			t.Fatalf("Ожидал 2 выражения, получил %v, %v", ids, err)
+		}
+		sweep, err := r.GetSweep(ctx, owner, sweepID)
+		if err != nil || sweep.Total != 2 || sweep.Status != models.StatusRunning {
+			t.Errorf("Ожидал 2 считающихся выражения, получил %+v, %v", sweep, err)
+		}
+	})
+	t.Run("Users", func(t *testing.T) {
+		r := newRepo(t, 0)
+		if err := r.CreateUser(ctx, "user", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.CreateUser(ctx, "other", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		id, ok, _ := r.VerifyUser(ctx, "user", "pass")
+		if !ok {
+			t.Error("Ожидал успешную проверку пароля")
+		}
+		if otherID, _, _ := r.VerifyUser(ctx, "other", "pass"); otherID == id {
+			t.Errorf("Ожидал разные ID пользователей, получил %d", id)
+		}
+		if _, ok, _ = r.VerifyUser(ctx, "user", "wrong"); ok {
+			t.Error("Ожидал отказ при неверном пароле")
+		}
+	})
+}
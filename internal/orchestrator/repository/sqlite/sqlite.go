@@ -0,0 +1,1137 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"math"
+	_ "modernc.org/sqlite"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var _ repository.Repository = (*Repository)(nil)
+
+// Время в SQLite хранится в миллисекундах Unix.
+const now = `CAST(unixepoch('subsec') * 1000 AS INTEGER)`
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+	return err
+}
+
+type Repository struct {
+	repository.Broadcaster
+	db      *sql.DB
+	cache   config.Cache
+	orderBy string
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+// Те же политики, что и в postgres.
+var policies = map[string]string{
+	"fifo":          `expression_id, created_at`,
+	"critical_path": `critical_path + (` + now + ` - created_at) DESC, expression_id`,
+	"sjf":           `(SELECT remaining_cost FROM expressions e WHERE e.id = tasks.expression_id), expression_id`,
+}
+
+// Open открывает файл БД по DATABASE_URL вида sqlite://path.
+// Соединение одно: SQLite всё равно пишет последовательно, а так не бывает SQLITE_BUSY.
+func Open(url string) (*sql.DB, error) {
+	path := strings.TrimPrefix(url, "sqlite://")
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, db.Ping()
+}
+
+func NewRepository(db *sql.DB, cache config.Cache, scheduler config.Scheduler) (*Repository, error) {
+	orderBy, ok := policies[scheduler.Policy]
+	if !ok {
+		return nil, fmt.Errorf("неизвестная политика планировщика: %s", scheduler.Policy)
+	}
+	if scheduler.Aging > 0 {
+		orderBy = fmt.Sprintf(`MIN(%d, priority + (%s - created_at) / %d) DESC, `,
+			models.PriorityHigh, now, scheduler.Aging.Milliseconds()) + orderBy
+	} else {
+		orderBy = `priority DESC, ` + orderBy
+	}
+	return &Repository{db: db, cache: cache, orderBy: orderBy}, nil
+}
+
+const expressionColumns = `id, status, COALESCE(result, ''), COALESCE(callback_url, ''), COALESCE(external_ref, ''), priority, created_at, started_at, finished_at`
+
+func msTime(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+	t := time.UnixMilli(ms.Int64)
+	return &t
+}
+
+func (r *Repository) Get(ctx context.Context, userID, key int) (models.Expressions, error) {
+	res := models.Expressions{}
+	var priority int
+	var createdAt int64
+	var startedAt, finishedAt sql.NullInt64
+	q := `SELECT ` + expressionColumns + ` FROM expressions WHERE id = ? AND user_id = ?`
+	err := r.db.QueryRowContext(ctx, q, key, userID).Scan(&res.ID, &res.Status, &res.Result, &res.CallbackURL, &res.ExternalRef, &priority, &createdAt,
+		&startedAt, &finishedAt)
+	res.Priority = models.PriorityName(priority)
+	res.CreatedAt = time.UnixMilli(createdAt)
+	res.StartedAt, res.FinishedAt = msTime(startedAt), msTime(finishedAt)
+	return res, notFound(err)
+}
+
+func (r *Repository) Set(ctx context.Context, value models.Expressions) (int64, error) {
+	if value.Result == nil {
+		q := `INSERT INTO expressions(status, created_at) VALUES(?, ` + now + `) RETURNING id`
+		var id int64
+		err := r.db.QueryRowContext(ctx, q, value.Status).Scan(&id)
+		return id, err
+	}
+	q := `UPDATE expressions
+		SET status = ?2, result = ?3, main_task_id = NULL, started_at = COALESCE(started_at, ` + now + `), finished_at = ` + now + `
+		WHERE id = ?1 AND status IN (` + repository.StatusesTo(value.Status) + `)`
+	res, err := r.db.ExecContext(ctx, q, value.ID, value.Status, value.Result)
+	if err != nil {
+		return value.ID, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = repository.ErrInvalidTransition
+	}
+	return value.ID, err
+}
+
+// listFilters - условия WHERE по фильтрам ListQuery, без курсора страницы.
+func listFilters(userID int, lq repository.ListQuery) ([]string, []any) {
+	where := []string{"user_id = ?"}
+	args := []any{userID}
+	add := func(cond string, values ...any) {
+		where = append(where, cond)
+		args = append(args, values...)
+	}
+	if lq.Status != "" {
+		add("status = ?", lq.Status)
+	}
+	if !lq.CreatedFrom.IsZero() {
+		add("created_at >= ?", lq.CreatedFrom.UnixMilli())
+	}
+	if !lq.CreatedTo.IsZero() {
+		add("created_at < ?", lq.CreatedTo.UnixMilli())
+	}
+	if lq.Search != "" {
+		add("instr(expression, ?) > 0", lq.Search)
+	}
+	return where, args
+}
+
+func listQuery(userID int, lq repository.ListQuery) (string, []any) {
+	where, args := listFilters(userID, lq)
+	add := func(cond string, values ...any) {
+		where = append(where, cond)
+		args = append(args, values...)
+	}
+	sort := repository.Sorts[lq.Sort]
+	cmp, dir := ">", "ASC"
+	if sort.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if lq.After != nil {
+		if sort.Column == "created_at" {
+			add("(created_at, id) "+cmp+" (?, ?)", lq.After.CreatedAt.UnixMilli(), lq.After.ID)
+		} else {
+			add("id "+cmp+" ?", lq.After.ID)
+		}
+	}
+	order := "id " + dir
+	if sort.Column == "created_at" {
+		order = "created_at " + dir + ", " + order
+	}
+	args = append(args, lq.PageSize()+1)
+	q := `SELECT ` + expressionColumns + ` FROM expressions WHERE ` +
+		strings.Join(where, " AND ") + ` ORDER BY ` + order + ` LIMIT ?`
+	return q, args
+}
+
+func (r *Repository) GetAll(ctx context.Context, userID int, lq repository.ListQuery) ([]models.Expressions, string, error) {
+	var res []models.Expressions
+	q, args := listQuery(userID, lq)
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return []models.Expressions{}, "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e models.Expressions
+		var priority int
+		var createdAt int64
+		var startedAt, finishedAt sql.NullInt64
+		if err = rows.Scan(&e.ID, &e.Status, &e.Result, &e.CallbackURL, &e.ExternalRef, &priority, &createdAt, &startedAt, &finishedAt); err != nil {
+			return []models.Expressions{}, "", err
+		}
+		e.Priority = models.PriorityName(priority)
+		e.CreatedAt = time.UnixMilli(createdAt)
+		e.StartedAt, e.FinishedAt = msTime(startedAt), msTime(finishedAt)
+		res = append(res, e)
+	}
+	if err = rows.Err(); err != nil {
+		return []models.Expressions{}, "", err
+	}
+	res, next := repository.Page(res, lq.PageSize())
+	return res, next, nil
+}
+
+// exportPage - размер страницы выгрузки. Соединение с базой одно, поэтому выгрузка читает
+// страницами по id и не держит его, пока клиент принимает ответ.
+const exportPage = 500
+
+func (r *Repository) Export(ctx context.Context, userID int, lq repository.ListQuery, fn func(models.ExportRow) error) error {
+	where, args := listFilters(userID, lq)
+	q := `SELECT id, expression, COALESCE(external_ref, ''), status, result, created_at, started_at, finished_at FROM expressions
+		WHERE ` + strings.Join(where, " AND ") + ` AND id > ? ORDER BY id LIMIT ?`
+	var after int64
+	for {
+		page, err := r.exportPage(ctx, q, slices.Concat(args, []any{after, exportPage}))
+		if err != nil {
+			return err
+		}
+		for _, e := range page {
+			if err = fn(e); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPage {
+			return nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+func (r *Repository) exportPage(ctx context.Context, q string, args []any) ([]models.ExportRow, error) {
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []models.ExportRow
+	for rows.Next() {
+		var e models.ExportRow
+		var createdAt int64
+		var startedAt, finishedAt sql.NullInt64
+		if err = rows.Scan(&e.ID, &e.Expression, &e.ExternalRef, &e.Status, &e.Result, &createdAt, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.UnixMilli(createdAt)
+		e.StartedAt, e.FinishedAt = msTime(startedAt), msTime(finishedAt)
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) SetWithExpression(ctx context.Context, userID int, value models.Expressions, expression string) (int, error) {
+	ids, err := r.SetBatch(ctx, userID, []models.Expressions{value}, []string{expression})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (r *Repository) SetBatch(ctx context.Context, userID int, values []models.Expressions, expressions []string) ([]int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	q := `INSERT INTO expressions(status, expression, priority, user_id, callback_url, external_ref, created_at)
+		VALUES(?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ` + now + `) RETURNING id`
+	ids := make([]int, len(values))
+	for i, value := range values {
+		priority, ok := models.ParsePriority(value.Priority)
+		if !ok {
+			return nil, calc.ErrInvalidPriority
+		}
+		if err = tx.QueryRowContext(ctx, q, value.Status, expressions[i], priority, userID, value.CallbackURL, value.ExternalRef).Scan(&ids[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+func (r *Repository) CreateSweep(ctx context.Context, userID int, template, priority string, expressions []string, values []map[string]float64) (int, []int, error) {
+	p, ok := models.ParsePriority(priority)
+	if !ok {
+		return 0, nil, calc.ErrInvalidPriority
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	var sweepID int
+	q := `INSERT INTO sweeps(expression, user_id) VALUES(?, ?) RETURNING id`
+	if err = tx.QueryRowContext(ctx, q, template, userID).Scan(&sweepID); err != nil {
+		return 0, nil, err
+	}
+	q = `INSERT INTO expressions(status, expression, priority, sweep_id, sweep_values, user_id, created_at)
+		VALUES('pending', ?, ?, ?, ?, ?, ` + now + `) RETURNING id`
+	ids := make([]int, len(expressions))
+	for i, expression := range expressions {
+		sweepValues, err := json.Marshal(values[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		if err = tx.QueryRowContext(ctx, q, expression, p, sweepID, string(sweepValues), userID).Scan(&ids[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	return sweepID, ids, tx.Commit()
+}
+
+func (r *Repository) GetSweep(ctx context.Context, userID, id int) (models.Sweep, error) {
+	sweep := models.Sweep{ID: id, Status: models.StatusDone}
+	q := `SELECT expression FROM sweeps WHERE id = ? AND user_id = ?`
+	if err := r.db.QueryRowContext(ctx, q, id, userID).Scan(&sweep.Expression); err != nil {
+		return sweep, notFound(err)
+	}
+	q = `SELECT id, status, result, sweep_values FROM expressions WHERE sweep_id = ? ORDER BY id`
+	rows, err := r.db.QueryContext(ctx, q, id)
+	if err != nil {
+		return sweep, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row models.SweepRow
+		var values string
+		if err = rows.Scan(&row.ID, &row.Status, &row.Result, &values); err != nil {
+			return sweep, err
+		}
+		if err = json.Unmarshal([]byte(values), &row.Values); err != nil {
+			return sweep, err
+		}
+		sweep.Total++
+		if row.Status.Active() {
+			sweep.Status = models.StatusRunning
+		} else {
+			sweep.Done++
+		}
+		sweep.Results = append(sweep.Results, row)
+	}
+	if sweep.Status.Active() {
+		sweep.Results = nil
+	}
+	return sweep, rows.Err()
+}
+
+func (r *Repository) GetExpression(ctx context.Context, userID, id int) (string, error) {
+	q := `SELECT COALESCE(expression, '') FROM expressions WHERE id = ? AND user_id = ?`
+	var expression string
+	err := r.db.QueryRowContext(ctx, q, id, userID).Scan(&expression)
+	return expression, notFound(err)
+}
+
+func (r *Repository) CreateUser(ctx context.Context, login, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	q := `INSERT INTO users(login, password_hash) VALUES(?, ?)`
+	_, err = r.db.ExecContext(ctx, q, login, string(hash))
+	return err
+}
+
+// VerifyUser возвращает rowid пользователя: отдельной колонки id в SQLite нет.
+func (r *Repository) VerifyUser(ctx context.Context, login, password string) (int, bool, error) {
+	var id int
+	var dbHash string
+	q := `SELECT rowid, password_hash FROM users WHERE login = ?`
+	if err := r.db.QueryRowContext(ctx, q, login).Scan(&id, &dbHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(dbHash), []byte(password))
+	return id, err == nil, nil
+}
+
+func (r *Repository) SaveTasks(ctx context.Context, tasks []*models.Task, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	q := `INSERT INTO tasks(id, expression_id, operation, arg1, arg2, left_id, right_id, cost, critical_path, priority,
+			plan_left_id, plan_right_id)
+		VALUES(?, ?, ?, ?, ?, ?6, ?7, ?, ?, (SELECT priority FROM expressions WHERE id = ?2), ?6, ?7)`
+	for _, task := range tasks {
+		_, err = tx.ExecContext(ctx, q, task.ID, id, task.Operation, task.Arg1, task.Arg2, task.LeftID, task.RightID,
+			task.OperationTime.Milliseconds(), task.CriticalPath.Milliseconds())
+		if err != nil {
+			return err
+		}
+	}
+	q = `UPDATE expressions
+		SET main_task_id = ?1,
+			remaining_cost = (SELECT COALESCE(sum(cost), 0) FROM tasks WHERE expression_id = ?2 AND state IN ('pending', 'leased'))
+		WHERE id = ?2 AND main_task_id IS NULL AND status = 'pending'`
+	res, err := tx.ExecContext(ctx, q, tasks[len(tasks)-1].ID, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return repository.ErrAlreadyPlanned
+	}
+	return r.commitReady(tx)
+}
+
+// commitReady коммитит транзакцию, после которой могли появиться готовые задачи,
+// и будит диспетчеров. LISTEN/NOTIFY нет, да и оркестратор с файлом БД работает один.
+func (r *Repository) commitReady(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.Notify()
+	return nil
+}
+
+func resolveTask(ctx context.Context, tx *sql.Tx, id uuid.UUID, result float64) error {
+	resStr := strconv.FormatFloat(result, 'f', 2, 64)
+	q := `UPDATE expressions
+		SET status = 'done', result = ?2, started_at = COALESCE(started_at, ` + now + `), finished_at = ` + now + `
+		WHERE main_task_id = ?1 AND status IN (` + repository.StatusesTo(models.StatusDone) + `)`
+	_, err := tx.ExecContext(ctx, q, id, resStr)
+	if err != nil {
+		return err
+	}
+	q = `UPDATE expressions SET remaining_cost = remaining_cost - (SELECT cost FROM tasks WHERE id = ?1)
+		WHERE id = (SELECT expression_id FROM tasks WHERE id = ?1)`
+	if _, err = tx.ExecContext(ctx, q, id); err != nil {
+		return err
+	}
+	q = `UPDATE tasks SET result = ?2, state = 'done', completed_at = ` + now + `, lease_until = NULL, stream_id = NULL WHERE id = ?1`
+	_, err = tx.ExecContext(ctx, q, id, result)
+	if err != nil {
+		return err
+	}
+	q = `UPDATE tasks
+		SET arg1     = CASE WHEN left_id = ?1 THEN ?2 ELSE arg1 END,
+			arg2     = CASE WHEN right_id = ?1 THEN ?2 ELSE arg2 END,
+			left_id  = NULLIF(left_id, ?1),
+			right_id = NULLIF(right_id, ?1)
+		WHERE left_id = ?1 OR right_id = ?1`
+	_, err = tx.ExecContext(ctx, q, id, result)
+	return err
+}
+
+// failTask роняет выражение с ошибкой вычисления задачи и снимает остальные его задачи.
+func failTask(ctx context.Context, tx *sql.Tx, task *models.Task) error {
+	q := `UPDATE tasks SET state = 'failed', completed_at = ` + now + `, lease_until = NULL, stream_id = NULL WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, q, task.ID); err != nil {
+		return err
+	}
+	q = `UPDATE expressions
+		SET status = 'failed', result = ?2, main_task_id = NULL, started_at = COALESCE(started_at, ` + now + `), finished_at = ` + now + `
+		WHERE id = ?1 AND status IN (` + repository.StatusesTo(models.StatusFailed) + `)`
+	if _, err := tx.ExecContext(ctx, q, task.ExpressionID, task.Error); err != nil {
+		return err
+	}
+	_, err := cancelTasks(ctx, tx, task.ExpressionID)
+	return err
+}
+
+func (r *Repository) UpdateTask(ctx context.Context, task *models.Task) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Ключ кэша берём из сохранённой задачи: операции и аргументам от агента верить нельзя.
+	stored := models.Task{ID: task.ID}
+	var ready bool
+	q := `SELECT expression_id, operation, COALESCE(arg1, 0), COALESCE(arg2, 0), left_id IS NULL AND right_id IS NULL
+		FROM tasks WHERE id = ? AND state IN ('pending', 'leased')`
+	err = tx.QueryRowContext(ctx, q, task.ID).Scan(&task.ExpressionID, &stored.Operation, &stored.Arg1, &stored.Arg2, &ready)
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrTaskDiscarded
+	}
+	if err != nil {
+		return err
+	}
+	if task.Error != "" {
+		if err = failTask(ctx, tx, task); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err = resolveTask(ctx, tx, task.ID, task.Result); err != nil {
+		return err
+	}
+	if ready {
+		stored.Result = task.Result
+		if err = r.cacheResult(ctx, tx, &stored); err != nil {
+			return err
+		}
+	}
+	return r.commitReady(tx)
+}
+
+func (r *Repository) cacheResult(ctx context.Context, tx *sql.Tx, task *models.Task) error {
+	if r.cache.Size <= 0 || math.IsInf(task.Result, 0) || math.IsNaN(task.Result) {
+		return nil
+	}
+	q := `INSERT INTO task_cache(operation, arg1, arg2, result) VALUES(?, ?, ?, ?)
+		ON CONFLICT (operation, arg1, arg2) DO UPDATE SET result = excluded.result, created_at = ` + now
+	_, err := tx.ExecContext(ctx, q, task.Operation, task.Arg1, task.Arg2, task.Result)
+	return err
+}
+
+func (r *Repository) TrimCache(ctx context.Context) (int64, error) {
+	if r.cache.Size <= 0 {
+		return 0, nil
+	}
+	q := `DELETE FROM task_cache WHERE created_at < ` + now + ` - ?`
+	expired, err := r.db.ExecContext(ctx, q, r.cache.TTL.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	q = `DELETE FROM task_cache WHERE rowid IN (SELECT rowid FROM task_cache ORDER BY created_at DESC LIMIT -1 OFFSET ?)`
+	evicted, err := r.db.ExecContext(ctx, q, r.cache.Size)
+	if err != nil {
+		return 0, err
+	}
+	n, err := expired.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	m, err := evicted.RowsAffected()
+	return n + m, err
+}
+
+func (r *Repository) fromCache(ctx context.Context, tx *sql.Tx, task models.Task) (bool, error) {
+	if r.cache.Size <= 0 {
+		return false, nil
+	}
+	var result float64
+	q := `SELECT result FROM task_cache
+		WHERE operation = ? AND arg1 = ? AND arg2 = ? AND created_at >= ` + now + ` - ?`
+	err := tx.QueryRowContext(ctx, q, task.Operation, task.Arg1, task.Arg2, r.cache.TTL.Milliseconds()).Scan(&result)
+	if errors.Is(err, sql.ErrNoRows) {
+		r.misses.Add(1)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = resolveTask(ctx, tx, task.ID, result); err != nil {
+		return false, err
+	}
+	r.hits.Add(1)
+	return true, nil
+}
+
+func (r *Repository) CacheStats(ctx context.Context) (models.CacheStats, error) {
+	stats := models.CacheStats{Hits: r.hits.Load(), Misses: r.misses.Load()}
+	q := `SELECT count(*) FROM task_cache`
+	err := r.db.QueryRowContext(ctx, q).Scan(&stats.Size)
+	return stats, err
+}
+
+func (r *Repository) GetTask(ctx context.Context, lease repository.Lease) (models.Task, error) {
+	for {
+		task, hit, err := r.leaseTask(ctx, lease)
+		if err != nil || !hit {
+			return task, err
+		}
+	}
+}
+
+// leaseTask - как в postgres, только SKIP LOCKED не нужен: соединение одно,
+// и транзакции и так идут друг за другом.
+func (r *Repository) leaseTask(ctx context.Context, lease repository.Lease) (models.Task, bool, error) {
+	var task models.Task
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return task, false, err
+	}
+	defer tx.Rollback()
+	q := `SELECT id, expression_id, operation, arg1, arg2 FROM tasks
+		WHERE left_id IS NULL AND right_id IS NULL AND state = 'pending'
+		ORDER BY ` + r.orderBy + ` LIMIT 1`
+	err = tx.QueryRowContext(ctx, q).Scan(&task.ID, &task.ExpressionID, &task.Operation, &task.Arg1, &task.Arg2)
+	if err != nil {
+		return task, false, notFound(err)
+	}
+	hit, err := r.fromCache(ctx, tx, task)
+	if err != nil {
+		return task, false, err
+	}
+	if !hit {
+		q = `UPDATE tasks
+			SET state = 'leased', lease_until = ` + now + ` + ?, stream_id = ?, dispatched_at = ` + now + `, agent_id = ?
+			WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, q, lease.TTL.Milliseconds(), lease.Stream, lease.Agent, task.ID); err != nil {
+			return task, false, err
+		}
+		q = `UPDATE expressions
+			SET started_at = COALESCE(started_at, ` + now + `), status = CASE WHEN status = 'pending' THEN 'running' ELSE status END
+			WHERE id = ?`
+		if _, err = tx.ExecContext(ctx, q, task.ExpressionID); err != nil {
+			return task, false, err
+		}
+	}
+	if hit {
+		return task, hit, r.commitReady(tx)
+	}
+	return task, hit, tx.Commit()
+}
+
+func (r *Repository) RequeueExpired(ctx context.Context) ([]uuid.UUID, error) {
+	q := `UPDATE tasks SET state = 'pending', lease_until = NULL, stream_id = NULL
+		WHERE state = 'leased' AND lease_until < ` + now + ` RETURNING id`
+	return r.requeue(ctx, q)
+}
+
+func (r *Repository) ReleaseStream(ctx context.Context, stream string) ([]uuid.UUID, error) {
+	q := `UPDATE tasks SET state = 'pending', lease_until = NULL, stream_id = NULL
+		WHERE state = 'leased' AND stream_id = ? RETURNING id`
+	return r.requeue(ctx, q, stream)
+}
+
+func (r *Repository) requeue(ctx context.Context, q string, args ...any) ([]uuid.UUID, error) {
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if len(ids) > 0 {
+		r.Notify()
+	}
+	return ids, err
+}
+
+func (r *Repository) GetTaskTimings(ctx context.Context, userID, id int) ([]models.TaskTiming, error) {
+	q := `SELECT t.id, t.operation, COALESCE(t.agent_id, ''), t.created_at, t.dispatched_at, t.completed_at
+		FROM tasks t JOIN expressions e ON e.id = t.expression_id
+		WHERE e.id = ? AND e.user_id = ?
+		ORDER BY t.created_at, t.dispatched_at IS NULL, t.dispatched_at`
+	rows, err := r.db.QueryContext(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []models.TaskTiming{}
+	for rows.Next() {
+		var t models.TaskTiming
+		var createdAt int64
+		var dispatchedAt, completedAt sql.NullInt64
+		if err = rows.Scan(&t.ID, &t.Operation, &t.Agent, &createdAt, &dispatchedAt, &completedAt); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = time.UnixMilli(createdAt)
+		t.DispatchedAt, t.CompletedAt = msTime(dispatchedAt), msTime(completedAt)
+		t.SetDurations()
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) GetExpressionTasks(ctx context.Context, id int) ([]models.Task, error) {
+	q := `SELECT id, operation, left_id, right_id FROM tasks WHERE expression_id = ? AND state IN ('pending', 'leased')`
+	rows, err := r.db.QueryContext(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []models.Task
+	for rows.Next() {
+		task := models.Task{ExpressionID: id}
+		if err = rows.Scan(&task.ID, &task.Operation, &task.LeftID, &task.RightID); err != nil {
+			return nil, err
+		}
+		res = append(res, task)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) GetPlanTasks(ctx context.Context, id int) ([]models.Task, error) {
+	q := `WITH RECURSIVE plan AS (
+			SELECT t.id, t.operation, t.arg1, t.arg2, t.plan_left_id, t.plan_right_id, t.cost
+			FROM tasks t JOIN expressions e ON e.main_task_id = t.id
+			WHERE e.id = ?
+			UNION
+			SELECT t.id, t.operation, t.arg1, t.arg2, t.plan_left_id, t.plan_right_id, t.cost
+			FROM tasks t JOIN plan p ON t.id IN (p.plan_left_id, p.plan_right_id)
+		)
+		SELECT id, operation, arg1, arg2, plan_left_id, plan_right_id, cost FROM plan`
+	rows, err := r.db.QueryContext(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []models.Task
+	for rows.Next() {
+		task := models.Task{ExpressionID: id}
+		var cost int64
+		err = rows.Scan(&task.ID, &task.Operation, &task.Arg1, &task.Arg2, &task.LeftID, &task.RightID, &cost)
+		if err != nil {
+			return nil, err
+		}
+		task.OperationTime = time.Duration(cost) * time.Millisecond
+		res = append(res, task)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) GetQueue(ctx context.Context, exceptID int) (map[string]int, error) {
+	q := `SELECT operation, count(*) FROM tasks
+		WHERE left_id IS NULL AND right_id IS NULL AND state IN ('pending', 'leased') AND expression_id <> ?
+		GROUP BY operation`
+	rows, err := r.db.QueryContext(ctx, q, exceptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]int)
+	for rows.Next() {
+		var operation string
+		var cnt int
+		if err = rows.Scan(&operation, &cnt); err != nil {
+			return nil, err
+		}
+		res[operation] = cnt
+	}
+	return res, rows.Err()
+}
+
+func deleteTasks(ctx context.Context, tx *sql.Tx, id int) ([]uuid.UUID, error) {
+	rows, err := tx.QueryContext(ctx, `DELETE FROM tasks WHERE expression_id = ? RETURNING id`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+// cancelTasks удаляет ждущие задачи выражения, а выданные агентам помечает отменёнными: их результат
+// отбросится, а сами они останутся в истории.
+func cancelTasks(ctx context.Context, tx *sql.Tx, id int) ([]uuid.UUID, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tasks WHERE expression_id = ? AND state = 'pending'`, id); err != nil {
+		return nil, err
+	}
+	q := `UPDATE tasks SET state = 'cancelled', lease_until = NULL, stream_id = NULL
+		WHERE expression_id = ? AND state = 'leased' RETURNING id`
+	rows, err := tx.QueryContext(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+func scanIDs(rows *sql.Rows) ([]uuid.UUID, error) {
+	defer rows.Close()
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var taskID uuid.UUID
+		if err := rows.Scan(&taskID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, taskID)
+	}
+	return ids, rows.Err()
+}
+
+func (r *Repository) Cancel(ctx context.Context, userID, id int) ([]uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var status models.Status
+	q := `SELECT status FROM expressions WHERE id = ? AND user_id = ?`
+	if err = tx.QueryRowContext(ctx, q, id, userID).Scan(&status); err != nil {
+		return nil, notFound(err)
+	}
+	if !status.CanTransition(models.StatusCancelled) {
+		return nil, repository.ErrNotRunning
+	}
+	q = `UPDATE expressions SET status = 'cancelled', main_task_id = NULL, finished_at = ` + now + ` WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, q, id); err != nil {
+		return nil, err
+	}
+	// Посчитанные и выданные агентам задачи остаются в истории выражения, результат выданных отбросится.
+	ids, err := cancelTasks(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+func (r *Repository) Retry(ctx context.Context, userID, id int, stuckAfter time.Duration) (string, []uuid.UUID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+	var status models.Status
+	var expression string
+	var stuck bool
+	q := `SELECT status, COALESCE(expression, ''), attempt_started_at < ` + now + ` - ?2
+		FROM expressions WHERE id = ?1 AND user_id = ?3`
+	err = tx.QueryRowContext(ctx, q, id, stuckAfter.Milliseconds(), userID).Scan(&status, &expression, &stuck)
+	if err != nil {
+		return "", nil, notFound(err)
+	}
+	if status != models.StatusFailed && !(status.Active() && stuck) {
+		return "", nil, repository.ErrNotRetryable
+	}
+	q = `INSERT INTO expression_attempts(expression_id, attempt, status, result, started_at)
+		SELECT id, attempt, status, result, attempt_started_at FROM expressions WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, q, id); err != nil {
+		return "", nil, err
+	}
+	q = `UPDATE expressions
+		SET status = 'pending', result = NULL, main_task_id = NULL, attempt = attempt + 1, attempt_started_at = ` + now + `,
+			started_at = NULL, finished_at = NULL
+		WHERE id = ?`
+	if _, err = tx.ExecContext(ctx, q, id); err != nil {
+		return "", nil, err
+	}
+	ids, err := deleteTasks(ctx, tx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	return expression, ids, tx.Commit()
+}
+
+func (r *Repository) ClaimUnplanned(ctx context.Context, stuckAfter time.Duration, limit int) ([]int, []string, error) {
+	q := `UPDATE expressions SET attempt_started_at = ` + now + `
+		WHERE id IN (
+			SELECT id FROM expressions
+			WHERE status = 'pending' AND main_task_id IS NULL AND attempt_started_at < ` + now + ` - ?
+			ORDER BY id LIMIT ?
+		)
+		RETURNING id, COALESCE(expression, '')`
+	rows, err := r.db.QueryContext(ctx, q, stuckAfter.Milliseconds(), limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	var expressions []string
+	for rows.Next() {
+		var id int
+		var expression string
+		if err = rows.Scan(&id, &expression); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		expressions = append(expressions, expression)
+	}
+	return ids, expressions, rows.Err()
+}
+
+func (r *Repository) GetAttempts(ctx context.Context, userID, id int) ([]models.Attempt, error) {
+	q := `SELECT a.attempt, a.status, a.result, a.started_at, a.finished_at
+		FROM expression_attempts a JOIN expressions e ON e.id = a.expression_id
+		WHERE e.id = ? AND e.user_id = ? ORDER BY a.attempt`
+	rows, err := r.db.QueryContext(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []models.Attempt{}
+	for rows.Next() {
+		var a models.Attempt
+		var startedAt, finishedAt int64
+		if err = rows.Scan(&a.Attempt, &a.Status, &a.Result, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+		a.StartedAt = time.UnixMilli(startedAt)
+		a.FinishedAt = time.UnixMilli(finishedAt)
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) Purge(ctx context.Context, rule config.RetentionRule) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	cutoff := time.Now().Add(-rule.After).UnixMilli()
+	where := `status = ? AND COALESCE(finished_at, created_at) < ?`
+	q := `DELETE FROM tasks WHERE expression_id IN (SELECT id FROM expressions WHERE ` + where + `)`
+	if _, err = tx.ExecContext(ctx, q, rule.Status, cutoff); err != nil {
+		return 0, err
+	}
+	if rule.Archive {
+		q = `INSERT INTO expressions_archive(id, user_id, status, result, expression, priority, created_at, started_at, finished_at)
+			SELECT id, user_id, status, result, expression, priority, created_at, started_at, finished_at
+			FROM expressions WHERE ` + where
+		if _, err = tx.ExecContext(ctx, q, rule.Status, cutoff); err != nil {
+			return 0, err
+		}
+	}
+	q = `DELETE FROM expressions WHERE ` + where
+	res, err := tx.ExecContext(ctx, q, rule.Status, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (r *Repository) GetEvents(ctx context.Context, userID, id int) ([]models.Event, error) {
+	q := `SELECT ev.id, ev.type, ev.task_id, COALESCE(ev.agent_id, ''), COALESCE(ev.detail, ''), ev.created_at
+		FROM expression_events ev JOIN expressions e ON e.id = ev.expression_id
+		WHERE e.id = ? AND e.user_id = ? ORDER BY ev.id`
+	rows, err := r.db.QueryContext(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []models.Event{}
+	for rows.Next() {
+		var e models.Event
+		var createdAt int64
+		if err = rows.Scan(&e.ID, &e.Type, &e.TaskID, &e.Agent, &e.Detail, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.UnixMilli(createdAt)
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) WebhookSecret(ctx context.Context, userID int) (string, error) {
+	secret, err := repository.NewWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	q := `UPDATE users SET webhook_secret = COALESCE(webhook_secret, ?2) WHERE rowid = ?1 RETURNING webhook_secret`
+	err = r.db.QueryRowContext(ctx, q, userID, secret).Scan(&secret)
+	return secret, notFound(err)
+}
+
+// ClaimWebhooks - соединение одно, поэтому хватает обычной транзакции без блокировок строк.
+func (r *Repository) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]models.Webhook, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	q := `UPDATE webhook_outbox
+		SET attempts = attempts + 1, next_attempt_at = ` + now + ` + ?2
+		WHERE id IN (
+			SELECT id FROM webhook_outbox
+			WHERE state = 'pending' AND next_attempt_at <= ` + now + `
+			ORDER BY next_attempt_at LIMIT ?1
+		)
+		RETURNING id, expression_id, url, payload, attempts, user_id`
+	rows, err := tx.QueryContext(ctx, q, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	var res []models.Webhook
+	var users []sql.NullInt64
+	for rows.Next() {
+		var w models.Webhook
+		var payload string
+		var userID sql.NullInt64
+		if err = rows.Scan(&w.ID, &w.ExpressionID, &w.URL, &payload, &w.Attempt, &userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		w.Payload = []byte(payload)
+		res = append(res, w)
+		users = append(users, userID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	q = `SELECT COALESCE(webhook_secret, '') FROM users WHERE rowid = ?`
+	for i, userID := range users {
+		if !userID.Valid {
+			continue
+		}
+		err = tx.QueryRowContext(ctx, q, userID.Int64).Scan(&res[i].Secret)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	return res, tx.Commit()
+}
+
+func (r *Repository) RecordDelivery(ctx context.Context, d models.WebhookDelivery, retryAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	q := `INSERT INTO webhook_deliveries(webhook_id, attempt, status_code, error, duration_ms, created_at)
+		VALUES(?, ?, NULLIF(?, 0), NULLIF(?, ''), ?, ` + now + `)`
+	if _, err = tx.ExecContext(ctx, q, d.WebhookID, d.Attempt, d.StatusCode, d.Error, d.DurationMs); err != nil {
+		return err
+	}
+	switch {
+	case d.Delivered():
+		q = `UPDATE webhook_outbox SET state = 'delivered' WHERE id = ?`
+		_, err = tx.ExecContext(ctx, q, d.WebhookID)
+	case retryAt.IsZero():
+		q = `UPDATE webhook_outbox SET state = 'failed' WHERE id = ?`
+		_, err = tx.ExecContext(ctx, q, d.WebhookID)
+	default:
+		q = `UPDATE webhook_outbox SET next_attempt_at = ?2 WHERE id = ?1`
+		_, err = tx.ExecContext(ctx, q, d.WebhookID, retryAt.UnixMilli())
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) GetWebhooks(ctx context.Context, userID, id int) ([]models.WebhookLog, error) {
+	q := `SELECT w.id, w.url, w.state, w.attempts, w.next_attempt_at, w.created_at
+		FROM webhook_outbox w JOIN expressions e ON e.id = w.expression_id
+		WHERE e.id = ? AND e.user_id = ? ORDER BY w.id`
+	rows, err := r.db.QueryContext(ctx, q, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	res := []models.WebhookLog{}
+	byID := map[int64]int{}
+	for rows.Next() {
+		var w models.WebhookLog
+		var next, createdAt int64
+		if err = rows.Scan(&w.ID, &w.URL, &w.State, &w.Attempts, &next, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if w.State == models.WebhookPending {
+			t := time.UnixMilli(next)
+			w.NextAttemptAt = &t
+		}
+		w.CreatedAt = time.UnixMilli(createdAt)
+		w.Deliveries = []models.WebhookDelivery{}
+		byID[w.ID] = len(res)
+		res = append(res, w)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	q = `SELECT d.webhook_id, d.attempt, COALESCE(d.status_code, 0), COALESCE(d.error, ''), d.duration_ms, d.created_at
+		FROM webhook_deliveries d JOIN webhook_outbox o ON o.id = d.webhook_id
+		WHERE o.expression_id = ? ORDER BY d.id`
+	rows, err = r.db.QueryContext(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var createdAt int64
+		if err = rows.Scan(&d.WebhookID, &d.Attempt, &d.StatusCode, &d.Error, &d.DurationMs, &createdAt); err != nil {
+			return nil, err
+		}
+		d.CreatedAt = time.UnixMilli(createdAt)
+		w := &res[byID[d.WebhookID]]
+		w.Deliveries = append(w.Deliveries, d)
+	}
+	return res, rows.Err()
+}
+
+func (r *Repository) CreateImport(ctx context.Context, userID int, filename string, total int) (int, error) {
+	q := `INSERT INTO imports(user_id, filename, total, created_at, updated_at) VALUES(?, NULLIF(?, ''), ?, ` + now + `, ` + now + `) RETURNING id`
+	var id int
+	err := r.db.QueryRowContext(ctx, q, userID, filename, total).Scan(&id)
+	return id, err
+}
+
+func (r *Repository) AddImportProgress(ctx context.Context, id, created int, errs []models.ImportError) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	q := `INSERT INTO import_errors(import_id, line, ref, error) VALUES(?, ?, NULLIF(?, ''), ?)`
+	for _, e := range errs {
+		if _, err = tx.ExecContext(ctx, q, id, e.Line, e.Ref, e.Error); err != nil {
+			return err
+		}
+	}
+	q = `UPDATE imports SET processed = processed + ?2 + ?3, created = created + ?2, failed = failed + ?3, updated_at = ` + now + `
+		WHERE id = ?1`
+	if _, err = tx.ExecContext(ctx, q, id, created, len(errs)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) FinishImport(ctx context.Context, id int, state string) error {
+	q := `UPDATE imports SET state = ?, finished_at = ` + now + ` WHERE id = ?`
+	_, err := r.db.ExecContext(ctx, q, state, id)
+	return err
+}
+
+func (r *Repository) FailStaleImports(ctx context.Context, stuckAfter time.Duration) (int64, error) {
+	q := `UPDATE imports SET state = 'failed', finished_at = ` + now + `
+		WHERE state = 'running' AND updated_at < ` + now + ` - ?`
+	res, err := r.db.ExecContext(ctx, q, stuckAfter.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *Repository) GetImport(ctx context.Context, userID, id int) (models.Import, error) {
+	res := models.Import{Errors: []models.ImportError{}}
+	var createdAt int64
+	var finishedAt sql.NullInt64
+	q := `SELECT id, COALESCE(filename, ''), state, total, processed, created, failed, created_at, finished_at
+		FROM imports WHERE id = ? AND user_id = ?`
+	err := r.db.QueryRowContext(ctx, q, id, userID).Scan(&res.ID, &res.Filename, &res.State, &res.Total, &res.Processed,
+		&res.Created, &res.Failed, &createdAt, &finishedAt)
+	if err != nil {
+		return res, notFound(err)
+	}
+	res.CreatedAt, res.FinishedAt = time.UnixMilli(createdAt), msTime(finishedAt)
+	q = `SELECT line, COALESCE(ref, ''), error FROM import_errors WHERE import_id = ? ORDER BY line`
+	rows, err := r.db.QueryContext(ctx, q, id)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e models.ImportError
+		if err = rows.Scan(&e.Line, &e.Ref, &e.Error); err != nil {
+			return res, err
+		}
+		res.Errors = append(res.Errors, e)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,36 @@
+package sqlite
+
+import (
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/repotest"
+	"github.com/pressly/goose/v3"
+	"path/filepath"
+	"testing"
+)
+
+func newRepo(t *testing.T, cache config.Cache, scheduler config.Scheduler) *Repository {
+	db, err := Open("sqlite://" + filepath.Join(t.TempDir(), "calc.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = goose.SetDialect("sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	goose.SetLogger(goose.NopLogger())
+	if err = goose.Up(db, "../../../../db/migrations/sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRepository(db, cache, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, cache config.Cache, scheduler config.Scheduler) repository.Repository {
+		return newRepo(t, cache, scheduler)
+	})
+}
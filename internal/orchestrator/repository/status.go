@@ -0,0 +1,16 @@
+package repository
+
+import (
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"strings"
+)
+
+// StatusesTo - список для SQL "status IN (...)": статусы, из которых разрешён переход в to.
+// Коды - константы models, поэтому их можно подставлять в запрос как есть.
+func StatusesTo(to models.Status) string {
+	var quoted []string
+	for _, s := range models.StatusesTo(to) {
+		quoted = append(quoted, "'"+string(s)+"'")
+	}
+	return strings.Join(quoted, ", ")
+}
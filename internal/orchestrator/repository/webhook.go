@@ -0,0 +1,15 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewWebhookSecret - случайный ключ HMAC для подписи вебхуков.
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
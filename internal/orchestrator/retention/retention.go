@@ -0,0 +1,59 @@
+package retention
+
+import (
+	"context"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Job чистит старые выражения по правилам RETENTION_RULES: по расписанию и по запросу админа.
+type Job struct {
+	r      repository.Repository
+	cfg    config.Retention
+	logger *zap.SugaredLogger
+	// Не даёт ручному запуску пересечься с плановым.
+	mux sync.Mutex
+}
+
+func NewJob(r repository.Repository, cfg config.Retention, logger *zap.SugaredLogger) *Job {
+	return &Job{r: r, cfg: cfg, logger: logger}
+}
+
+func (j *Job) Purge(ctx context.Context) ([]models.PurgeResult, error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	res := []models.PurgeResult{}
+	for _, rule := range j.cfg.Rules {
+		n, err := j.r.Purge(ctx, rule)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, models.PurgeResult{Status: rule.Status, Action: rule.Action(), Count: n})
+		if n > 0 {
+			j.logger.Infof("Чистка выражений: %s, %s: %d", rule.Status, rule.Action(), n)
+		}
+	}
+	return res, nil
+}
+
+func (j *Job) Run(ctx context.Context) {
+	if len(j.cfg.Rules) == 0 || j.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := j.Purge(ctx); err != nil {
+			j.logger.Errorf("Ошибка чистки выражений: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -5,16 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/eta"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
-	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/postgres"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
 	pb "github.com/Cool-Andrey/Calculating/pkg/api/proto"
-	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -25,75 +27,142 @@ type Server struct {
 	logger *zap.SugaredLogger
 	cfg    config.GRPCConfig
 	delay  config.Delay
-	r      *postgres.Repository
+	r      repository.Repository
+	est    *eta.Estimator
+	// Аренда задачи: запас на доставку плюс самая долгая операция.
+	leaseTTL time.Duration
+	// Задачи, отданные агентам и ещё не вернувшиеся, и канал отмены стрима, которому отдали.
+	inFlight map[uuid.UUID]chan uuid.UUID
+	mux      sync.Mutex
 }
 
-func NewServer(logger *zap.SugaredLogger, cfg *config.Config, r *postgres.Repository) *Server {
+func NewServer(logger *zap.SugaredLogger, cfg *config.Config, r repository.Repository, est *eta.Estimator) *Server {
 	grpcSrv := grpc.NewServer()
+	leaseTTL := cfg.GRPC.Lease
+	for _, d := range cfg.Delay {
+		leaseTTL = max(leaseTTL, cfg.GRPC.Lease+d)
+	}
 	srv := &Server{
-		server: grpcSrv,
-		logger: logger,
-		cfg:    cfg.GRPC,
-		delay:  cfg.Delay,
-		r:      r,
+		leaseTTL: leaseTTL,
+		server:   grpcSrv,
+		logger:   logger,
+		cfg:      cfg.GRPC,
+		delay:    cfg.Delay,
+		r:        r,
+		est:      est,
+		inFlight: make(map[uuid.UUID]chan uuid.UUID),
 	}
 	pb.RegisterOrchestratorServer(grpcSrv, srv)
 	return srv
 }
 
 func setOperationTime(task *models.Task, delay config.Delay) {
-	switch task.Operation {
-	case "+":
-		task.OperationTime = delay.Plus
-	case "-":
-		task.OperationTime = delay.Minus
-	case "*":
-		task.OperationTime = delay.Multiple
-	case "/":
-		task.OperationTime = delay.Divide
+	task.OperationTime = delay.Get(task.Operation)
+}
+
+func (s *Server) track(id uuid.UUID, cancelCh chan uuid.UUID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.inFlight[id] = cancelCh
+}
+
+func (s *Server) untrack(id uuid.UUID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.inFlight, id)
+}
+
+func (s *Server) untrackStream(cancelCh chan uuid.UUID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for id, ch := range s.inFlight {
+		if ch == cancelCh {
+			delete(s.inFlight, id)
+		}
 	}
 }
 
-func (s *Server) sendTask(ctx context.Context, stream grpc.BidiStreamingServer[pb.TaskWithResult, pb.Task]) error {
+func (s *Server) CancelTasks(ids []uuid.UUID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, id := range ids {
+		cancelCh, ok := s.inFlight[id]
+		if !ok {
+			continue
+		}
+		delete(s.inFlight, id)
+		select {
+		case cancelCh <- id:
+		default:
+			s.logger.Warnf("Не смог отправить агенту отмену задачи %s: канал переполнен", id)
+		}
+	}
+}
+
+func (s *Server) sendTask(ctx context.Context, stream grpc.BidiStreamingServer[pb.TaskWithResult, pb.Task], cancelCh chan uuid.UUID, lease repository.Lease, workers int) error {
 	ticker := time.NewTicker(s.cfg.Ping)
 	defer ticker.Stop()
+	ready, unsubscribe := s.r.Subscribe()
+	defer unsubscribe()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-ticker.C:
-			task, err := s.r.GetTask(ctx)
-			if errors.Is(err, pgx.ErrNoRows) {
-				continue
-			}
+		case id := <-cancelCh:
+			err := stream.Send(&pb.Task{
+				ID:     id.String(),
+				Cancel: true,
+			})
 			if err != nil {
-				s.logger.Errorf("Ошибка получения из СУБД задачи: %v", err)
+				s.logger.Errorf("Ошибка отправки отмены задачи: %v", err)
 				return err
 			}
-			if task.Arg2 == 0 && task.Operation == "/" {
-				errEvaluate := calc.ErrDivByZero.Error()
-				_, err = s.r.Set(ctx, models.Expressions{
-					ID:     int64(task.ExpressionID),
-					Status: "Ошибка",
-					Result: &errEvaluate,
-				})
+		case <-ready:
+			// Готовых задач могло стать много сразу: раздаём по одной на воркер агента.
+			for i := 0; i < workers; i++ {
+				sent, err := s.dispatch(ctx, stream, cancelCh, lease)
+				if err != nil {
+					return err
+				}
+				if !sent {
+					break
+				}
 			}
-			setOperationTime(&task, s.delay)
-			err = stream.Send(&pb.Task{
-				ID:            task.ID.String(),
-				Operation:     task.Operation,
-				Arg1:          task.Arg1,
-				Arg2:          task.Arg2,
-				OperationTime: task.OperationTime.Milliseconds(),
-			})
-			if err != nil {
-				s.logger.Errorf("Ошибка отправки задачи: %v", err)
+		case <-ticker.C:
+			// Опрос на случай потерянного сигнала.
+			if _, err := s.dispatch(ctx, stream, cancelCh, lease); err != nil {
 				return err
 			}
 		}
 	}
 }
 
+// dispatch отдаёт агенту одну готовую задачу. false - готовых задач нет.
+func (s *Server) dispatch(ctx context.Context, stream grpc.BidiStreamingServer[pb.TaskWithResult, pb.Task], cancelCh chan uuid.UUID, lease repository.Lease) (bool, error) {
+	task, err := s.r.GetTask(ctx, lease)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		s.logger.Errorf("Ошибка получения из СУБД задачи: %v", err)
+		return false, err
+	}
+	setOperationTime(&task, s.delay)
+	err = stream.Send(&pb.Task{
+		ID:            task.ID.String(),
+		Operation:     task.Operation,
+		Arg1:          task.Arg1,
+		Arg2:          task.Arg2,
+		OperationTime: task.OperationTime.Milliseconds(),
+	})
+	if err != nil {
+		s.logger.Errorf("Ошибка отправки задачи: %v", err)
+		return false, err
+	}
+	s.track(task.ID, cancelCh)
+	return true, nil
+}
+
 func (s *Server) getTask(ctx context.Context, stream grpc.BidiStreamingServer[pb.TaskWithResult, pb.Task]) error {
 	for {
 		select {
@@ -114,48 +183,120 @@ func (s *Server) getTask(ctx context.Context, stream grpc.BidiStreamingServer[pb
 				s.logger.Errorf("Ошибка преобразования string в uuid: %v", err)
 				return err
 			}
+			s.untrack(id)
 			task := &models.Task{
 				ID:        id,
 				Operation: msg.Operation,
 				Arg1:      msg.Arg1,
 				Arg2:      msg.Arg2,
 				Result:    msg.Result,
+				Error:     msg.Error,
 			}
 			err = s.r.UpdateTask(ctx, task)
+			if errors.Is(err, repository.ErrTaskDiscarded) {
+				s.logger.Debugf("Результат отменённой задачи %s отброшен", id)
+				continue
+			}
 			if err != nil {
 				s.logger.Errorf("Ошибка обновления задачи в СУБД: %v", err)
 				return err
 			}
-			err = s.r.RemoveTask(ctx, id)
-			if err != nil {
-				s.logger.Errorf("Ошибка удаления задачи в СУБД: %v", err)
-			}
 		}
 	}
 }
 
+func workersFromContext(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 1
+	}
+	values := md.Get("workers")
+	if len(values) == 0 {
+		return 1
+	}
+	workers, err := strconv.Atoi(values[0])
+	if err != nil || workers <= 0 {
+		return 1
+	}
+	return workers
+}
+
+// agentFromContext возвращает имя агента из метаданных, а для старых агентов - адрес соединения.
+func agentFromContext(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("agent"); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
 func (s *Server) GiveTakeTask(stream grpc.BidiStreamingServer[pb.TaskWithResult, pb.Task]) error {
 	ctx := stream.Context()
+	workers := workersFromContext(ctx)
+	s.est.AddWorkers(workers)
+	defer s.est.AddWorkers(-workers)
+	cancelCh := make(chan uuid.UUID, 64)
+	defer s.untrackStream(cancelCh)
+	lease := repository.Lease{Agent: agentFromContext(ctx), Stream: uuid.NewString(), TTL: s.leaseTTL}
+	defer s.release(context.WithoutCancel(ctx), lease.Stream)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	errCh := make(chan error)
+	// Стрим заканчивается, как только завершилась любая из сторон: чистый EOF от агента тоже конец.
+	errCh := make(chan error, 2)
 	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
-		errCh <- s.sendTask(ctx, stream)
+		errCh <- s.sendTask(ctx, stream, cancelCh, lease, workers)
 	}()
 	go func() {
-		wg.Add(1)
-		defer wg.Done()
 		errCh <- s.getTask(ctx, stream)
 	}()
-	for err := range errCh {
-		if err != nil {
-			return err
+	err := <-errCh
+	cancel()
+	// Ждём отправителя: после возврата он не должен отдавать задачи в уже освобождённый стрим.
+	// Получатель может висеть в Recv, он выйдет, когда gRPC закроет стрим после возврата.
+	wg.Wait()
+	return err
+}
+
+// release возвращает в очередь задачи закрывшегося стрима, не дожидаясь конца аренды.
+func (s *Server) release(ctx context.Context, stream string) {
+	ids, err := s.r.ReleaseStream(ctx, stream)
+	if err != nil {
+		s.logger.Errorf("Ошибка возврата задач стрима в очередь: %v", err)
+		return
+	}
+	if len(ids) > 0 {
+		s.logger.Infof("Стрим закрылся, вернул в очередь задач: %d", len(ids))
+	}
+}
+
+// Reap возвращает в очередь задачи с истёкшей арендой. Агенту, который их держал,
+// отправляется отмена: задачу посчитает кто-то другой.
+func (s *Server) Reap(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Ping)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ids, err := s.r.RequeueExpired(ctx)
+			if err != nil {
+				s.logger.Errorf("Ошибка возврата просроченных задач в очередь: %v", err)
+				continue
+			}
+			if len(ids) > 0 {
+				s.logger.Warnf("Аренда истекла, вернул в очередь задач: %d", len(ids))
+				s.CancelTasks(ids)
+			}
 		}
 	}
-	return nil
 }
 
 func (s *Server) Run() {
@@ -0,0 +1,92 @@
+package grpc
+
+import (
+	"context"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/eta"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
+	pb "github.com/Cool-Andrey/Calculating/pkg/api/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+// eventually ждёт, пока cond не станет верным, но не дольше секунды.
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestGiveTakeTaskClose(t *testing.T) {
+	ctx := context.Background()
+	r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{GRPC: config.GRPCConfig{Ping: 10 * time.Millisecond, Lease: time.Minute}}
+	est := eta.NewEstimator(r, cfg.Delay, cfg.GRPC.Ping)
+	s := NewServer(zap.NewNop().Sugar(), cfg, r, est)
+	lis := bufconn.Listen(1 << 20)
+	go s.server.Serve(lis)
+	t.Cleanup(s.server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	id, err := r.SetWithExpression(ctx, 1, models.Expressions{Status: models.StatusPending}, "2+2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &models.Task{ID: uuid.New(), Operation: "+", Arg1: 2, Arg2: 2}
+	if err = r.SaveTasks(ctx, []*models.Task{task}, id); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := pb.NewOrchestratorClient(conn).GiveTakeTask(metadata.AppendToOutgoingContext(ctx, "workers", "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := stream.Recv()
+	if err != nil || got.ID != task.ID.String() {
+		t.Fatalf("Ожидал задачу %s, получил %+v, %v", task.ID, got, err)
+	}
+	if est.Workers() != 3 {
+		t.Errorf("Ожидал 3 воркера на открытом стриме, получил %d", est.Workers())
+	}
+	// Агент закрывает стрим без ошибки: сервер должен всё за ним прибрать.
+	if err = stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return est.Workers() == 0 }) {
+		t.Errorf("Ожидал, что воркеры закрытого стрима не учитываются, получил %d", est.Workers())
+	}
+	if !eventually(func() bool {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		return len(s.inFlight) == 0
+	}) {
+		t.Error("Ожидал, что задачи закрытого стрима не ждут отмены")
+	}
+	other := repository.Lease{Agent: "test", Stream: "other", TTL: time.Minute}
+	if !eventually(func() bool {
+		leased, err := r.GetTask(ctx, other)
+		return err == nil && leased.ID == task.ID
+	}) {
+		t.Error("Ожидал, что задача закрытого стрима вернётся в очередь")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/background"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/transport/http/server/handler"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalcBatchHandler(t *testing.T) {
+	ctx := context.Background()
+	r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zap.NewNop().Sugar()
+	a := ast.NewAST(r, logger, &config.Config{Delay: config.Delay{"TIME_ADDITION_MS": time.Second}})
+	bg := background.New()
+	body := `{"expressions": [
+		{"expression": "2+2"},
+		{"expression": "2+"},
+		{"expression": "3+3", "priority": "urgent"},
+		{"expression": "4+4", "callback_url": "http://127.0.0.1/hook"},
+		{"expression": "5+5", "priority": "high"}
+	]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch", strings.NewReader(body))
+	req = req.WithContext(handler.WithUserID(req.Context(), 1))
+	w := httptest.NewRecorder()
+	handler.CalcBatchHandler(w, req, logger, a, r, bg, 10, false)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Ожидал код 201, получил %d: %s", w.Code, w.Body)
+	}
+	var res handler.BatchWr
+	if err = json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", calc.ErrInvalidOperands.Error(), calc.ErrInvalidPriority.Error(), calc.ErrPrivateCallback.Error(), ""}
+	if len(res.Results) != len(want) {
+		t.Fatalf("Ожидал %d результатов, получил %+v", len(want), res.Results)
+	}
+	for i, item := range res.Results {
+		if item.Err != want[i] || (item.Err == "") != (item.ID != 0) {
+			t.Errorf("Строка %d: ожидал ошибку %q и ID только без ошибки, получил %+v", i, want[i], item)
+		}
+	}
+	// Ошибочные строки не записываются: у пользователя только два выражения.
+	if all, _, err := r.GetAll(ctx, 1, repository.ListQuery{Limit: 10}); err != nil || len(all) != 2 {
+		t.Errorf("Ожидал два записанных выражения, получил %+v, %v", all, err)
+	}
+	if e, _ := r.Get(ctx, 1, res.Results[4].ID); e.Priority != "high" {
+		t.Errorf("Ожидал приоритет high, получил %+v", e)
+	}
+	// Задачи строятся в фоне после ответа.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		queue, err := r.GetQueue(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queue["+"] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Ожидал две задачи сложения в очереди, получил %v", queue)
+		}
+	}
+	if err = bg.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalcBatchHandlerTooLarge(t *testing.T) {
+	r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zap.NewNop().Sugar()
+	a := ast.NewAST(r, logger, &config.Config{})
+	body := `{"expressions": [{"expression": "1+1"}, {"expression": "2+2"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate/batch", strings.NewReader(body))
+	req = req.WithContext(handler.WithUserID(req.Context(), 1))
+	w := httptest.NewRecorder()
+	handler.CalcBatchHandler(w, req, logger, a, r, background.New(), 1, false)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), calc.ErrBatchTooLarge.Error()) {
+		t.Errorf("Ожидал 422 с ошибкой размера пачки, получил %d: %s", w.Code, w.Body)
+	}
+}
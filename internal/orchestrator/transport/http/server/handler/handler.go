@@ -1,24 +1,35 @@
 package handler
 
 import (
+	"cmp"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/background"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/eta"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/importer"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
-	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/postgres"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/webhook"
 	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"github.com/golang-jwt/jwt/v4"
-	"github.com/jackc/pgx/v5"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func CalcHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, a *ast.AST, rep *postgres.Repository) {
+func CalcHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, a *ast.AST, rep repository.Repository, bg *background.Group, batchMax int, allowPrivate bool) {
 	request := new(Request)
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if r.Method != http.MethodPost {
@@ -46,14 +57,47 @@ func CalcHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogg
 	} else {
 		logger.Debugf("Прочитал: %s", request.Expression)
 	}
+	if _, ok := models.ParsePriority(request.Priority); !ok {
+		w.WriteHeader(422)
+		logger.Errorf("Неизвестный приоритет: %s", request.Priority)
+		res := ResultBad{Err: calc.ErrInvalidPriority.Error()}
+		jsonBytes, _ := json.Marshal(res)
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	if errBad := checkCallback(request.CallbackURL, len(request.Sweep) > 0, allowPrivate); errBad != nil {
+		w.WriteHeader(422)
+		logger.Errorf("Некорректный callback_url: %s", request.CallbackURL)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: errBad.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	if len(request.Sweep) > 0 {
+		calcSweep(w, r, logger, a, rep, bg, request, batchMax)
+		return
+	}
 	ctx := r.Context()
-	id, err := rep.SetWithExpression(ctx, models.Expressions{Status: "Подсчёт"}, request.Expression)
+	if request.CallbackURL != "" {
+		// Ключ нужен до того, как выражение досчитается: им подписывается вебхук.
+		if _, err = rep.WebhookSecret(ctx, UserID(ctx)); err != nil {
+			w.WriteHeader(500)
+			logger.Errorf("Ошибка получения ключа вебхуков: %v", err)
+			return
+		}
+	}
+	value := models.Expressions{Status: models.StatusPending, Priority: request.Priority, CallbackURL: request.CallbackURL}
+	id, err := rep.SetWithExpression(ctx, UserID(ctx), value, request.Expression)
 	if err != nil {
 		w.WriteHeader(500)
 		logger.Errorf("Ошибка записи выражения в СУБД: %v", err)
 		return
 	}
 	resp := ResponseID{ID: id}
+	if done := a.Calc(ctx, request.Expression, id); done != nil {
+		resp.Status = done.Status
+		resp.StatusLabel = done.Status.Label()
+		resp.Result = done.Result
+	}
 	jsonBytes, err := json.Marshal(resp)
 	if err != nil {
 		w.WriteHeader(500)
@@ -61,10 +105,271 @@ func CalcHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogg
 		w.WriteHeader(201)
 		_, _ = fmt.Fprint(w, string(jsonBytes))
 	}
-	a.Calc(ctx, request.Expression, id)
 }
 
-func GetExpression(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep *postgres.Repository) {
+// checkCallback проверяет callback_url: полный адрес http или https. Для перебора вебхуки не шлются.
+// Внутренние адреса, указанные явно, отсекаются сразу, остальные диспетчер проверит при отправке.
+func checkCallback(callbackURL string, sweep, allowPrivate bool) error {
+	if callbackURL == "" {
+		return nil
+	}
+	if sweep {
+		return calc.ErrCallbackSweep
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return calc.ErrInvalidCallback
+	}
+	if allowPrivate {
+		return nil
+	}
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); (err == nil && !webhook.Public(addr)) || strings.EqualFold(host, "localhost") {
+		return calc.ErrPrivateCallback
+	}
+	return nil
+}
+
+func calcSweep(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, a *ast.AST, rep repository.Repository, bg *background.Group, request *Request, batchMax int) {
+	expressions, values, err := calc.Expand(request.Expression, request.Sweep, batchMax)
+	if err != nil {
+		w.WriteHeader(422)
+		logger.Errorf("Ошибка раскрытия перебора: %v", err)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: err.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	ctx := r.Context()
+	sweepID, ids, err := rep.CreateSweep(ctx, UserID(ctx), request.Expression, request.Priority, expressions, values)
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка записи перебора в СУБД: %v", err)
+		return
+	}
+	jsonBytes, err := json.Marshal(ResponseSweep{SweepID: sweepID, IDs: ids})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	w.WriteHeader(201)
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+	bg.Go(func(ctx context.Context) {
+		a.CalcAll(ctx, ids, expressions)
+	})
+}
+
+func GetSweep(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить перебор не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	sweep, err := rep.GetSweep(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл перебора")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	sweep.Localize()
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(SweepWr{Sweep: sweep})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func CalcBatchHandler(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, a *ast.AST, rep repository.Repository, bg *background.Group, batchMax int, allowPrivate bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка отдать пачку выражений методом не POST")
+		return
+	}
+	var request BatchRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	w.Header().Set("Content-Type", "application/json")
+	var errBad error
+	switch {
+	case err == io.EOF || (err == nil && len(request.Expressions) == 0):
+		errBad = calc.ErrEmptyJson
+	case err != nil:
+		logger.Errorf("Ошибка чтения json: %v", err)
+		errBad = calc.ErrInvalidJson
+	case len(request.Expressions) > batchMax:
+		errBad = calc.ErrBatchTooLarge
+	}
+	if errBad != nil {
+		w.WriteHeader(422)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: errBad.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	results := make([]BatchItem, len(request.Expressions))
+	var values []models.Expressions
+	var expressions []string
+	var positions []int
+	for i, req := range request.Expressions {
+		if _, ok := models.ParsePriority(req.Priority); !ok {
+			results[i].Err = calc.ErrInvalidPriority.Error()
+			continue
+		}
+		if err = a.Validate(req.Expression); err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		if err = checkCallback(req.CallbackURL, len(req.Sweep) > 0, allowPrivate); err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		values = append(values, models.Expressions{Status: models.StatusPending, Priority: req.Priority, CallbackURL: req.CallbackURL})
+		expressions = append(expressions, req.Expression)
+		positions = append(positions, i)
+	}
+	ctx := r.Context()
+	if slices.ContainsFunc(values, func(v models.Expressions) bool { return v.CallbackURL != "" }) {
+		if _, err = rep.WebhookSecret(ctx, UserID(ctx)); err != nil {
+			w.WriteHeader(500)
+			logger.Errorf("Ошибка получения ключа вебхуков: %v", err)
+			return
+		}
+	}
+	var ids []int
+	if len(values) > 0 {
+		ids, err = rep.SetBatch(ctx, UserID(ctx), values, expressions)
+		if err != nil {
+			w.WriteHeader(500)
+			logger.Errorf("Ошибка записи пачки выражений в СУБД: %v", err)
+			return
+		}
+	}
+	for i, id := range ids {
+		results[positions[i]].ID = id
+	}
+	jsonBytes, err := json.Marshal(BatchWr{Results: results})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	w.WriteHeader(201)
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+	// Задачи строим уже после ответа, чтобы клиент не ждал разбора тысяч выражений.
+	bg.Go(func(ctx context.Context) {
+		a.CalcAll(ctx, ids, expressions)
+	})
+}
+
+// ImportExpressions принимает файл с выражениями (поле file формы multipart/form-data) и заводит задание импорта.
+// Файл с расширением .csv или типом text/csv читается как CSV, остальные - построчно.
+func ImportExpressions(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, imp Importer, cfg config.Imports) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка загрузить файл выражений методом не POST")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	bad := func(err error) {
+		w.WriteHeader(422)
+		logger.Debugf("Некорректный файл импорта: %v", err)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: err.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes)
+	file, header, err := r.FormFile("file")
+	if maxErr := new(http.MaxBytesError); errors.As(err, &maxErr) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: calc.ErrImportTooLarge.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	if err != nil {
+		bad(calc.ErrImportFile)
+		return
+	}
+	defer file.Close()
+	priority := r.FormValue("priority")
+	if _, ok := models.ParsePriority(priority); !ok {
+		bad(calc.ErrInvalidPriority)
+		return
+	}
+	isCSV := strings.EqualFold(filepath.Ext(header.Filename), ".csv") ||
+		strings.HasPrefix(header.Header.Get("Content-Type"), "text/csv")
+	lines, err := importer.Parse(file, isCSV, cfg.MaxLines)
+	if err != nil {
+		bad(err)
+		return
+	}
+	if len(lines) == 0 {
+		bad(calc.ErrImportEmpty)
+		return
+	}
+	ctx := r.Context()
+	id, err := imp.Start(ctx, UserID(ctx), header.Filename, priority, lines)
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка записи импорта в СУБД: %v", err)
+		return
+	}
+	jsonBytes, err := json.Marshal(ResponseImport{ImportID: id, Total: len(lines)})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetImport(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить импорт не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	imp, err := rep.GetImport(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл импорта")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(ImportWr{Import: imp})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetExpression(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository, est *eta.Estimator) {
 	if r.Method != http.MethodGet {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		logger.Errorf("Попытка получить выражение не методом GET.")
@@ -79,14 +384,23 @@ func GetExpression(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLo
 		return
 	}
 	logger.Debugf("Преобразовал ID: %v", id)
-	res, err := rep.Get(r.Context(), id)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+	ctx := r.Context()
+	res, err := rep.Get(ctx, UserID(ctx), id)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
 		logger.Errorf("Ошибка запроса к СУБД: %v", err)
 	}
-	if errors.Is(err, pgx.ErrNoRows) {
+	if errors.Is(err, repository.ErrNotFound) {
 		w.WriteHeader(404)
 		logger.Debug("Не нашёл выражения")
 	} else {
+		if res.Status.Active() {
+			res.ETA, err = est.Estimate(ctx, id)
+			if err != nil {
+				logger.Errorf("Ошибка оценки времени подсчёта: %v", err)
+			}
+		}
+		res.SetDurations()
+		res.Localize()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		resWr := ResponseWr{Expression: res}
@@ -100,19 +414,33 @@ func GetExpression(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLo
 	}
 }
 
-func GetAllExpressions(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep *postgres.Repository) {
+func GetAllExpressions(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
 	if r.Method != http.MethodGet {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		logger.Errorf("Попытка получить выражение не методом GET")
 		return
 	}
-	expressions, err := rep.GetAll(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	lq, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Debugf("Некорректные параметры списка: %v", err)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: repository.ErrInvalidQuery.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	ctx := r.Context()
+	expressions, next, err := rep.GetAll(ctx, UserID(ctx), lq)
 	if err != nil {
 		w.WriteHeader(500)
 		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	res := ExprWr{Expressions: expressions}
+	for i := range expressions {
+		expressions[i].SetDurations()
+		expressions[i].Localize()
+	}
+	res := ExprWr{Expressions: expressions, NextCursor: next}
 	jsonBytes, err := json.Marshal(res)
 	if err != nil {
 		w.WriteHeader(500)
@@ -122,7 +450,409 @@ func GetAllExpressions(w http.ResponseWriter, r *http.Request, logger *zap.Sugar
 	}
 }
 
-func Register(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep *postgres.Repository) {
+// parseListQuery читает limit, after, status, created_from, created_to, q и sort.
+func parseListQuery(values url.Values) (repository.ListQuery, error) {
+	lq := repository.ListQuery{
+		Search: values.Get("q"),
+		Sort:   values.Get("sort"),
+	}
+	var err error
+	if v := values.Get("status"); v != "" {
+		var ok bool
+		if lq.Status, ok = models.ParseStatus(v); !ok {
+			return lq, fmt.Errorf("status: %s", v)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		lq.Limit, err = strconv.Atoi(v)
+		if err != nil || lq.Limit <= 0 || lq.Limit > repository.MaxLimit {
+			return lq, fmt.Errorf("limit: %s", v)
+		}
+	}
+	if lq.Sort == "" {
+		lq.Sort = "id"
+	}
+	if _, ok := repository.Sorts[lq.Sort]; !ok {
+		return lq, fmt.Errorf("sort: %s", lq.Sort)
+	}
+	if v := values.Get("after"); v != "" {
+		if lq.After, err = repository.ParseCursor(v); err != nil {
+			return lq, fmt.Errorf("after: %s", v)
+		}
+	}
+	if v := values.Get("created_from"); v != "" {
+		if lq.CreatedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+			return lq, err
+		}
+	}
+	if v := values.Get("created_to"); v != "" {
+		if lq.CreatedTo, err = time.Parse(time.RFC3339, v); err != nil {
+			return lq, err
+		}
+	}
+	return lq, nil
+}
+
+// exportHeader - колонки CSV выгрузки.
+var exportHeader = []string{"id", "expression", "external_ref", "status", "result", "created_at", "started_at", "finished_at"}
+
+func exportRecord(e models.ExportRow) []string {
+	format := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	result := ""
+	if e.Result != nil {
+		result = *e.Result
+	}
+	return []string{strconv.FormatInt(e.ID, 10), e.Expression, e.ExternalRef, string(e.Status), result,
+		format(&e.CreatedAt), format(e.StartedAt), format(e.FinishedAt)}
+}
+
+// ExportExpressions отдаёт историю выражений пользователя в CSV или NDJSON потоком, строка за строкой.
+// Фильтры те же, что у списка выражений.
+func ExportExpressions(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка выгрузить выражения не методом GET")
+		return
+	}
+	format := cmp.Or(r.URL.Query().Get("format"), "csv")
+	lq, err := parseListQuery(r.URL.Query())
+	if err != nil || (format != "csv" && format != "ndjson") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Debugf("Некорректные параметры выгрузки: format=%s, %v", format, err)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: repository.ErrInvalidQuery.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	ctx := r.Context()
+	var write func(models.ExportRow) error
+	flush := func() error { return nil }
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		write = func(e models.ExportRow) error {
+			return cw.Write(exportRecord(e))
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		// Заголовок уходит, даже если выражений нет.
+		_ = cw.Write(exportHeader)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(e models.ExportRow) error {
+			return enc.Encode(e)
+		}
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="expressions.`+format+`"`)
+	if err = rep.Export(ctx, UserID(ctx), lq, write); err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// Часть ответа уже ушла, статус не поменять: клиент увидит оборванную выгрузку.
+		logger.Errorf("Ошибка выгрузки выражений: %v", err)
+	}
+}
+
+func GetPlan(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, a *ast.AST, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить план выражения не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	expression, err := rep.GetExpression(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	plan, err := a.Plan(ctx, id, expression)
+	if err != nil && !slices.Contains(calc.Errors, err) {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка построения плана выражения %d: %v", id, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(422)
+		logger.Debugf("Не смог построить план выражения %d: %v", id, err)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: err.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	jsonBytes, err := json.Marshal(PlanWr{Plan: plan})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func CancelExpression(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository, c Canceller) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка отменить выражение не методом DELETE/POST.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	ids, err := rep.Cancel(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	if errors.Is(err, repository.ErrNotRunning) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: err.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка отмены выражения в СУБД: %v", err)
+		return
+	}
+	c.CancelTasks(ids)
+	logger.Debugf("Отменил выражение %d, удалено задач: %d", id, len(ids))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func RetryExpression(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, a *ast.AST, c Canceller) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка перезапустить выражение не методом POST.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	ids, err := a.Retry(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, repository.ErrNotRetryable) {
+		w.WriteHeader(http.StatusConflict)
+		jsonBytes, _ := json.Marshal(ResultBad{Err: err.Error()})
+		_, _ = fmt.Fprint(w, string(jsonBytes))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка перезапуска выражения: %v", err)
+		return
+	}
+	c.CancelTasks(ids)
+	jsonBytes, err := json.Marshal(ResponseID{ID: id})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetAttempts(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить историю попыток не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	_, err = rep.Get(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	attempts, err := rep.GetAttempts(ctx, UserID(ctx), id)
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	for i := range attempts {
+		attempts[i].StatusLabel = attempts[i].Status.Label()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(AttemptsWr{Attempts: attempts})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetEvents(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить историю выражения не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	_, err = rep.Get(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	events, err := rep.GetEvents(ctx, UserID(ctx), id)
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(EventsWr{Events: events})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetTaskTimings(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить задачи выражения не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	_, err = rep.Get(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	tasks, err := rep.GetTaskTimings(ctx, UserID(ctx), id)
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(TasksWr{Tasks: tasks})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func PurgeExpressions(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, p Purger) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка запустить чистку выражений не методом POST.")
+		return
+	}
+	removed, err := p.Purge(r.Context())
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка чистки выражений: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(PurgeWr{Removed: removed})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetCacheStats(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить статистику кэша не методом GET.")
+		return
+	}
+	stats, err := rep.CacheStats(r.Context())
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(CacheWr{Cache: stats})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func Register(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
 	if r.Method != http.MethodPost {
 		logger.Error("Попытка зарегистрироваться не методом POST")
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -157,7 +887,7 @@ func Register(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger,
 	w.WriteHeader(http.StatusOK)
 }
 
-func Login(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep *postgres.Repository, secret string) {
+func Login(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository, secret string) {
 	if r.Method != http.MethodPost {
 		logger.Error("Попытка войти не методом POST")
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -183,7 +913,7 @@ func Login(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, re
 		return
 	}
 	ctx := r.Context()
-	ok, err := rep.VerifyUser(ctx, user.Login, user.Password)
+	userID, ok, err := rep.VerifyUser(ctx, user.Login, user.Password)
 	if err != nil {
 		w.WriteHeader(500)
 		logger.Errorf("Ошибка проверки учетной записи в СУБД: %v", err)
@@ -194,7 +924,7 @@ func Login(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, re
 		logger.Debug("Учётную запись не нашли в СУБД")
 		return
 	}
-	jwtToken, err := GenerateJWT(secret)
+	jwtToken, err := GenerateJWT(secret, userID)
 	if err != nil {
 		w.WriteHeader(500)
 		logger.Errorf("Ошибка формирования jwt: %v", err)
@@ -208,13 +938,27 @@ func Login(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, re
 	}
 }
 
-func GenerateJWT(secret string) (string, error) {
+func GenerateJWT(secret string, userID int) (string, error) {
 	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": strconv.Itoa(userID),
 		"exp": time.Now().Add(time.Hour * 1).Unix(),
 	})
 	return claims.SignedString([]byte(secret))
 }
 
+type userKey struct{}
+
+// WithUserID кладёт в контекст ID пользователя из токена.
+func WithUserID(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, userKey{}, userID)
+}
+
+// UserID достаёт ID пользователя, которого положил JWTAuthMiddleware.
+func UserID(ctx context.Context) int {
+	userID, _ := ctx.Value(userKey{}).(int)
+	return userID
+}
+
 func Decorate(next http.Handler, ds ...Decorator) http.Handler {
 	res := next
 	for d := len(ds) - 1; d >= 0; d-- {
@@ -222,3 +966,66 @@ func Decorate(next http.Handler, ds ...Decorator) http.Handler {
 	}
 	return res
 }
+
+func GetWebhooks(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить журнал вебхуков не методом GET.")
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		logger.Errorf("Ошибка преобразования ID: %v", err)
+		return
+	}
+	ctx := r.Context()
+	_, err = rep.Get(ctx, UserID(ctx), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(404)
+		logger.Debug("Не нашёл выражения")
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	webhooks, err := rep.GetWebhooks(ctx, UserID(ctx), id)
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка запроса к СУБД: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(WebhooksWr{Webhooks: webhooks})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
+
+func GetWebhookSecret(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger, rep repository.Repository) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		logger.Errorf("Попытка получить ключ вебхуков не методом GET.")
+		return
+	}
+	ctx := r.Context()
+	secret, err := rep.WebhookSecret(ctx, UserID(ctx))
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка получения ключа вебхуков: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonBytes, err := json.Marshal(SecretWr{Secret: secret})
+	if err != nil {
+		w.WriteHeader(500)
+		logger.Errorf("Ошибка преобразования в json: %v", err)
+		return
+	}
+	_, _ = fmt.Fprint(w, string(jsonBytes))
+}
@@ -1,14 +1,45 @@
 package handler
 
 import (
+	"context"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/pkg/calc"
+	"github.com/google/uuid"
 	"net/http"
 )
 
 type Decorator func(http.Handler) http.Handler
 
+type Canceller interface {
+	CancelTasks(ids []uuid.UUID)
+}
+
+type Purger interface {
+	Purge(ctx context.Context) ([]models.PurgeResult, error)
+}
+
+type Importer interface {
+	Start(ctx context.Context, userID int, filename, priority string, lines []models.ImportLine) (int, error)
+}
+
 type Request struct {
-	Expression string `json:"expression"`
+	Expression  string                `json:"expression"`
+	Priority    string                `json:"priority"`
+	Sweep       map[string]calc.Range `json:"sweep"`
+	CallbackURL string                `json:"callback_url"`
+}
+
+type BatchRequest struct {
+	Expressions []Request `json:"expressions"`
+}
+
+type BatchItem struct {
+	ID  int    `json:"id,omitempty"`
+	Err string `json:"error,omitempty"`
+}
+
+type BatchWr struct {
+	Results []BatchItem `json:"results"`
 }
 
 type ResponseWr struct {
@@ -17,10 +48,64 @@ type ResponseWr struct {
 
 type ExprWr struct {
 	Expressions []models.Expressions `json:"expressions"`
+	NextCursor  string               `json:"next_cursor,omitempty"`
+}
+
+type PlanWr struct {
+	Plan models.Plan `json:"plan"`
+}
+
+type AttemptsWr struct {
+	Attempts []models.Attempt `json:"attempts"`
+}
+
+type EventsWr struct {
+	Events []models.Event `json:"events"`
+}
+
+type WebhooksWr struct {
+	Webhooks []models.WebhookLog `json:"webhooks"`
+}
+
+type SecretWr struct {
+	Secret string `json:"secret"`
+}
+
+type TasksWr struct {
+	Tasks []models.TaskTiming `json:"tasks"`
+}
+
+type PurgeWr struct {
+	Removed []models.PurgeResult `json:"removed"`
+}
+
+type CacheWr struct {
+	Cache models.CacheStats `json:"cache"`
 }
 
 type ResponseID struct {
-	ID int `json:"id"`
+	ID          int           `json:"id"`
+	Status      models.Status `json:"status,omitempty"`
+	StatusLabel string        `json:"status_label,omitempty"`
+	Result      *string       `json:"result,omitempty"`
+}
+
+type ResponseSweep struct {
+	SweepID int   `json:"sweep_id"`
+	IDs     []int `json:"ids"`
+}
+
+type ResponseImport struct {
+	ImportID int `json:"import_id"`
+	Total    int `json:"total"`
+}
+
+type ImportWr struct {
+	Import models.Import `json:"import"`
+}
+
+type SweepWr struct {
+	Sweep models.Sweep `json:"sweep"`
 }
 
 type ResultBad struct {
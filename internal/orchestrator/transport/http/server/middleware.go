@@ -2,25 +2,47 @@ package server
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/transport/http/server/handler"
 	"github.com/Cool-Andrey/Calculating/pkg/calc"
 	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// maxLoggedBody - сколько байт тела JSON запроса попадает в лог. Остальное читает уже обработчик.
+const maxLoggedBody = 64 << 10
+
+// logBody решает, писать ли тело запроса в лог: файлы импорта и прочие не-JSON тела
+// не читаются заранее, иначе обработчик не сможет ограничить их размер.
+func logBody(r *http.Request) bool {
+	if r.URL.Path == "/api/v1/calculate/import" {
+		return false
+	}
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "" || strings.HasPrefix(contentType, "application/json")
+}
+
 func LoggingMiddleware(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			bodyBytes, err := io.ReadAll(r.Body)
-			defer r.Body.Close()
-			if err != nil {
-				logger.Errorf("Ошибка чтения тела из логера: %v", err)
+			var bodyBytes []byte
+			if logBody(r) {
+				var err error
+				bodyBytes, err = io.ReadAll(io.LimitReader(r.Body, maxLoggedBody))
+				if err != nil {
+					logger.Errorf("Ошибка чтения тела из логера: %v", err)
+				}
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(bodyBytes), r.Body), r.Body}
 			}
-			r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 			start := time.Now()
 			next.ServeHTTP(w, r)
 			duration := time.Since(start)
@@ -56,19 +78,38 @@ func JWTAuthMiddleware(logger *zap.SugaredLogger, secret string) func(http.Handl
 					http.Error(w, "Неправильный формат хедера", http.StatusUnauthorized)
 					return
 				}
-				err := ValidateToken(parts[1], secret)
+				userID, err := ValidateToken(parts[1], secret)
 				if err != nil {
 					http.Error(w, "Чёт не то с токеном", http.StatusUnauthorized)
 					logger.Errorf("Ошибка авторизации: %v", err)
 					return
 				}
+				r = r.WithContext(handler.WithUserID(r.Context(), userID))
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func ValidateToken(tokenString, secret string) error {
+// AdminMiddleware пускает в /api/v1/admin/ только с заголовком X-Admin-Token, равным ADMIN_TOKEN.
+// Пустой ADMIN_TOKEN закрывает админские ручки для всех.
+func AdminMiddleware(logger *zap.SugaredLogger, token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/api/v1/admin/") {
+				got := r.Header.Get("X-Admin-Token")
+				if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+					logger.Errorf("Пользователь %d без прав администратора запросил %s", handler.UserID(r.Context()), r.URL.Path)
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ValidateToken(tokenString, secret string) (int, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Не тот метод подписи: %v", token.Header["alg"])
@@ -76,15 +117,21 @@ func ValidateToken(tokenString, secret string) error {
 		return []byte(secret), nil
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		if exp, ok := claims["exp"].(float64); ok {
 			if time.Now().Unix() > int64(exp) {
-				return calc.ErrExpJWTToken
+				return 0, calc.ErrExpJWTToken
 			}
 		}
-		return nil
+		// Токены без sub выданы до разделения выражений по пользователям.
+		sub, _ := claims["sub"].(string)
+		userID, err := strconv.Atoi(sub)
+		if err != nil {
+			return 0, calc.ErrInvalidJWTToken
+		}
+		return userID, nil
 	}
-	return calc.ErrInvalidJWTToken
+	return 0, calc.ErrInvalidJWTToken
 }
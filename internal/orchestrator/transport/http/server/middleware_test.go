@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/transport/http/server/handler"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name     string
+		token    string
+		path     string
+		header   string
+		expected int
+	}{
+		{name: "admin", token: "secret", path: "/api/v1/admin/retention", header: "secret", expected: http.StatusOK},
+		{name: "wrong token", token: "secret", path: "/api/v1/admin/retention", header: "guess", expected: http.StatusForbidden},
+		{name: "no token", token: "secret", path: "/api/v1/admin/cache", expected: http.StatusForbidden},
+		{name: "admin disabled", token: "", path: "/api/v1/admin/cache", expected: http.StatusForbidden},
+		{name: "not admin path", token: "secret", path: "/api/v1/expressions", expected: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := AdminMiddleware(zap.NewNop().Sugar(), test.token)(ok)
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.header != "" {
+				r.Header.Set("X-Admin-Token", test.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.expected {
+				t.Errorf("Ожидал код %d, получил %d", test.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core).Sugar()
+
+	t.Run("Oversized import", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		file, err := form.CreateFormFile("file", "data.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = file.Write([]byte(strings.Repeat("2+2\n", 1000)))
+		_ = form.Close()
+		imports := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ImportExpressions(w, r, logger, nil, config.Imports{MaxLines: 10, MaxBytes: 100})
+		})
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate/import", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		LoggingMiddleware(logger)(imports).ServeHTTP(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Ожидал код 413, получил %d: %s", w.Code, w.Body)
+		}
+		for _, entry := range logs.TakeAll() {
+			if _, ok := entry.ContextMap()["Тело"]; ok {
+				t.Errorf("Файл импорта попал в лог: %v", entry.ContextMap())
+			}
+		}
+	})
+
+	t.Run("JSON body", func(t *testing.T) {
+		const body = `{"expression": "2+2"}`
+		var got string
+		echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			got = string(b)
+		})
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		LoggingMiddleware(logger)(echo).ServeHTTP(httptest.NewRecorder(), r)
+		if got != body {
+			t.Errorf("Ожидал, что обработчик получит тело целиком, получил %q", got)
+		}
+		entries := logs.TakeAll()
+		if len(entries) != 1 || entries[0].ContextMap()["Тело"] != body {
+			t.Errorf("Ожидал тело в логе, получил %+v", entries)
+		}
+	})
+
+	t.Run("Long JSON body", func(t *testing.T) {
+		body := `{"expression": "` + strings.Repeat("1+", maxLoggedBody) + `1"}`
+		var got int
+		count := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			got = len(b)
+		})
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(body))
+		LoggingMiddleware(logger)(count).ServeHTTP(httptest.NewRecorder(), r)
+		if got != len(body) {
+			t.Errorf("Ожидал тело из %d байт, обработчик получил %d", len(body), got)
+		}
+		entries := logs.TakeAll()
+		if len(entries) != 1 || len(entries[0].ContextMap()["Тело"].(string)) != maxLoggedBody {
+			t.Errorf("Ожидал в логе первые %d байт тела", maxLoggedBody)
+		}
+	})
+}
@@ -3,36 +3,87 @@ package server
 import (
 	"context"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/ast"
-	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/postgres"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/background"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/eta"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
 	"github.com/Cool-Andrey/Calculating/internal/orchestrator/transport/http/server/handler"
 	"go.uber.org/zap"
 	"net/http"
 	"time"
 )
 
-func newHandler(logger *zap.SugaredLogger, a *ast.AST, rep *postgres.Repository, secret string) http.Handler {
+func newHandler(logger *zap.SugaredLogger, a *ast.AST, rep repository.Repository, bg *background.Group, est *eta.Estimator, c handler.Canceller, p handler.Purger, imp handler.Importer, cfg *config.Config) http.Handler {
 	muxHandler := http.NewServeMux()
 	muxHandler.HandleFunc("/api/v1/calculate", func(w http.ResponseWriter, r *http.Request) {
-		handler.CalcHandler(w, r, logger, a, rep)
+		handler.CalcHandler(w, r, logger, a, rep, bg, cfg.BatchMax, cfg.Webhooks.AllowPrivate)
+	})
+	muxHandler.HandleFunc("/api/v1/calculate/batch", func(w http.ResponseWriter, r *http.Request) {
+		handler.CalcBatchHandler(w, r, logger, a, rep, bg, cfg.BatchMax, cfg.Webhooks.AllowPrivate)
+	})
+	muxHandler.HandleFunc("/api/v1/calculate/import", func(w http.ResponseWriter, r *http.Request) {
+		handler.ImportExpressions(w, r, logger, imp, cfg.Imports)
+	})
+	muxHandler.HandleFunc("/api/v1/imports/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetImport(w, r, logger, rep)
 	})
 	muxHandler.HandleFunc("/api/v1/expressions/", func(w http.ResponseWriter, r *http.Request) {
-		handler.GetExpression(w, r, logger, rep)
+		handler.GetExpression(w, r, logger, rep, est)
+	})
+	muxHandler.HandleFunc("GET /api/v1/expressions/export", func(w http.ResponseWriter, r *http.Request) {
+		handler.ExportExpressions(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("DELETE /api/v1/expressions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.CancelExpression(w, r, logger, rep, c)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		handler.CancelExpression(w, r, logger, rep, c)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		handler.RetryExpression(w, r, logger, a, c)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/attempts", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetAttempts(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetEvents(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetWebhooks(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/webhooks/secret", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetWebhookSecret(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/tasks", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetTaskTimings(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/expressions/{id}/plan", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetPlan(w, r, logger, a, rep)
 	})
 	muxHandler.HandleFunc("/api/v1/expressions", func(w http.ResponseWriter, r *http.Request) {
 		handler.GetAllExpressions(w, r, logger, rep)
 	})
+	muxHandler.HandleFunc("/api/v1/sweeps/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetSweep(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		handler.GetCacheStats(w, r, logger, rep)
+	})
+	muxHandler.HandleFunc("/api/v1/admin/retention", func(w http.ResponseWriter, r *http.Request) {
+		handler.PurgeExpressions(w, r, logger, p)
+	})
 	muxHandler.HandleFunc("/api/v1/register", func(w http.ResponseWriter, r *http.Request) {
 		handler.Register(w, r, logger, rep)
 	})
 	muxHandler.HandleFunc("/api/v1/login", func(w http.ResponseWriter, r *http.Request) {
-		handler.Login(w, r, logger, rep, secret)
+		handler.Login(w, r, logger, rep, cfg.JWTSecret)
 	})
-	return handler.Decorate(muxHandler, JWTAuthMiddleware(logger, secret), LoggingMiddleware(logger))
+	return handler.Decorate(muxHandler, JWTAuthMiddleware(logger, cfg.JWTSecret), AdminMiddleware(logger, cfg.AdminToken), LoggingMiddleware(logger))
 }
 
-func Run(logger *zap.SugaredLogger, addr string, a *ast.AST, r *postgres.Repository, secret string) func(ctx context.Context) error {
-	Handler := newHandler(logger, a, r, secret)
-	server := &http.Server{Addr: ":" + addr, Handler: Handler}
+func Run(logger *zap.SugaredLogger, a *ast.AST, r repository.Repository, bg *background.Group, est *eta.Estimator, c handler.Canceller, p handler.Purger, imp handler.Importer, cfg *config.Config) func(ctx context.Context) error {
+	Handler := newHandler(logger, a, r, bg, est, c, p, imp, cfg)
+	server := &http.Server{Addr: ":" + cfg.Addr, Handler: Handler}
 	ch := make(chan error, 1)
 	go func() {
 		err := server.ListenAndServe()
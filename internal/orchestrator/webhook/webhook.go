@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	IDHeader        = "X-Webhook-ID"
+	AttemptHeader   = "X-Webhook-Attempt"
+)
+
+// maxBackoff - потолок задержки между попытками.
+const maxBackoff = time.Hour
+
+var ErrPrivateAddress = errors.New("адрес получателя во внутренней сети")
+
+// sharedSpace - адреса провайдерского NAT (RFC 6598), на них бывают сервисы метаданных облаков.
+var sharedSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Public сообщает, можно ли слать вебхук на addr: не loopback, не link-local, не частная сеть.
+func Public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedSpace.Contains(addr)
+}
+
+// control проверяет адрес уже после резолва, поэтому DNS, отвечающий внутренним адресом, не поможет.
+func control(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !Public(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, ap.Addr())
+	}
+	return nil
+}
+
+func newClient(cfg config.Webhooks) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Через прокси проверялся бы адрес прокси, а не получателя.
+	transport.Proxy = nil
+	if !cfg.AllowPrivate {
+		dialer := &net.Dialer{Timeout: cfg.Timeout, Control: control}
+		transport.DialContext = dialer.DialContext
+	}
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+		// Редирект увёл бы запрос на непроверенный адрес: 3xx считается неудачной попыткой.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Sign - подпись тела вебхука: HMAC-SHA256 ключом пользователя в hex с префиксом sha256=.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher разносит вебхуки из outbox. Outbox общий, поэтому оркестраторов может быть несколько.
+type Dispatcher struct {
+	r      repository.Webhooks
+	cfg    config.Webhooks
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+func NewDispatcher(r repository.Webhooks, cfg config.Webhooks, logger *zap.SugaredLogger) *Dispatcher {
+	return &Dispatcher{r: r, cfg: cfg, client: newClient(cfg), logger: logger}
+}
+
+// retryAt - когда повторять неудачную попытку attempt. Нулевое время - попытки кончились.
+func (d *Dispatcher) retryAt(attempt int) time.Time {
+	if attempt >= d.cfg.MaxAttempts {
+		return time.Time{}
+	}
+	backoff := d.cfg.Backoff
+	for i := 1; i < attempt && backoff > 0 && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return time.Now().Add(min(backoff, maxBackoff))
+}
+
+// Deliver делает один проход по outbox и возвращает, сколько доставок попробовал.
+func (d *Dispatcher) Deliver(ctx context.Context) (int, error) {
+	// Аренда с запасом на таймаут: иначе медленный получатель получит вебхук дважды.
+	webhooks, err := d.r.ClaimWebhooks(ctx, d.cfg.Batch, 2*d.cfg.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	for _, w := range webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delivery := d.send(ctx, w)
+			var retryAt time.Time
+			if !delivery.Delivered() {
+				retryAt = d.retryAt(w.Attempt)
+				d.logger.Warnf("Вебхук %d выражения %d не доставлен, попытка %d: %s",
+					w.ID, w.ExpressionID, w.Attempt, delivery.Error)
+			}
+			if err := d.r.RecordDelivery(ctx, delivery, retryAt); err != nil {
+				d.logger.Errorf("Ошибка записи доставки вебхука %d: %v", w.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return len(webhooks), nil
+}
+
+func (d *Dispatcher) send(ctx context.Context, w models.Webhook) (res models.WebhookDelivery) {
+	res = models.WebhookDelivery{WebhookID: w.ID, Attempt: w.Attempt}
+	start := time.Now()
+	defer func() {
+		res.DurationMs = time.Since(start).Milliseconds()
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(w.Payload))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.Secret, w.Payload))
+	req.Header.Set(IDHeader, strconv.FormatInt(w.ID, 10))
+	req.Header.Set(AttemptHeader, strconv.Itoa(w.Attempt))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	res.StatusCode = resp.StatusCode
+	if !res.Delivered() {
+		res.Error = fmt.Sprintf("получатель ответил %s", resp.Status)
+	}
+	return res
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	if d.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		// Полный проход - возможно, в outbox есть ещё, не ждём тика.
+		n, err := d.Deliver(ctx)
+		if err != nil {
+			d.logger.Errorf("Ошибка доставки вебхуков: %v", err)
+		}
+		if err == nil && n == d.cfg.Batch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/config"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/models"
+	"github.com/Cool-Andrey/Calculating/internal/orchestrator/repository/memory"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+	// httptest слушает loopback, поэтому внутренние адреса в тестах разрешены.
+	cfg := config.Webhooks{Timeout: time.Second, Backoff: -time.Minute, MaxAttempts: 2, Batch: 10, AllowPrivate: true}
+	setup := func(t *testing.T, url string) (*memory.Repository, string, int, int) {
+		r, err := memory.NewRepository(config.Cache{}, config.Scheduler{Policy: "fifo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = r.CreateUser(ctx, "user", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		userID, _, _ := r.VerifyUser(ctx, "user", "pass")
+		secret, err := r.WebhookSecret(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := models.Expressions{Status: models.StatusPending, CallbackURL: url}
+		id, err := r.SetWithExpression(ctx, userID, value, "2+2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := "4.00"
+		if _, err = r.Set(ctx, models.Expressions{ID: int64(id), Status: models.StatusDone, Result: &res}); err != nil {
+			t.Fatal(err)
+		}
+		return r, secret, userID, id
+	}
+
+	t.Run("Signed delivery", func(t *testing.T) {
+		var body []byte
+		var signature string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			signature = r.Header.Get(SignatureHeader)
+		}))
+		defer srv.Close()
+		r, secret, userID, id := setup(t, srv.URL)
+		d := NewDispatcher(r, cfg, zap.NewNop().Sugar())
+		if n, err := d.Deliver(ctx); err != nil || n != 1 {
+			t.Fatalf("Ожидал одну доставку, получил %d, %v", n, err)
+		}
+		if signature != Sign(secret, body) {
+			t.Errorf("Подпись %s не сходится с телом %s", signature, body)
+		}
+		var payload models.WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil || payload.ID != int64(id) || payload.Status != models.StatusDone {
+			t.Errorf("Ожидал посчитанное выражение %d, получил %s, %v", id, body, err)
+		}
+		logs, _ := r.GetWebhooks(ctx, userID, id)
+		if len(logs) != 1 || logs[0].State != models.WebhookDelivered || len(logs[0].Deliveries) != 1 {
+			t.Errorf("Ожидал одну доставленную попытку, получил %+v", logs)
+		}
+		if n, _ := d.Deliver(ctx); n != 0 {
+			t.Errorf("Доставленный вебхук ушёл повторно: %d", n)
+		}
+	})
+
+	t.Run("Retries", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+		r, _, userID, id := setup(t, srv.URL)
+		d := NewDispatcher(r, cfg, zap.NewNop().Sugar())
+		// Отрицательный Backoff делает повтор сразу доступным.
+		for range 3 {
+			if _, err := d.Deliver(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if calls.Load() != int32(cfg.MaxAttempts) {
+			t.Errorf("Ожидал %d попытки, получил %d", cfg.MaxAttempts, calls.Load())
+		}
+		logs, _ := r.GetWebhooks(ctx, userID, id)
+		if len(logs) != 1 || logs[0].State != models.WebhookFailed || len(logs[0].Deliveries) != cfg.MaxAttempts ||
+			logs[0].Deliveries[0].StatusCode != http.StatusInternalServerError {
+			t.Errorf("Ожидал брошенный после %d попыток вебхук, получил %+v", cfg.MaxAttempts, logs)
+		}
+	})
+	t.Run("Private address", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		r, _, userID, id := setup(t, srv.URL)
+		strict := cfg
+		strict.AllowPrivate = false
+		if _, err := NewDispatcher(r, strict, zap.NewNop().Sugar()).Deliver(ctx); err != nil {
+			t.Fatal(err)
+		}
+		logs, _ := r.GetWebhooks(ctx, userID, id)
+		if calls.Load() != 0 || len(logs) != 1 || len(logs[0].Deliveries) != 1 ||
+			!strings.Contains(logs[0].Deliveries[0].Error, ErrPrivateAddress.Error()) {
+			t.Errorf("Ожидал, что вебхук на loopback не уйдёт, получил %d вызовов и %+v", calls.Load(), logs)
+		}
+	})
+
+	t.Run("No redirects", func(t *testing.T) {
+		var calls atomic.Int32
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+		defer target.Close()
+		srv := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+		defer srv.Close()
+		r, _, userID, id := setup(t, srv.URL)
+		if _, err := NewDispatcher(r, cfg, zap.NewNop().Sugar()).Deliver(ctx); err != nil {
+			t.Fatal(err)
+		}
+		logs, _ := r.GetWebhooks(ctx, userID, id)
+		if calls.Load() != 0 || len(logs) != 1 || logs[0].Deliveries[0].StatusCode != http.StatusTemporaryRedirect {
+			t.Errorf("Ожидал, что редирект не выполнится, получил %d вызовов и %+v", calls.Load(), logs)
+		}
+	})
+
+	t.Run("Backoff cap", func(t *testing.T) {
+		d := NewDispatcher(nil, config.Webhooks{Backoff: time.Second, MaxAttempts: 1000}, zap.NewNop().Sugar())
+		if wait := time.Until(d.retryAt(3)); wait <= 3*time.Second || wait > 4*time.Second {
+			t.Errorf("Ожидал задержку 4s перед третьим повтором, получил %v", wait)
+		}
+		if wait := time.Until(d.retryAt(999)); wait <= 0 || wait > maxBackoff {
+			t.Errorf("Ожидал задержку не больше %v, получил %v", maxBackoff, wait)
+		}
+	})
+}
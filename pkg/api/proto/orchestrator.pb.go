@@ -28,6 +28,7 @@ type Task struct {
 	Arg1          float64                `protobuf:"fixed64,3,opt,name=Arg1,proto3" json:"Arg1,omitempty"`
 	Arg2          float64                `protobuf:"fixed64,4,opt,name=Arg2,proto3" json:"Arg2,omitempty"`
 	OperationTime int64                  `protobuf:"varint,5,opt,name=OperationTime,proto3" json:"OperationTime,omitempty"`
+	Cancel        bool                   `protobuf:"varint,6,opt,name=Cancel,proto3" json:"Cancel,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -97,6 +98,13 @@ func (x *Task) GetOperationTime() int64 {
 	return 0
 }
 
+func (x *Task) GetCancel() bool {
+	if x != nil {
+		return x.Cancel
+	}
+	return false
+}
+
 type TaskWithResult struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ID            string                 `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
@@ -105,6 +113,7 @@ type TaskWithResult struct {
 	Arg2          float64                `protobuf:"fixed64,4,opt,name=Arg2,proto3" json:"Arg2,omitempty"`
 	Result        float64                `protobuf:"fixed64,5,opt,name=Result,proto3" json:"Result,omitempty"`
 	OperationTime int64                  `protobuf:"varint,6,opt,name=OperationTime,proto3" json:"OperationTime,omitempty"`
+	Error         string                 `protobuf:"bytes,7,opt,name=Error,proto3" json:"Error,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -181,24 +190,33 @@ func (x *TaskWithResult) GetOperationTime() int64 {
 	return 0
 }
 
+func (x *TaskWithResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
 var File_api_proto_orchestrator_proto protoreflect.FileDescriptor
 
 const file_api_proto_orchestrator_proto_rawDesc = "" +
 	"\n" +
-	"\x1capi/proto/orchestrator.proto\"\x82\x01\n" +
+	"\x1capi/proto/orchestrator.proto\"\x9a\x01\n" +
 	"\x04Task\x12\x0e\n" +
 	"\x02ID\x18\x01 \x01(\tR\x02ID\x12\x1c\n" +
 	"\tOperation\x18\x02 \x01(\tR\tOperation\x12\x12\n" +
 	"\x04Arg1\x18\x03 \x01(\x01R\x04Arg1\x12\x12\n" +
 	"\x04Arg2\x18\x04 \x01(\x01R\x04Arg2\x12$\n" +
-	"\rOperationTime\x18\x05 \x01(\x03R\rOperationTime\"\xa4\x01\n" +
+	"\rOperationTime\x18\x05 \x01(\x03R\rOperationTime\x12\x16\n" +
+	"\x06Cancel\x18\x06 \x01(\bR\x06Cancel\"\xba\x01\n" +
 	"\x0eTaskWithResult\x12\x0e\n" +
 	"\x02ID\x18\x01 \x01(\tR\x02ID\x12\x1c\n" +
 	"\tOperation\x18\x02 \x01(\tR\tOperation\x12\x12\n" +
 	"\x04Arg1\x18\x03 \x01(\x01R\x04Arg1\x12\x12\n" +
 	"\x04Arg2\x18\x04 \x01(\x01R\x04Arg2\x12\x16\n" +
 	"\x06Result\x18\x05 \x01(\x01R\x06Result\x12$\n" +
-	"\rOperationTime\x18\x06 \x01(\x03R\rOperationTime2:\n" +
+	"\rOperationTime\x18\x06 \x01(\x03R\rOperationTime\x12\x14\n" +
+	"\x05Error\x18\a \x01(\tR\x05Error2:\n" +
 	"\fOrchestrator\x12*\n" +
 	"\fGiveTakeTask\x12\x0f.TaskWithResult\x1a\x05.Task(\x010\x01B>Z<github.com/Cool-Andrey/Calculating/pkg/proto/orchestrator;pbb\x06proto3"
 
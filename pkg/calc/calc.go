@@ -7,7 +7,8 @@ import (
 )
 
 func IsOperator(s string) bool {
-	return s == "+" || s == "-" || s == "*" || s == "/"
+	_, ok := Lookup(s)
+	return ok
 }
 
 func RightString(s string) bool {
@@ -48,16 +49,16 @@ func RightString(s string) bool {
 }
 
 func CountOp(expression []string) bool {
-	op := 0
+	consumed := 0
 	numbers := 0
 	for _, val := range expression {
 		if _, err := strconv.ParseFloat(val, 64); err == nil {
 			numbers++
-		} else if IsOperator(val) {
-			op++
+		} else if op, ok := Lookup(val); ok {
+			consumed += op.Arity - 1
 		}
 	}
-	if numbers-op == 1 {
+	if numbers-consumed == 1 {
 		return true
 	} else {
 		return false
@@ -111,38 +112,19 @@ func Calc(expression string) (float64, error) {
 	}
 	var stack []float64
 	for _, val := range tokens {
-		switch val {
-		case "+":
-			v_1 := float64(stack[len(stack)-1])
-			v_2 := float64(stack[len(stack)-2])
-			stack = stack[:len(stack)-2]
-			stack = append(stack, float64(v_1+v_2))
-		case "-":
-			v_1 := float64(stack[len(stack)-1])
-			v_2 := float64(stack[len(stack)-2])
-			stack = stack[:len(stack)-2]
-			stack = append(stack, float64(v_2-v_1))
-		case "*":
-			v_1 := float64(stack[len(stack)-1])
-			v_2 := float64(stack[len(stack)-2])
-			stack = stack[:len(stack)-2]
-			stack = append(stack, float64(v_1*v_2))
-		case "/":
-			v_1 := float64(stack[len(stack)-2])
-			v_2 := float64(stack[len(stack)-1])
-			r_1 := float64(v_1)
-			r_2 := float64(v_2)
-			stack = stack[:len(stack)-2]
-			if v_2 == 0 {
-				return 0.0, ErrDivByZero
+		if op, ok := Lookup(val); ok {
+			args := stack[len(stack)-op.Arity:]
+			res, err := op.Eval(args...)
+			if err != nil {
+				return 0.0, err
 			}
-			stack = append(stack, float64(r_1/r_2))
-		default:
-			val1, _ := strconv.ParseFloat(string(val), 64)
-			stack = append(stack, float64(val1))
+			stack = append(stack[:len(stack)-op.Arity], res)
+			continue
 		}
+		val1, _ := strconv.ParseFloat(val, 64)
+		stack = append(stack, val1)
 	}
-	return float64(stack[len(stack)-1]), nil
+	return stack[len(stack)-1], nil
 }
 
 func InfixToPostfix(expression []string) []string {
@@ -161,20 +143,21 @@ func InfixToPostfix(expression []string) []string {
 				stack = stack[:len(stack)-1]
 			}
 
-		case "+", "-":
-			for len(stack) > 0 && stack[len(stack)-1] != "(" && IsOperator(stack[len(stack)-1]) {
-				postfix = append(postfix, stack[len(stack)-1])
-				stack = stack[:len(stack)-1]
+		default:
+			op, ok := Lookup(r)
+			if !ok {
+				postfix = append(postfix, r)
+				continue
 			}
-			stack = append(stack, r)
-		case "*", "/":
-			for len(stack) > 0 && (stack[len(stack)-1] == "*" || stack[len(stack)-1] == "/") {
+			for len(stack) > 0 {
+				top, ok := Lookup(stack[len(stack)-1])
+				if !ok || top.Precedence < op.Precedence || (top.Precedence == op.Precedence && op.RightAssoc) {
+					break
+				}
 				postfix = append(postfix, stack[len(stack)-1])
 				stack = stack[:len(stack)-1]
 			}
 			stack = append(stack, r)
-		default:
-			postfix = append(postfix, r)
 		}
 	}
 	for len(stack) > 0 {
@@ -1,6 +1,7 @@
 package calc
 
 import (
+	"math"
 	"testing"
 )
 
@@ -41,6 +42,12 @@ func TestCalc(t *testing.T) {
 			expected_num: 0,
 			expected_err: ErrDivByZero,
 		},
+		{
+			name:         "power is right associative",
+			expression:   "2^3^2",
+			expected_num: 512,
+			expected_err: nil,
+		},
 		{
 			name:         "with double digit numbers",
 			expression:   "22*3",
@@ -60,3 +67,115 @@ func TestCalc(t *testing.T) {
 		})
 	}
 }
+
+func TestRegister(t *testing.T) {
+	Register(Operation{
+		Symbol:     "%",
+		Arity:      2,
+		Precedence: 2,
+		Eval: func(args ...float64) (float64, error) {
+			return math.Mod(args[0], args[1]), nil
+		},
+		DelayEnv: "TIME_MOD_MS",
+	})
+	t.Cleanup(func() {
+		delete(operations, "%")
+	})
+	val, err := Calc("2+7%4")
+	if err != nil {
+		t.Errorf("Calc(%q): unexpected error %v", "2+7%4", err)
+	}
+	if val != 5 {
+		t.Errorf("Calc(%q): expected num %.2f, got %.2f", "2+7%4", 5.0, val)
+	}
+}
+
+func TestRegisterArity(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Register: expected panic for unary operation")
+		}
+		delete(operations, "!")
+	}()
+	Register(Operation{
+		Symbol: "!",
+		Arity:  1,
+		Eval: func(args ...float64) (float64, error) {
+			return math.Gamma(args[0] + 1), nil
+		},
+	})
+}
+
+func TestExpand(t *testing.T) {
+	t.Run("one variable", func(t *testing.T) {
+		expressions, values, err := Expand("x^2+1", map[string]Range{"x": {From: -1, To: 0.5, Step: 0.5}}, 100)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := []string{"(0-1)^2+1", "(0-0.5)^2+1", "0^2+1", "0.5^2+1"}
+		if len(expressions) != len(expected) {
+			t.Fatalf("expected %v, got %v", expected, expressions)
+		}
+		for i := range expected {
+			if expressions[i] != expected[i] {
+				t.Errorf("expected %q, got %q", expected[i], expressions[i])
+			}
+		}
+		if values[0]["x"] != -1 || values[3]["x"] != 0.5 {
+			t.Errorf("unexpected values %v", values)
+		}
+		val, err := Calc(expressions[0])
+		if err != nil || val != 2 {
+			t.Errorf("Calc(%q): expected 2, got %.2f, %v", expressions[0], val, err)
+		}
+	})
+
+	t.Run("cartesian product", func(t *testing.T) {
+		expressions, _, err := Expand("x*y", map[string]Range{"x": {From: 1, To: 3, Step: 1}, "y": {From: 1, To: 2, Step: 1}}, 100)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(expressions) != 6 {
+			t.Errorf("expected 6 expressions, got %v", expressions)
+		}
+	})
+
+	t.Run("too many", func(t *testing.T) {
+		_, _, err := Expand("x", map[string]Range{"x": {From: 0, To: 100, Step: 1}}, 10)
+		if err != ErrBatchTooLarge {
+			t.Errorf("expected error %v, got %v", ErrBatchTooLarge, err)
+		}
+	})
+
+	t.Run("invalid ranges", func(t *testing.T) {
+		cases := map[string]Range{
+			"negative step": {From: 1, To: 0, Step: -1},
+			"zero step":     {From: 0, To: 1, Step: 0},
+			"backwards":     {From: 1, To: 0, Step: 1},
+			"NaN":           {From: 0, To: math.NaN(), Step: 1},
+			"Inf":           {From: 0, To: math.Inf(1), Step: 1},
+		}
+		for name, r := range cases {
+			_, _, err := Expand("x", map[string]Range{"x": r}, 10)
+			if err != ErrInvalidSweep {
+				t.Errorf("%s: expected error %v, got %v", name, ErrInvalidSweep, err)
+			}
+		}
+	})
+
+	t.Run("huge ranges", func(t *testing.T) {
+		cases := map[string]map[string]Range{
+			"overflow":   {"x": {From: 0, To: 1e300, Step: 1}},
+			"billion":    {"x": {From: 0, To: 1e9, Step: 1}},
+			"tiny step":  {"x": {From: 0, To: 1, Step: 1e-300}},
+			"product":    {"x": {From: 1, To: 8, Step: 1}, "y": {From: 1, To: 8, Step: 1}},
+			"full range": {"x": {From: -math.MaxFloat64, To: math.MaxFloat64, Step: 1}},
+		}
+		for name, sweep := range cases {
+			_, _, err := Expand("x*y", sweep, 10)
+			if err != ErrBatchTooLarge {
+				t.Errorf("%s: expected error %v, got %v", name, ErrBatchTooLarge, err)
+			}
+		}
+	})
+}
@@ -3,14 +3,25 @@ package calc
 import "errors"
 
 var (
-	ErrDivByZero       = errors.New("Деление на ноль! Мы не высшая математика, так что иди лесом!")
-	ErrInvalidBracket  = errors.New("Товарищ пользователь! Проверьте скобки и точки!")
-	ErrInvalidOperands = errors.New("Товарищ пользователь! Проверьте количество операндов(+,-,/,*), их порядок и проверьте что нет буков")
-	ErrInvalidJson     = errors.New("Товарищ пользователь! Проверьте правильность написания json'а")
-	ErrEmptyJson       = errors.New("Пустой запрос!")
-	ErrEmptyExpression = errors.New("Пустое выражение/json!")
-	ErrExpJWTToken     = errors.New("Токен протух")
-	ErrInvalidJWTToken = errors.New("Невалидный токен")
+	ErrDivByZero        = errors.New("Деление на ноль! Мы не высшая математика, так что иди лесом!")
+	ErrInvalidBracket   = errors.New("Товарищ пользователь! Проверьте скобки и точки!")
+	ErrInvalidOperands  = errors.New("Товарищ пользователь! Проверьте количество операндов у операторов, их порядок и проверьте что нет буков")
+	ErrInvalidJson      = errors.New("Товарищ пользователь! Проверьте правильность написания json'а")
+	ErrEmptyJson        = errors.New("Пустой запрос!")
+	ErrEmptyExpression  = errors.New("Пустое выражение/json!")
+	ErrExpJWTToken      = errors.New("Токен протух")
+	ErrInvalidJWTToken  = errors.New("Невалидный токен")
+	ErrInvalidPriority  = errors.New("Товарищ пользователь! Приоритет может быть только high, normal или batch")
+	ErrBatchTooLarge    = errors.New("Товарищ пользователь! Слишком много выражений в одном запросе")
+	ErrInvalidSweep     = errors.New("Товарищ пользователь! Проверьте диапазоны переменных: шаг должен быть положительным, а to - не меньше from")
+	ErrInvalidCallback  = errors.New("Товарищ пользователь! callback_url должен быть полным адресом http или https")
+	ErrPrivateCallback  = errors.New("Товарищ пользователь! callback_url не может вести во внутреннюю сеть")
+	ErrCallbackSweep    = errors.New("Товарищ пользователь! Для перебора callback_url не поддерживается")
+	ErrImportFile       = errors.New("Товарищ пользователь! Приложите файл в поле file запроса multipart/form-data")
+	ErrImportEmpty      = errors.New("Товарищ пользователь! В файле нет ни одного выражения")
+	ErrImportTooLarge   = errors.New("Товарищ пользователь! Файл слишком большой или в нём слишком много строк")
+	ErrImportCSV        = errors.New("Товарищ пользователь! Проверьте CSV: кавычки должны быть парными")
+	ErrUnknownOperation = errors.New("Агент не знает такой операции")
 
-	Errors = []error{ErrDivByZero, ErrInvalidBracket, ErrInvalidOperands, ErrInvalidJson, ErrEmptyJson, ErrEmptyExpression, ErrExpJWTToken, ErrInvalidJWTToken}
+	Errors = []error{ErrDivByZero, ErrInvalidBracket, ErrInvalidOperands, ErrInvalidJson, ErrEmptyJson, ErrEmptyExpression, ErrExpJWTToken, ErrInvalidJWTToken, ErrInvalidPriority, ErrBatchTooLarge, ErrInvalidSweep, ErrInvalidCallback, ErrPrivateCallback, ErrCallbackSweep, ErrImportFile, ErrImportEmpty, ErrImportTooLarge, ErrImportCSV, ErrUnknownOperation}
 )
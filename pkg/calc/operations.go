@@ -0,0 +1,98 @@
+package calc
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Operation описывает оператор целиком: его знают парсер, оркестратор и агент.
+// Чтобы добавить новый оператор, достаточно вызвать Register.
+type Operation struct {
+	Symbol     string
+	Arity      int
+	Precedence int
+	RightAssoc bool
+	Eval       func(args ...float64) (float64, error)
+	// Переменная окружения с задержкой операции в миллисекундах.
+	DelayEnv string
+}
+
+var operations = make(map[string]Operation)
+
+// Register добавляет оператор. Задачи оркестратора бинарные, поэтому оператор другой арности -
+// ошибка программиста, и Register паникует.
+func Register(op Operation) {
+	if op.Arity != 2 {
+		panic(fmt.Sprintf("calc: оператор %q с арностью %d не поддерживается, нужна 2", op.Symbol, op.Arity))
+	}
+	operations[op.Symbol] = op
+}
+
+func Lookup(symbol string) (Operation, bool) {
+	op, ok := operations[symbol]
+	return op, ok
+}
+
+func Operations() []Operation {
+	res := make([]Operation, 0, len(operations))
+	for _, op := range operations {
+		res = append(res, op)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Symbol < res[j].Symbol
+	})
+	return res
+}
+
+func init() {
+	Register(Operation{
+		Symbol:     "+",
+		Arity:      2,
+		Precedence: 1,
+		Eval: func(args ...float64) (float64, error) {
+			return args[0] + args[1], nil
+		},
+		DelayEnv: "TIME_ADDITION_MS",
+	})
+	Register(Operation{
+		Symbol:     "-",
+		Arity:      2,
+		Precedence: 1,
+		Eval: func(args ...float64) (float64, error) {
+			return args[0] - args[1], nil
+		},
+		DelayEnv: "TIME_SUBTRACTION_MS",
+	})
+	Register(Operation{
+		Symbol:     "*",
+		Arity:      2,
+		Precedence: 2,
+		Eval: func(args ...float64) (float64, error) {
+			return args[0] * args[1], nil
+		},
+		DelayEnv: "TIME_MULTIPLICATIONS_MS",
+	})
+	Register(Operation{
+		Symbol:     "/",
+		Arity:      2,
+		Precedence: 2,
+		Eval: func(args ...float64) (float64, error) {
+			if args[1] == 0 {
+				return args[0] / args[1], ErrDivByZero
+			}
+			return args[0] / args[1], nil
+		},
+		DelayEnv: "TIME_DIVISIONS_MS",
+	})
+	Register(Operation{
+		Symbol:     "^",
+		Arity:      2,
+		Precedence: 3,
+		RightAssoc: true,
+		Eval: func(args ...float64) (float64, error) {
+			return math.Pow(args[0], args[1]), nil
+		},
+		DelayEnv: "TIME_POWER_MS",
+	})
+}
@@ -44,6 +44,12 @@ func (s *SafeMap) Set(key int, value models.Expressions) {
 	s.m[key] = value
 }
 
+func (s *SafeMap) Delete(key int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.m, key)
+}
+
 func (s *SafeMap) GetAll() []models.Expressions {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
@@ -0,0 +1,99 @@
+package calc
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+type Range struct {
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+	Step float64 `json:"step"`
+}
+
+var identifier = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// count - сколько значений в диапазоне. Считается во float до выделения памяти: диапазон приходит
+// от клиента, и {"to":1e300} не должен превратиться в make на миллиарды элементов.
+func (r Range) count(limit int) (int, error) {
+	for _, v := range []float64{r.From, r.To, r.Step} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, ErrInvalidSweep
+		}
+	}
+	if r.Step <= 0 || r.To < r.From {
+		return 0, ErrInvalidSweep
+	}
+	cnt := math.Floor((r.To-r.From)/r.Step+1e-9) + 1
+	if cnt > float64(limit) {
+		return 0, ErrBatchTooLarge
+	}
+	return int(cnt), nil
+}
+
+func (r Range) values(cnt int) []float64 {
+	res := make([]float64, cnt)
+	for i := range res {
+		res[i] = math.Round((r.From+float64(i)*r.Step)*1e10) / 1e10
+	}
+	return res
+}
+
+// Отрицательные числа парсер не понимает, поэтому подставляем их как (0-x).
+func formatValue(v float64) string {
+	if v < 0 {
+		return "(0-" + strconv.FormatFloat(-v, 'f', -1, 64) + ")"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func Substitute(template string, values map[string]float64) string {
+	return identifier.ReplaceAllStringFunc(template, func(name string) string {
+		if v, ok := values[name]; ok {
+			return formatValue(v)
+		}
+		return name
+	})
+}
+
+// Expand раскрывает шаблон во все комбинации значений переменных(декартово произведение).
+func Expand(template string, sweep map[string]Range, limit int) ([]string, []map[string]float64, error) {
+	if len(sweep) == 0 {
+		return nil, nil, ErrInvalidSweep
+	}
+	names := make([]string, 0, len(sweep))
+	for name := range sweep {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	combinations := []map[string]float64{{}}
+	for _, name := range names {
+		cnt, err := sweep[name].count(limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(combinations)*cnt > limit {
+			return nil, nil, ErrBatchTooLarge
+		}
+		values := sweep[name].values(cnt)
+		next := make([]map[string]float64, 0, len(combinations)*len(values))
+		for _, combination := range combinations {
+			for _, v := range values {
+				c := make(map[string]float64, len(combination)+1)
+				for k, val := range combination {
+					c[k] = val
+				}
+				c[name] = v
+				next = append(next, c)
+			}
+		}
+		combinations = next
+	}
+	expressions := make([]string, len(combinations))
+	for i, combination := range combinations {
+		expressions[i] = Substitute(template, combination)
+	}
+	return expressions, combinations, nil
+}